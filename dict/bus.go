@@ -0,0 +1,97 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"sync"
+)
+
+/*
+ * This file contains the invalidation bus through which the dataset caches of multiple instances
+ * notify each other about the updated datasets
+ */
+
+//InvalidationMessage is the message published on the invalidation bus when a dataset is updated
+type InvalidationMessage struct {
+	//Origin is the id of the dataset cache which published the message
+	Origin string `json:"origin"`
+	//DatasetID is the id of the dataset to be invalidated
+	DatasetID string `json:"dataset_id"`
+	//All indicates that all the cached datasets are to be invalidated since the messages sent to the
+	//subscriber may have been lost
+	All bool `json:"all,omitempty"`
+}
+
+//InvalidationBus is the bus through which the dataset caches of multiple instances publish and receive dataset invalidations
+type InvalidationBus interface {
+	//Publish publishes the message to all the subscribers of the bus including the publisher itself
+	Publish(ctx context.Context, msg InvalidationMessage) error
+	//Subscribe returns the channel on which the messages published on the bus are received.
+	//The returned function has to be called to cancel the subscription, after which the channel is closed.
+	Subscribe() (<-chan InvalidationMessage, func(), error)
+}
+
+//LocalInvalidationBufferSize is the no. of messages buffered for a subscriber of the local invalidation bus
+const LocalInvalidationBufferSize = 64
+
+//LocalInvalidationBus is an in process invalidation bus. It can be used to share invalidations between
+//the dataset caches living in the same process
+type LocalInvalidationBus struct {
+	m    sync.Mutex
+	subs map[int]chan InvalidationMessage
+	next int
+}
+
+//NewLocalInvalidationBus returns a new in process invalidation bus
+func NewLocalInvalidationBus() *LocalInvalidationBus {
+	return &LocalInvalidationBus{subs: map[int]chan InvalidationMessage{}}
+}
+
+//Publish publishes the message to all the subscribers of the bus. Publishing never blocks. If the buffer of a
+//subscriber is full, the buffered messages are replaced with a message invalidating all the datasets,
+//so that the subscriber doesn't miss any invalidation
+func (b *LocalInvalidationBus) Publish(ctx context.Context, msg InvalidationMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- msg:
+			continue
+		default:
+		}
+		//the subscriber overflowed. the buffered messages are dropped in favour of invalidating all the datasets
+		for len(ch) > 0 {
+			select {
+			case <-ch:
+			default:
+			}
+		}
+		ch <- InvalidationMessage{All: true}
+	}
+	return nil
+}
+
+//Subscribe returns the channel on which the messages published on the bus are received
+func (b *LocalInvalidationBus) Subscribe() (<-chan InvalidationMessage, func(), error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	id := b.next
+	b.next++
+	ch := make(chan InvalidationMessage, LocalInvalidationBufferSize)
+	b.subs[id] = ch
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.m.Lock()
+			delete(b.subs, id)
+			close(ch)
+			b.m.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocalInvalidationBusFlushesAnOverflowedSubscriber(t *testing.T) {
+	b := NewLocalInvalidationBus()
+	ch, cancel, err := b.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; i <= LocalInvalidationBufferSize; i++ {
+			if pErr := b.Publish(context.Background(), InvalidationMessage{Origin: "a", DatasetID: "1"}); pErr != nil {
+				err = pErr
+			}
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the message overflowing the buffer to be published, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("publishing to a subscriber not receiving the messages blocked")
+	}
+	if len(ch) != 1 {
+		t.Fatalf("expected the buffered messages to be replaced by a single message, got %d", len(ch))
+	}
+	if msg := <-ch; !msg.All || len(msg.Origin) != 0 {
+		t.Errorf("expected a message invalidating all the datasets from no origin, got %+v", msg)
+	}
+}
+
+func TestInvalidateAllOverTheBus(t *testing.T) {
+	b := NewLocalInvalidationBus()
+	conf := DefaultDatasetCacheConfig()
+	conf.Bus = b
+	agg := newFakeAggregator()
+	c := startCache(agg, conf)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := c.GetMany(ctx, []string{"1", "2"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan DatasetEvent, 10)
+	defer c.Observe(DatasetObserverFunc(func(e DatasetEvent) {
+		events <- e
+	}))()
+	if err := b.Publish(ctx, InvalidationMessage{All: true}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-events:
+			if e.Type != DatasetUpdated {
+				t.Errorf("expected the updated events of the invalidated datasets, got %s", e.Type)
+			}
+		case <-ctx.Done():
+			t.Fatal("expected all the cached datasets to be invalidated")
+		}
+	}
+	if _, err := c.GetMany(ctx, []string{"1", "2"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if agg.count("1") != 2 || agg.count("2") != 2 {
+		t.Errorf("expected the invalidated datasets to be loaded again, got %d and %d loads", agg.count("1"), agg.count("2"))
+	}
+}
+
+func TestCloseWithTheBusAfterShutdown(t *testing.T) {
+	b := NewLocalInvalidationBus()
+	conf := DefaultDatasetCacheConfig()
+	conf.Bus = b
+	c := startCache(newFakeAggregator(), conf)
+	other := startCache(newFakeAggregator(), conf)
+	defer other.Close()
+
+	//the cache keeps draining the bus while it is draining the requests in progress
+	c.lm.Lock()
+	c.state = cacheDraining
+	c.lm.Unlock()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < LocalInvalidationBufferSize*4; i++ {
+			other.Invalidate("1")
+		}
+		c.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("invalidating over the bus of a draining cache blocked its close")
+	}
+}
@@ -0,0 +1,1176 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cuttle-ai/brain/log"
+	"github.com/cuttle-ai/octopus/interpreter"
+	"github.com/google/uuid"
+)
+
+/*
+ * This file contains the implementation of the dataset cache
+ */
+
+//DatasetRequestType is the type of the request for the dataset
+type DatasetRequestType uint
+
+const (
+	//DatasetUpdate comes to update and datatset and update corresponding subscribed ids
+	DatasetUpdate DatasetRequestType = 1
+	//DatasetGet returns the dataset of a given id
+	DatasetGet DatasetRequestType = 2
+	//DatasetRemove to remove the dataset from the cache
+	DatasetRemove DatasetRequestType = 3
+	//DatasetInvalidate removes a given dataset from the cache and drops the DICTs of the subscribed ids
+	DatasetInvalidate DatasetRequestType = 4
+	//DatasetPatch applies a node level diff on a given dataset and drops the DICTs of the subscribed ids
+	DatasetPatch DatasetRequestType = 5
+	//DatasetUnsubscribe unsubscribes the subscribe id from a given dataset
+	DatasetUnsubscribe DatasetRequestType = 6
+	//DatasetSubscribers returns the ids subscribed to a given dataset
+	DatasetSubscribers DatasetRequestType = 7
+	//DatasetSyncSubscriptions subscribes the subscribe id to the given dataset ids and unsubscribes it from the rest
+	DatasetSyncSubscriptions DatasetRequestType = 8
+	//DatasetSnapshot returns all the cached datasets
+	DatasetSnapshot DatasetRequestType = 9
+	//DatasetGetMany returns the datasets of the given ids. The datasets missing in the cache are loaded in a single batch
+	DatasetGetMany DatasetRequestType = 10
+	//DatasetInvalidateAll removes all the datasets from the cache and drops the DICTs of all the subscribed ids
+	DatasetInvalidateAll DatasetRequestType = 11
+)
+
+//DatasetClearCheckInterval is the default interval after which the datatset removal check has to run
+const DatasetClearCheckInterval = time.Minute * 20
+
+//DatasetExpiry is the default expiry time after which the datatset expiries without any active usage
+const DatasetExpiry = time.Hour * 4
+
+//DatasetCacheConfig has the configuration for a dataset cache
+type DatasetCacheConfig struct {
+	//MaxEntries is the maximum no. of datasets to be kept in the cache. Zero means no limit
+	MaxEntries int
+	//MaxBytes is the maximum estimated memory in bytes held by the tokens of the cached datasets. Zero means no limit
+	MaxBytes int64
+	//TTL is the time after which a dataset expires from the cache without any active usage
+	TTL time.Duration
+	//SweepInterval is the interval after which the check for expired datasets has to run
+	SweepInterval time.Duration
+	//Bus is the invalidation bus through which the updates of the datasets are shared with the other instances.
+	//Updates aren't shared if not set
+	Bus InvalidationBus
+	//Logger is the logger to be used by the cache. Defaults to log.NewLogger()
+	Logger log.Log
+	//SnapshotDir is the directory to which the snapshots of the cached datasets are written on shutdown.
+	//The snapshots are restored on start if the aggregator implements DatasetVersioner. Snapshots aren't used if empty
+	SnapshotDir string
+}
+
+//DefaultDatasetCacheConfig returns the default configuration of the dataset cache.
+//It doesn't limit the no. of datasets or their size
+func DefaultDatasetCacheConfig() DatasetCacheConfig {
+	return DatasetCacheConfig{
+		TTL:           DatasetExpiry,
+		SweepInterval: DatasetClearCheckInterval,
+	}
+}
+
+var (
+	//ErrDatasetCacheClosed is returned when a request is made to a dataset cache which is already closed
+	ErrDatasetCacheClosed = errors.New("dataset cache is closed")
+	//ErrDatasetCacheNotStarted is returned when a request is made to a dataset cache which is not started yet
+	ErrDatasetCacheNotStarted = errors.New("dataset cache is not started")
+	//ErrDatasetNotFound is returned when the dataset couldn't be found in the cache or from the aggregator
+	ErrDatasetNotFound = errors.New("dataset couldn't be found")
+)
+
+//DatasetAggregator is the aggregator to get the dict from a service or database
+type DatasetAggregator interface {
+	GetDataset(ID string) (Dataset, error)
+}
+
+//BatchDatasetAggregator is an aggregator which can load several datasets at once.
+//The datasets missing in the cache for a get many request are loaded with a single call to it
+type BatchDatasetAggregator interface {
+	DatasetAggregator
+	//GetDatasets returns the datasets of the given ids mapped to their ids
+	GetDatasets(IDs []string) (map[string]Dataset, error)
+}
+
+//Dataset is the dataset instance having the node tokens
+type Dataset struct {
+	D        map[string]interpreter.Token
+	LastUsed time.Time
+	//UpdatedAt is the update time of the dataset when its tokens were built. It is used to validate its snapshots
+	UpdatedAt time.Time
+}
+
+//DatasetRequest can be used to make a request to get the dataset cache
+type DatasetRequest struct {
+	//ID of the dataset
+	ID string
+	//SubscribeID is the id which subscribes to the dataset
+	SubscribeID string
+	//Type is the type of the dictionary request. It can have Add, Get, Remove
+	Type DatasetRequestType
+	//Dataset has the tokens mapped to the token string for the dataset
+	Dataset Dataset
+	//Diff is the node level diff to be applied on the dataset for the patch requests
+	Diff NodeDiff
+	//Subscribers has the ids subscribed to the dataset for the subscribers requests
+	Subscribers []string
+	//DatasetIDs has the ids of the datasets the subscribe id still has access to for the sync subscriptions requests
+	//and the ids of the datasets to get for the get many requests
+	DatasetIDs []string
+	//Datasets has the cached datasets mapped to their ids for the snapshot requests and the datasets found for the get many requests
+	Datasets map[string]Dataset
+	//Valid indicates that the dict is valid. During get requests, if valid is false then cache couldn't find the dict
+	Valid bool
+	//Out channel for sending response to the requester
+	Out chan DatasetRequest
+}
+
+//SendDatasetToChannel sends a dataset request to the channel. This function is to be used with go routines so that
+//datasets isn't blocked by the requests
+func SendDatasetToChannel(ch chan DatasetRequest, req DatasetRequest) {
+	ch <- req
+}
+
+//cacheState is the state in the lifecycle of a dataset cache
+type cacheState uint
+
+const (
+	//cacheNew is the state of a cache which is not started yet
+	cacheNew cacheState = iota
+	//cacheRunning is the state of a cache serving the requests
+	cacheRunning
+	//cacheDraining is the state of a cache waiting for the requests in progress to complete before closing
+	cacheDraining
+	//cacheClosed is the state of a closed cache
+	cacheClosed
+)
+
+//DatasetCache is the cache providing the datatsets. When a dataset is updated, coresponding users who all have
+//access to that dataset get their DICTs updated automatically.
+//Multiple caches can exist side by side since each of them owns its own state and go routines.
+type DatasetCache struct {
+	//id uniquely identifies the cache on the invalidation bus
+	id        string
+	in        chan DatasetRequest
+	loaded    chan loadResult
+	done      chan struct{}
+	closeOnce sync.Once
+	//lm guards the lifecycle state and the no. of requests in progress
+	lm        sync.Mutex
+	state     cacheState
+	inflight  int
+	drained   chan struct{}
+	agg       DatasetAggregator
+	conf      DatasetCacheConfig
+	busCancel func()
+	metrics   *CacheMetrics
+	m         sync.Mutex
+	//observers has the observers of the events of the datasets
+	observers observers
+
+	//the following are owned by the run go routine of the cache and mustn't be accessed elsewhere
+	//subscriptions has the ids subscribed to the datasets
+	subscriptions *subscriptions
+	//datasets has the cached datasets
+	datasets *lruStore
+	//flights has the aggregator loads which are in progress mapped to their generation
+	flights map[uint64]*flight
+	//latest has the generation of the latest load in progress for a dataset
+	latest map[string]uint64
+	//gen is the generation of the last load started
+	gen uint64
+}
+
+//flight is a load of a dataset from the aggregator which is in progress.
+//All the get requests for the dataset arriving during the load wait for the same flight
+type flight struct {
+	//update indicates that the flight was started by an update request
+	update bool
+	//waiters are the requests waiting for the load to complete
+	waiters []DatasetRequest
+	//batches are the get many requests waiting for the load to complete
+	batches []*batch
+}
+
+//batch is a get many request waiting for the loads of its datasets missing in the cache
+type batch struct {
+	req DatasetRequest
+	//ids are the unique ids of the datasets of the request
+	ids []string
+	//pending is the no. of datasets of the request still being loaded
+	pending int
+}
+
+//loadResult is the result of a load from the aggregator
+type loadResult struct {
+	ID      string
+	gen     uint64
+	dataset Dataset
+	valid   bool
+	//err is the error of the load if it is not valid
+	err error
+	//duration is the time taken by the load
+	duration time.Duration
+}
+
+//NewDatasetCache returns a new dataset cache which uses the given aggregator to load the datasets on a cache miss.
+//The TTL and SweepInterval of the config fall back to their defaults if not set.
+//The cache has to be started with Start before making any requests and stopped with Shutdown or Close.
+func NewDatasetCache(agg DatasetAggregator, conf DatasetCacheConfig) *DatasetCache {
+	if conf.TTL <= 0 {
+		conf.TTL = DatasetExpiry
+	}
+	if conf.SweepInterval <= 0 {
+		conf.SweepInterval = DatasetClearCheckInterval
+	}
+	if conf.Logger == nil {
+		conf.Logger = log.NewLogger()
+	}
+	c := &DatasetCache{
+		id:            uuid.New().String(),
+		in:            make(chan DatasetRequest),
+		loaded:        make(chan loadResult),
+		done:          make(chan struct{}),
+		drained:       make(chan struct{}),
+		agg:           agg,
+		conf:          conf,
+		metrics:       newCacheMetrics(),
+		subscriptions: newSubscriptions(),
+		datasets:      newLRUStore(conf.MaxEntries, conf.MaxBytes),
+		flights:       map[uint64]*flight{},
+		latest:        map[string]uint64{},
+		observers:     observers{obs: map[int]*observer{}, drops: map[int]DICTDropFunc{}},
+	}
+	return c
+}
+
+//Start starts the go routines of the cache serving the requests, sweeping the expired datasets and
+//listening to the invalidation bus. Starting a cache which is already started or closed has no effect
+func (c *DatasetCache) Start() {
+	c.lm.Lock()
+	defer c.lm.Unlock()
+	if c.state != cacheNew {
+		return
+	}
+	c.state = cacheRunning
+	if len(c.conf.SnapshotDir) > 0 {
+		c.restore()
+	}
+	go c.run()
+	go c.clearCheck()
+	if c.conf.Bus != nil {
+		ch, cancel, err := c.conf.Bus.Subscribe()
+		if err != nil {
+			c.conf.Logger.Error("error while subscribing to the invalidation bus. updates from other instances won't be received", err)
+		} else {
+			c.busCancel = cancel
+			go c.listen(ch)
+		}
+	}
+}
+
+//Shutdown gracefully stops the cache. The snapshots of the cached datasets are written if the cache has a snapshot directory.
+//A cache which isn't running is closed at once without writing the snapshots.
+//New requests are rejected with ErrDatasetCacheClosed while the requests in progress are allowed to complete.
+//If the context is done before that, the cache is closed immediately and the error of the context is returned
+func (c *DatasetCache) Shutdown(ctx context.Context) error {
+	/*
+	 * We will check if the cache is running
+	 * We will write the snapshots
+	 * We will move the cache to draining state
+	 * Then we will wait for the requests in progress to complete
+	 * Finally we will close the cache
+	 */
+	//a cache which isn't running has nothing to snapshot or drain
+	if !c.running() {
+		c.Close()
+		return nil
+	}
+
+	if err := c.Snapshot(ctx); err != nil {
+		c.conf.Logger.Error("error while writing the snapshots of the cached datasets", err)
+	}
+
+	c.lm.Lock()
+	if c.state != cacheRunning {
+		c.lm.Unlock()
+		c.Close()
+		return nil
+	}
+	c.state = cacheDraining
+	if c.inflight == 0 {
+		close(c.drained)
+	}
+	c.lm.Unlock()
+
+	//waiting for the requests in progress
+	var err error
+	select {
+	case <-c.drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.Close()
+	return err
+}
+
+//Close stops the cache immediately. Any request in progress or made after closing the cache will return ErrDatasetCacheClosed
+func (c *DatasetCache) Close() {
+	c.closeOnce.Do(func() {
+		c.lm.Lock()
+		c.state = cacheClosed
+		c.lm.Unlock()
+		close(c.done)
+		if c.busCancel != nil {
+			c.busCancel()
+		}
+	})
+}
+
+//running returns true if the cache is started and not yet shutting down
+func (c *DatasetCache) running() bool {
+	c.lm.Lock()
+	defer c.lm.Unlock()
+	return c.state == cacheRunning
+}
+
+//enter registers a request in progress. Returns error if the cache is not accepting the requests
+func (c *DatasetCache) enter() error {
+	c.lm.Lock()
+	defer c.lm.Unlock()
+	switch c.state {
+	case cacheNew:
+		return ErrDatasetCacheNotStarted
+	case cacheRunning:
+		c.inflight++
+		return nil
+	default:
+		return ErrDatasetCacheClosed
+	}
+}
+
+//exit marks the completion of a request in progress
+func (c *DatasetCache) exit() {
+	c.lm.Lock()
+	defer c.lm.Unlock()
+	c.inflight--
+	if c.inflight == 0 && c.state == cacheDraining {
+		close(c.drained)
+	}
+}
+
+//SetAggregator sets the aggregator to be used by the cache for loading the datasets
+func (c *DatasetCache) SetAggregator(agg DatasetAggregator) {
+	c.m.Lock()
+	c.agg = agg
+	c.m.Unlock()
+}
+
+//Metrics returns the metrics of the cache
+func (c *DatasetCache) Metrics() *CacheMetrics {
+	return c.metrics
+}
+
+//MetricsHandler returns the http handler serving the metrics of the cache in the prometheus text exposition format
+func (c *DatasetCache) MetricsHandler() http.Handler {
+	return c.metrics
+}
+
+//Get returns the dataset with the given id. If subscribeID is not empty, the id will be subscribed to the
+//updates of the dataset. The request is abandoned if the context gets cancelled or its deadline exceeds.
+func (c *DatasetCache) Get(ctx context.Context, ID string, subscribeID string) (Dataset, error) {
+	return c.request(ctx, DatasetRequest{ID: ID, SubscribeID: subscribeID, Type: DatasetGet})
+}
+
+//GetMany returns the datasets with the given ids mapped to their ids. The cached datasets are served at once and
+//the rest are loaded together, in a single call to the aggregator if it is a BatchDatasetAggregator.
+//The datasets which couldn't be found are left out. If subscribeID is not empty, the id will be subscribed to the
+//updates of the datasets found. The request is abandoned if the context gets cancelled or its deadline exceeds.
+func (c *DatasetCache) GetMany(ctx context.Context, IDs []string, subscribeID string) (map[string]Dataset, error) {
+	res, err := c.do(ctx, DatasetRequest{DatasetIDs: IDs, SubscribeID: subscribeID, Type: DatasetGetMany})
+	if err != nil {
+		return nil, err
+	}
+	return res.Datasets, nil
+}
+
+//Update reloads the dataset with the given id from the aggregator and drops the DICTs of the subscribed ids.
+//The request is abandoned if the context gets cancelled or its deadline exceeds.
+//The update is published on the invalidation bus if the cache has one.
+func (c *DatasetCache) Update(ctx context.Context, ID string) (Dataset, error) {
+	d, err := c.request(ctx, DatasetRequest{ID: ID, Type: DatasetUpdate})
+	if err != ErrDatasetCacheClosed {
+		c.publish(ctx, ID)
+	}
+	return d, err
+}
+
+//UpdateMany reloads the datasets with the given ids from the aggregator in a single batch and subscribes the id to them.
+//The datasets are invalidated first, dropping the DICTs of their subscribed ids, and then loaded together as in GetMany.
+//The datasets which fail to load are left out of the result. The updates are published on the invalidation bus if the cache has one.
+func (c *DatasetCache) UpdateMany(ctx context.Context, IDs []string, subscribeID string) (map[string]Dataset, error) {
+	/*
+	 * We will invalidate the datasets
+	 * Then we will load them together
+	 * Then we will publish the updates
+	 */
+	//invalidating the datasets. loads in progress for them won't be cached
+	for _, ID := range IDs {
+		if err := c.invalidate(ID); err != nil {
+			return nil, err
+		}
+	}
+
+	//loading the datasets
+	result, err := c.GetMany(ctx, IDs, subscribeID)
+	if err == ErrDatasetCacheClosed {
+		return result, err
+	}
+
+	//publishing the updates
+	for _, ID := range IDs {
+		c.publish(ctx, ID)
+	}
+	return result, err
+}
+
+//Patch applies the node level diff on the cached dataset with the given id instead of reloading the whole dataset.
+//The DICTs of the subscribed ids are dropped so that they are merged and ranked again from the patched dataset without
+//re-tokenising it. Patching a DICT in place would race with its rebuilds and leave its tokens out of rank.
+//If the dataset isn't cached, it will be loaded with the changes on the next get request.
+//The other instances on the invalidation bus invalidate the dataset since they don't receive the diff.
+func (c *DatasetCache) Patch(ctx context.Context, ID string, diff NodeDiff) error {
+	_, err := c.request(ctx, DatasetRequest{ID: ID, Type: DatasetPatch, Diff: diff})
+	if err == ErrDatasetNotFound {
+		err = nil
+	}
+	if err != ErrDatasetCacheClosed {
+		c.publish(ctx, ID)
+	}
+	return err
+}
+
+//Invalidate removes the dataset with the given id from the cache and drops the DICTs of the subscribed ids.
+//The dataset will be loaded again from the aggregator on the next get request.
+//The invalidation is published on the invalidation bus if the cache has one.
+func (c *DatasetCache) Invalidate(ID string) error {
+	err := c.invalidate(ID)
+	if err == nil {
+		c.publish(context.Background(), ID)
+	}
+	return err
+}
+
+//invalidate invalidates the dataset in the cache without publishing it on the invalidation bus
+func (c *DatasetCache) invalidate(ID string) error {
+	return c.send(DatasetRequest{ID: ID, Type: DatasetInvalidate})
+}
+
+//invalidateAll invalidates all the datasets in the cache without publishing it on the invalidation bus
+func (c *DatasetCache) invalidateAll() error {
+	return c.send(DatasetRequest{Type: DatasetInvalidateAll})
+}
+
+//Unsubscribe unsubscribes the subscriber from the updates of the dataset
+func (c *DatasetCache) Unsubscribe(datasetID, subscriberID string) error {
+	return c.send(DatasetRequest{ID: datasetID, SubscribeID: subscriberID, Type: DatasetUnsubscribe})
+}
+
+//SyncSubscriptions subscribes the subscriber to the given datasets and unsubscribes it from all the other datasets.
+//It is to be used when the list of datasets a subscriber has access to changes
+func (c *DatasetCache) SyncSubscriptions(subscriberID string, datasetIDs []string) error {
+	return c.send(DatasetRequest{SubscribeID: subscriberID, DatasetIDs: datasetIDs, Type: DatasetSyncSubscriptions})
+}
+
+//Subscribers returns the sorted list of ids currently subscribed to the dataset
+func (c *DatasetCache) Subscribers(ctx context.Context, datasetID string) ([]string, error) {
+	res, err := c.do(ctx, DatasetRequest{ID: datasetID, Type: DatasetSubscribers})
+	if err != nil {
+		return nil, err
+	}
+	return res.Subscribers, nil
+}
+
+//Snapshot writes the snapshots of the cached datasets to the snapshot directory of the cache.
+//It has no effect if the cache doesn't have a snapshot directory
+func (c *DatasetCache) Snapshot(ctx context.Context) error {
+	/*
+	 * We will get the cached datasets
+	 * Then we will write the snapshot of each of them
+	 */
+	if len(c.conf.SnapshotDir) == 0 {
+		return nil
+	}
+	res, err := c.do(ctx, DatasetRequest{Type: DatasetSnapshot})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(c.conf.SnapshotDir, 0755); err != nil {
+		return err
+	}
+	for k, d := range res.Datasets {
+		if wErr := writeSnapshotFile(c.conf.SnapshotDir, Snapshot{ID: k, Dataset: d}); wErr != nil {
+			c.conf.Logger.Error("error while writing the snapshot of the dataset", k, wErr)
+			err = wErr
+		}
+	}
+	return err
+}
+
+//restore restores the cached datasets from the snapshots in the snapshot directory. The snapshots older than
+//the latest update of their datasets and the corrupt ones are removed. It is to be called before the cache starts running
+func (c *DatasetCache) restore() {
+	/*
+	 * We will read the snapshots
+	 * Then we will get the latest update time of their datasets
+	 * Then we will cache the valid snapshots and remove the others
+	 */
+	c.m.Lock()
+	versioner, ok := c.agg.(DatasetVersioner)
+	c.m.Unlock()
+	if !ok {
+		c.conf.Logger.Warn("not restoring the dataset snapshots since the aggregator can't validate them")
+		return
+	}
+
+	//reading the snapshots
+	snaps, invalid, err := readSnapshotFiles(c.conf.SnapshotDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		c.conf.Logger.Error("error while reading the dataset snapshots from", c.conf.SnapshotDir, err)
+		return
+	}
+	for _, p := range invalid {
+		c.conf.Logger.Warn("removing the dataset snapshot which couldn't be read", p)
+		os.Remove(p)
+	}
+	if len(snaps) == 0 {
+		return
+	}
+
+	//getting the latest update time of the datasets
+	ids := make([]string, 0, len(snaps))
+	for _, s := range snaps {
+		ids = append(ids, s.ID)
+	}
+	versions, err := versioner.DatasetsUpdatedAt(ids)
+	if err != nil {
+		c.conf.Logger.Error("error while getting the update time of the datasets for validating their snapshots", err)
+		return
+	}
+
+	//caching the valid snapshots
+	restored := 0
+	for _, s := range snaps {
+		latest, ok := versions[s.ID]
+		if !ok || latest.After(s.Dataset.UpdatedAt) {
+			os.Remove(snapshotPath(c.conf.SnapshotDir, s.ID))
+			continue
+		}
+		s.Dataset.LastUsed = time.Now()
+		c.datasets.add(s.ID, s.Dataset)
+		restored++
+	}
+	c.metrics.setCached(c.datasets.len(), c.datasets.bytes)
+	c.conf.Logger.Info("restored", restored, "datasets from the snapshots of", len(snaps), "datasets")
+}
+
+//send sends the request to the cache without waiting for a response
+func (c *DatasetCache) send(req DatasetRequest) error {
+	if err := c.enter(); err != nil {
+		return err
+	}
+	defer c.exit()
+	select {
+	case c.in <- req:
+		return nil
+	case <-c.done:
+		return ErrDatasetCacheClosed
+	}
+}
+
+//publish publishes the invalidation of the dataset on the invalidation bus
+func (c *DatasetCache) publish(ctx context.Context, ID string) {
+	if c.conf.Bus == nil {
+		return
+	}
+	err := c.conf.Bus.Publish(ctx, InvalidationMessage{Origin: c.id, DatasetID: ID})
+	if err != nil {
+		c.conf.Logger.Error("error while publishing the invalidation of the dataset", ID, err)
+	}
+}
+
+//listen invalidates the datasets for the invalidations received from the other instances over the bus.
+//It keeps draining the channel till the subscription is cancelled on closing the cache, so that the
+//publishers are never held up by a cache which is draining or closed
+func (c *DatasetCache) listen(ch <-chan InvalidationMessage) {
+	for msg := range ch {
+		if msg.Origin == c.id {
+			continue
+		}
+		if msg.All {
+			if err := c.invalidateAll(); err != nil && err != ErrDatasetCacheClosed {
+				c.conf.Logger.Error("error while invalidating all the datasets for the invalidations lost on the invalidation bus", err)
+			}
+			continue
+		}
+		if err := c.invalidate(msg.DatasetID); err != nil && err != ErrDatasetCacheClosed {
+			c.conf.Logger.Error("error while invalidating the dataset", msg.DatasetID, "received over the invalidation bus", err)
+		}
+	}
+}
+
+//request sends the request to the cache and returns the dataset in the response.
+//ErrDatasetNotFound is returned if the response is not valid
+func (c *DatasetCache) request(ctx context.Context, req DatasetRequest) (Dataset, error) {
+	res, err := c.do(ctx, req)
+	if err != nil {
+		return Dataset{}, err
+	}
+	if !res.Valid {
+		return Dataset{}, ErrDatasetNotFound
+	}
+	return res.Dataset, nil
+}
+
+//do sends the request to the cache and waits for the response while honouring the context
+func (c *DatasetCache) do(ctx context.Context, req DatasetRequest) (DatasetRequest, error) {
+	/*
+	 * We will send the request to the cache
+	 * Then we will wait for the response
+	 * If the context is done or the cache is closed in between we will abandon the request
+	 */
+	if err := c.enter(); err != nil {
+		return req, err
+	}
+	defer c.exit()
+
+	//the out channel is buffered so that the cache never blocks on an abandoned request
+	req.Out = make(chan DatasetRequest, 1)
+
+	//sending the request
+	select {
+	case c.in <- req:
+	case <-ctx.Done():
+		return req, ctx.Err()
+	case <-c.done:
+		return req, ErrDatasetCacheClosed
+	}
+
+	//waiting for the response
+	select {
+	case res := <-req.Out:
+		return res, nil
+	case <-ctx.Done():
+		return req, ctx.Err()
+	case <-c.done:
+		return req, ErrDatasetCacheClosed
+	}
+}
+
+//getDataset gets the dataset from the aggregator of the cache
+func (c *DatasetCache) getDataset(ID string) (Dataset, error) {
+	c.m.Lock()
+	agg := c.agg
+	c.m.Unlock()
+	if agg == nil {
+		return Dataset{}, ErrDatasetNotFound
+	}
+	d, err := agg.GetDataset(ID)
+	if err != nil {
+		c.metrics.aggregatorError()
+		return Dataset{}, err
+	}
+	return d, nil
+}
+
+//getDatasets gets the datasets from the aggregator of the cache. A batch aggregator loads them in a single call
+//while the others load them one by one. The errors of the datasets which couldn't be loaded are returned mapped to their ids
+func (c *DatasetCache) getDatasets(IDs []string) (map[string]Dataset, map[string]error) {
+	c.m.Lock()
+	agg := c.agg
+	c.m.Unlock()
+	result := map[string]Dataset{}
+	errs := map[string]error{}
+	if agg == nil {
+		return result, errs
+	}
+	if b, ok := agg.(BatchDatasetAggregator); ok {
+		ds, err := b.GetDatasets(IDs)
+		if err != nil {
+			c.metrics.aggregatorError()
+			for _, ID := range IDs {
+				errs[ID] = err
+			}
+			return result, errs
+		}
+		return ds, errs
+	}
+	for _, ID := range IDs {
+		d, err := agg.GetDataset(ID)
+		if err != nil {
+			c.metrics.aggregatorError()
+			errs[ID] = err
+			continue
+		}
+		result[ID] = d
+	}
+	return result, errs
+}
+
+//run is the go routine serving the requests made to the cache
+func (c *DatasetCache) run() {
+	for {
+		select {
+		case req := <-c.in:
+			c.serve(req)
+		case res := <-c.loaded:
+			c.complete(res)
+		case <-c.done:
+			return
+		}
+		c.metrics.setCached(c.datasets.len(), c.datasets.bytes)
+	}
+}
+
+//serve serves a request made to the cache
+func (c *DatasetCache) serve(req DatasetRequest) {
+	switch req.Type {
+	case DatasetGet:
+		/*
+		 * If the dataset is in the cache we will respond immediately
+		 * Else if a load is in progress for the dataset we will wait for it
+		 * Else we will start a new load
+		 */
+		req.Dataset, req.Valid = c.datasets.get(req.ID)
+		if req.Valid {
+			c.metrics.hit()
+			c.subscribe(req.ID, req.SubscribeID)
+			go SendDatasetToChannel(req.Out, req)
+			return
+		}
+		c.metrics.miss()
+		if g, ok := c.latest[req.ID]; ok {
+			c.flights[g].waiters = append(c.flights[g].waiters, req)
+			return
+		}
+		c.startLoad(req, false)
+	case DatasetGetMany:
+		/*
+		 * The cached datasets are added to the response at once
+		 * The datasets whose loads are in progress are waited for
+		 * The rest are loaded together in a single batch
+		 * The datasets are pinned in the cache till the response is sent once all the loads complete
+		 */
+		b := &batch{req: req}
+		b.req.Datasets = map[string]Dataset{}
+		missing := []string{}
+		seen := map[string]struct{}{}
+		for _, ID := range req.DatasetIDs {
+			if _, ok := seen[ID]; ok {
+				continue
+			}
+			seen[ID] = struct{}{}
+			//the datasets of the request are pinned so that loading the rest doesn't evict them
+			c.datasets.pin(ID)
+			b.ids = append(b.ids, ID)
+			if d, ok := c.datasets.get(ID); ok {
+				c.metrics.hit()
+				c.subscribe(ID, req.SubscribeID)
+				b.req.Datasets[ID] = d
+				continue
+			}
+			c.metrics.miss()
+			b.pending++
+			if g, ok := c.latest[ID]; ok {
+				c.flights[g].batches = append(c.flights[g].batches, b)
+				continue
+			}
+			missing = append(missing, ID)
+		}
+		if len(missing) > 0 {
+			c.startBatchLoad(missing, b)
+		}
+		if b.pending == 0 {
+			c.respondBatch(b)
+		}
+	case DatasetUpdate:
+		//loads in progress for the dataset are superseded by the new load
+		c.datasets.remove(req.ID)
+		c.startLoad(req, true)
+	case DatasetInvalidate:
+		//loads in progress for the dataset won't be cached once they complete
+		c.datasets.remove(req.ID)
+		delete(c.latest, req.ID)
+		subs := c.subscriptions.subscribers(req.ID)
+		c.dropDICTs(subs)
+		c.emit(DatasetEvent{Type: DatasetUpdated, DatasetID: req.ID, Subscribers: subs})
+	case DatasetInvalidateAll:
+		//the datasets evicted earlier may still have the DICTs of their subscribers
+		IDs := map[string]struct{}{}
+		for k := range c.datasets.all() {
+			IDs[k] = struct{}{}
+		}
+		for k := range c.subscriptions.byDataset {
+			IDs[k] = struct{}{}
+		}
+		for k := range IDs {
+			c.datasets.remove(k)
+			delete(c.latest, k)
+			subs := c.subscriptions.subscribers(k)
+			c.dropDICTs(subs)
+			c.emit(DatasetEvent{Type: DatasetUpdated, DatasetID: k, Subscribers: subs})
+		}
+	case DatasetPatch:
+		/*
+		 * Loads in progress for the dataset won't be cached since they may not have the changes
+		 * If the dataset is cached we will apply the diff on a copy of it
+		 * The DICTs of the subscribed ids are dropped so that they are merged again from the patched datasets
+		 */
+		delete(c.latest, req.ID)
+		if d, ok := c.datasets.peek(req.ID); ok {
+			d.D = ApplyDiff(d.D, req.Diff)
+			c.evict(c.datasets.add(req.ID, d), EvictionLRU, "")
+			req.Dataset, req.Valid = d, true
+		}
+		subs := c.subscriptions.subscribers(req.ID)
+		c.dropDICTs(subs)
+		c.emit(DatasetEvent{Type: DatasetUpdated, DatasetID: req.ID, Subscribers: subs, Diff: req.Diff})
+		go SendDatasetToChannel(req.Out, req)
+	case DatasetUnsubscribe:
+		c.unsubscribe(req.ID, req.SubscribeID)
+	case DatasetSubscribers:
+		req.Subscribers = c.subscriptions.subscribers(req.ID)
+		req.Valid = true
+		go SendDatasetToChannel(req.Out, req)
+	case DatasetSyncSubscriptions:
+		//unsubscribing from the datasets which are not in the given list
+		keep := map[string]struct{}{}
+		for _, k := range req.DatasetIDs {
+			keep[k] = struct{}{}
+		}
+		for _, k := range c.subscriptions.datasets(req.SubscribeID) {
+			if _, ok := keep[k]; !ok {
+				c.unsubscribe(k, req.SubscribeID)
+			}
+		}
+		//subscribing to the given datasets
+		for _, k := range req.DatasetIDs {
+			c.subscribe(k, req.SubscribeID)
+		}
+	case DatasetSnapshot:
+		req.Datasets = c.datasets.all()
+		req.Valid = true
+		go SendDatasetToChannel(req.Out, req)
+	case DatasetRemove:
+		//we will remove the datasets which weren't used within the ttl
+		c.evict(c.datasets.expire(time.Now().Add(-c.conf.TTL)), EvictionExpired, "")
+	}
+}
+
+//startLoad starts a new load of the dataset from the aggregator in a separate go routine
+func (c *DatasetCache) startLoad(req DatasetRequest, update bool) {
+	c.gen++
+	c.flights[c.gen] = &flight{update: update, waiters: []DatasetRequest{req}}
+	c.latest[req.ID] = c.gen
+	go c.load(req.ID, c.gen)
+}
+
+//startBatchLoad starts a load of the datasets from the aggregator in a single go routine.
+//Each dataset gets its own flight so that the other requests for it wait for the same load
+func (c *DatasetCache) startBatchLoad(IDs []string, b *batch) {
+	gens := make(map[string]uint64, len(IDs))
+	for _, ID := range IDs {
+		c.gen++
+		c.flights[c.gen] = &flight{batches: []*batch{b}}
+		c.latest[ID] = c.gen
+		gens[ID] = c.gen
+	}
+	go c.loadBatch(IDs, gens)
+}
+
+//loadBatch loads the datasets from the aggregator and sends the result of each of them back to the cache
+func (c *DatasetCache) loadBatch(IDs []string, gens map[string]uint64) {
+	start := time.Now()
+	datasets, errs := c.getDatasets(IDs)
+	duration := time.Since(start)
+	c.metrics.observeLoad(duration)
+	for _, ID := range IDs {
+		res := loadResult{ID: ID, gen: gens[ID], duration: duration}
+		res.dataset, res.valid = datasets[ID]
+		if !res.valid {
+			res.err = errs[ID]
+			if res.err == nil {
+				res.err = ErrDatasetNotFound
+			}
+		}
+		select {
+		case c.loaded <- res:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+//load loads the dataset from the aggregator and sends the result back to the cache
+func (c *DatasetCache) load(ID string, gen uint64) {
+	res := loadResult{ID: ID, gen: gen}
+	start := time.Now()
+	res.dataset, res.err = c.getDataset(ID)
+	res.valid = res.err == nil
+	res.duration = time.Since(start)
+	c.metrics.observeLoad(res.duration)
+	select {
+	case c.loaded <- res:
+	case <-c.done:
+	}
+}
+
+//complete stores the result of a load in the cache and responds to the requests waiting for the load
+func (c *DatasetCache) complete(res loadResult) {
+	/*
+	 * We will store the dataset in the cache if the load is the latest one for the dataset
+	 * If the load was an update, the DICTs of the subscribed ids will be dropped
+	 * Then we will respond to the waiting requests and the get many requests
+	 * Finally we will emit the event of the load
+	 */
+	f, ok := c.flights[res.gen]
+	if !ok {
+		return
+	}
+	delete(c.flights, res.gen)
+
+	//storing the dataset if the load is not superseded
+	stored := false
+	if c.latest[res.ID] == res.gen {
+		delete(c.latest, res.ID)
+		if res.valid {
+			res.dataset.LastUsed = time.Now()
+			c.evict(c.datasets.add(res.ID, res.dataset), EvictionLRU, "")
+			stored = true
+		}
+	}
+
+	//the DICTs built from the previous version of the dataset are dropped before the waiting requests are responded
+	if f.update {
+		c.dropDICTs(c.subscriptions.subscribers(res.ID))
+	}
+
+	//responding to the waiting requests
+	for _, req := range f.waiters {
+		req.Dataset, req.Valid = res.dataset, res.valid
+		if req.Valid {
+			c.subscribe(req.ID, req.SubscribeID)
+		}
+		go SendDatasetToChannel(req.Out, req)
+	}
+	for _, b := range f.batches {
+		if res.valid {
+			b.req.Datasets[res.ID] = res.dataset
+			c.subscribe(res.ID, b.req.SubscribeID)
+		}
+		b.pending--
+		if b.pending == 0 {
+			c.respondBatch(b)
+		}
+	}
+
+	//emitting the event
+	e := DatasetEvent{Type: DatasetLoaded, DatasetID: res.ID, Subscribers: c.subscriptions.subscribers(res.ID), Duration: res.duration}
+	if !res.valid {
+		e.Type = DatasetFailed
+		e.Err = res.err
+	} else if !stored {
+		return
+	} else if f.update {
+		e.Type = DatasetUpdated
+	}
+	c.emit(e)
+}
+
+//evict records the datasets evicted from the cache for the given reason. Since the cache no longer tracks the evicted
+//datasets, the DICTs built from them are dropped and their subscriptions are removed, except the subscriptions of the
+//pinned id whose DICT is being built from the datasets. Such a subscription is kept till the dataset updates later on
+func (c *DatasetCache) evict(IDs []string, reason EvictionReason, pinned string) {
+	c.metrics.evicted(reason, len(IDs))
+	for _, k := range IDs {
+		subs := c.subscriptions.subscribers(k)
+		c.emit(DatasetEvent{Type: DatasetEvicted, DatasetID: k, Subscribers: subs, Reason: reason})
+		dropped := make([]string, 0, len(subs))
+		for _, s := range subs {
+			if s == pinned {
+				continue
+			}
+			c.subscriptions.remove(k, s)
+			dropped = append(dropped, s)
+		}
+		c.dropDICTs(dropped)
+		c.metrics.setSubscribers(k, c.subscriptions.count(k))
+	}
+}
+
+//respondBatch responds to the get many request once all its datasets are found. The datasets of the request
+//are unpinned and the ones exceeding the limits of the cache are evicted
+func (c *DatasetCache) respondBatch(b *batch) {
+	for _, ID := range b.ids {
+		c.datasets.unpin(ID)
+	}
+	//the subscriptions of the request are kept for its datasets since its DICT is being built from them
+	inBatch := make(map[string]struct{}, len(b.ids))
+	for _, ID := range b.ids {
+		inBatch[ID] = struct{}{}
+	}
+	for _, ID := range c.datasets.evict("") {
+		pinned := ""
+		if _, ok := inBatch[ID]; ok {
+			pinned = b.req.SubscribeID
+		}
+		c.evict([]string{ID}, EvictionLRU, pinned)
+	}
+	b.req.Valid = true
+	go SendDatasetToChannel(b.req.Out, b.req)
+}
+
+//subscribe subscribes the given id to the updates of the dataset
+func (c *DatasetCache) subscribe(ID, subscribeID string) {
+	if len(subscribeID) == 0 {
+		return
+	}
+	c.subscriptions.add(ID, subscribeID)
+	c.metrics.setSubscribers(ID, c.subscriptions.count(ID))
+}
+
+//unsubscribe unsubscribes the given id from the updates of the dataset
+func (c *DatasetCache) unsubscribe(ID, subscribeID string) {
+	if c.subscriptions.remove(ID, subscribeID) {
+		c.metrics.setSubscribers(ID, c.subscriptions.count(ID))
+	}
+}
+
+//clearCheck periodically asks the cache to remove the expired datasets
+func (c *DatasetCache) clearCheck() {
+	t := time.NewTicker(c.conf.SweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-c.done:
+			return
+		}
+		select {
+		case c.in <- DatasetRequest{Type: DatasetRemove}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+//removeSubscribedDICTs will remove the DICTs of the subscribed ids from the interpreter
+func removeSubscribedDICTs(subscribers []string) {
+	for _, k := range subscribers {
+		go interpreter.SendDICTToChannel(dictInputChannel(), interpreter.DICTRequest{ID: k, Type: interpreter.DICTRemove})
+	}
+}
+
+//DefaultDatasetCache is the dataset cache used by the DAgg dict aggregator unless another cache is given
+var DefaultDatasetCache *DatasetCache
+
+//DatasetInputChannel is the input channel to communicate with the default dataset cache.
+//It is served only after the default dataset cache is started. Sends on it block till then.
+//
+//Deprecated: use the methods of DefaultDatasetCache instead
+var DatasetInputChannel chan DatasetRequest
+
+//Datasets serves the requests sent on the channel from the default dataset cache till the default cache is closed.
+//The requests sent on DatasetInputChannel are served by the default cache itself.
+//
+//Deprecated: use the methods of DefaultDatasetCache instead
+func Datasets(in chan DatasetRequest) {
+	c := DefaultDatasetCache
+	if in == c.in {
+		return
+	}
+	for {
+		select {
+		case req := <-in:
+			go c.forward(req)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+//forward serves the request sent to the cache over another channel and responds on the out channel of the request.
+//Requests which fail are responded as not valid
+func (c *DatasetCache) forward(req DatasetRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), DatasetRequestTimeout)
+	defer cancel()
+	res := req
+	var err error
+	switch req.Type {
+	case DatasetGet:
+		res.Dataset, err = c.Get(ctx, req.ID, req.SubscribeID)
+	case DatasetUpdate:
+		res.Dataset, err = c.Update(ctx, req.ID)
+	case DatasetInvalidate:
+		err = c.Invalidate(req.ID)
+	default:
+		if req.Out == nil {
+			err = c.send(req)
+			break
+		}
+		res, err = c.do(ctx, req)
+	}
+	if err != nil {
+		c.conf.Logger.Error("error while serving the", req.Type, "request for the dataset", req.ID, err)
+	}
+	if req.Out == nil {
+		return
+	}
+	if req.Type == DatasetGet || req.Type == DatasetUpdate || req.Type == DatasetInvalidate {
+		res.Valid = err == nil
+	} else if err != nil {
+		res.Valid = false
+	}
+	res.Out = req.Out
+	SendDatasetToChannel(req.Out, res)
+}
+
+//Start starts the default dataset cache. The default cache isn't started on importing the package. It is started
+//by Start, SetDefaultDatasetAggregator or NewDAgg, and requests made to it before that fail with ErrDatasetCacheNotStarted
+func Start() {
+	DefaultDatasetCache.Start()
+}
+
+//Shutdown gracefully stops the default dataset cache. See DatasetCache.Shutdown
+func Shutdown(ctx context.Context) error {
+	return DefaultDatasetCache.Shutdown(ctx)
+}
+
+//SetDefaultDatasetAggregator sets the default aggregator as the passed param and starts the default dataset cache
+//if not started yet
+func SetDefaultDatasetAggregator(agg DatasetAggregator) {
+	DefaultDatasetCache.SetAggregator(agg)
+	DefaultDatasetCache.Start()
+}
+
+func init() {
+	DefaultDatasetCache = NewDatasetCache(nil, DefaultDatasetCacheConfig())
+	DatasetInputChannel = DefaultDatasetCache.in
+}
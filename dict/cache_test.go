@@ -0,0 +1,516 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+//fakeAggregator is the dataset aggregator returning a dataset with a single token for every id
+type fakeAggregator struct {
+	m     sync.Mutex
+	loads map[string]int
+}
+
+func newFakeAggregator() *fakeAggregator {
+	return &fakeAggregator{loads: map[string]int{}}
+}
+
+func (f *fakeAggregator) GetDataset(ID string) (Dataset, error) {
+	f.m.Lock()
+	f.loads[ID]++
+	f.m.Unlock()
+	n := &interpreter.ColumnNode{UID: "column-" + ID, Word: []rune("column " + ID), Name: "column " + ID}
+	return Dataset{D: map[string]interpreter.Token{"column " + ID: {Word: n.Word, Nodes: []interpreter.Node{n}}}}, nil
+}
+
+func (f *fakeAggregator) count(ID string) int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.loads[ID]
+}
+
+//startCache starts a dataset cache with the aggregator and the config. The cache is to be closed by the caller
+func startCache(agg DatasetAggregator, conf DatasetCacheConfig) *DatasetCache {
+	c := NewDatasetCache(agg, conf)
+	c.Start()
+	return c
+}
+
+func TestGetManyKeepsSubscriptionsOfEvictedDatasets(t *testing.T) {
+	conf := DefaultDatasetCacheConfig()
+	conf.MaxEntries = 2
+	c := startCache(newFakeAggregator(), conf)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	datasets, err := c.GetMany(ctx, []string{"1", "2", "3"}, "user-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datasets) != 3 {
+		t.Fatalf("expected 3 datasets, got %d", len(datasets))
+	}
+	for _, ID := range []string{"1", "2", "3"} {
+		subs, err := c.Subscribers(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(subs, []string{"user-7"}) {
+			t.Errorf("expected dataset %s to keep its subscriber after eviction, got %v", ID, subs)
+		}
+	}
+	if n := c.Metrics().Evictions(EvictionLRU); n != 1 {
+		t.Errorf("expected 1 lru eviction once the batch is served, got %d", n)
+	}
+}
+
+func TestEvictionRemovesTheSubscriptions(t *testing.T) {
+	conf := DefaultDatasetCacheConfig()
+	conf.MaxEntries = 1
+	c := startCache(newFakeAggregator(), conf)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := c.Get(ctx, "1", "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "2", "user-2"); err != nil {
+		t.Fatal(err)
+	}
+	subs, err := c.Subscribers(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 0 {
+		t.Errorf("expected the subscriptions of the evicted dataset to be removed, got %v", subs)
+	}
+	if n := c.Metrics().Subscribers("1"); n != 0 {
+		t.Errorf("expected the evicted dataset to be removed from the subscriber metrics, got %d", n)
+	}
+	if subs, err = c.Subscribers(ctx, "2"); err != nil || !reflect.DeepEqual(subs, []string{"user-2"}) {
+		t.Errorf("expected the cached dataset to keep its subscriber, got %v %v", subs, err)
+	}
+}
+
+func TestGetManyPinsTheDatasetsOfTheBatch(t *testing.T) {
+	conf := DefaultDatasetCacheConfig()
+	conf.MaxEntries = 1
+	agg := newFakeAggregator()
+	c := startCache(agg, conf)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := c.Get(ctx, "1", ""); err != nil {
+		t.Fatal(err)
+	}
+	datasets, err := c.GetMany(ctx, []string{"1", "2", "3"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datasets) != 3 {
+		t.Fatalf("expected 3 datasets, got %d", len(datasets))
+	}
+	if n := agg.count("1"); n != 1 {
+		t.Errorf("expected the cached dataset to be served without a reload, got %d loads", n)
+	}
+}
+
+//stalledAggregator is the aggregator blocking till it is released
+type stalledAggregator struct {
+	release chan struct{}
+}
+
+func (s stalledAggregator) GetDataset(ID string) (Dataset, error) {
+	<-s.release
+	return Dataset{D: map[string]interpreter.Token{}}, nil
+}
+
+func TestGetHonoursTheContext(t *testing.T) {
+	agg := stalledAggregator{release: make(chan struct{})}
+	defer close(agg.release)
+	c := startCache(agg, DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	if _, err := c.Get(ctx, "1", ""); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline of the context with a stalled aggregator, got %v", err)
+	}
+}
+
+func TestCachesSideBySide(t *testing.T) {
+	aggA, aggB := newFakeAggregator(), newFakeAggregator()
+	a := startCache(aggA, DefaultDatasetCacheConfig())
+	b := startCache(aggB, DefaultDatasetCacheConfig())
+	defer b.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := a.Get(ctx, "1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(ctx, "1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if aggA.count("1") != 1 || aggB.count("1") != 1 {
+		t.Errorf("expected each cache to load the dataset from its own aggregator, got %d and %d", aggA.count("1"), aggB.count("1"))
+	}
+	a.Close()
+	if _, err := a.Get(ctx, "1", ""); err != ErrDatasetCacheClosed {
+		t.Errorf("expected the closed cache to reject the request, got %v", err)
+	}
+	if _, err := b.Get(ctx, "1", ""); err != nil {
+		t.Errorf("expected the other cache to keep serving, got %v", err)
+	}
+}
+
+func TestUpdateAndInvalidateReloadTheDataset(t *testing.T) {
+	agg := newFakeAggregator()
+	c := startCache(agg, DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := c.Get(ctx, "1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Update(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := agg.count("1"); n != 2 {
+		t.Errorf("expected the update to reload the dataset, got %d loads", n)
+	}
+	if _, err := c.Get(ctx, "1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := agg.count("1"); n != 2 {
+		t.Errorf("expected the updated dataset to be cached, got %d loads", n)
+	}
+	if err := c.Invalidate("1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := agg.count("1"); n != 3 {
+		t.Errorf("expected the invalidated dataset to be loaded again, got %d loads", n)
+	}
+}
+
+func TestDatasetsForwardsToTheDefaultCache(t *testing.T) {
+	agg := newFakeAggregator()
+	def := DefaultDatasetCache
+	DefaultDatasetCache = startCache(agg, DefaultDatasetCacheConfig())
+	defer func() {
+		DefaultDatasetCache.Close()
+		DefaultDatasetCache = def
+	}()
+	in := make(chan DatasetRequest)
+	go Datasets(in)
+
+	req := DatasetRequest{ID: "1", Type: DatasetGet, Out: make(chan DatasetRequest)}
+	in <- req
+	select {
+	case res := <-req.Out:
+		if !res.Valid {
+			t.Fatal("expected the dataset from the default cache")
+		}
+		if _, ok := res.Dataset.D["column 1"]; !ok {
+			t.Errorf("expected the tokens of the dataset, got %v", res.Dataset.D)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected a response on the out channel of the request")
+	}
+	if n := agg.count("1"); n != 1 {
+		t.Errorf("expected the default cache to load the dataset, got %d loads", n)
+	}
+}
+
+//gatedAggregator is the fake aggregator holding the loads of the dataset with the given id till it is released
+type gatedAggregator struct {
+	*fakeAggregator
+	gated   string
+	release chan struct{}
+}
+
+func (g gatedAggregator) GetDataset(ID string) (Dataset, error) {
+	if ID == g.gated {
+		<-g.release
+	}
+	return g.fakeAggregator.GetDataset(ID)
+}
+
+func TestConcurrentGetsShareTheLoad(t *testing.T) {
+	agg := gatedAggregator{fakeAggregator: newFakeAggregator(), gated: "1", release: make(chan struct{})}
+	c := startCache(agg, DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			_, err := c.Get(ctx, "1", "user-"+strconv.Itoa(i))
+			errs <- err
+		}(i)
+	}
+	//the load in progress mustn't hold up the requests for the other datasets
+	if _, err := c.Get(ctx, "2", ""); err != nil {
+		t.Fatalf("expected the other dataset to be served during the load, got %v", err)
+	}
+	close(agg.release)
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := agg.count("1"); n != 1 {
+		t.Errorf("expected the concurrent gets to share a single load, got %d loads", n)
+	}
+	subs, err := c.Subscribers(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 10 {
+		t.Errorf("expected all the waiting requests to be subscribed, got %v", subs)
+	}
+}
+
+func TestShutdownBeforeStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := DefaultDatasetCacheConfig()
+	conf.SnapshotDir = dir
+	agg := newFakeAggregator()
+	c := NewDatasetCache(agg, conf)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := c.Get(ctx, "1", ""); err != ErrDatasetCacheNotStarted {
+		t.Errorf("expected the request before starting the cache to fail, got %v", err)
+	}
+	if err := c.Shutdown(ctx); err != nil {
+		t.Errorf("expected the cache which isn't running to be closed at once, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected no snapshots of a cache which wasn't started, got %d", len(files))
+	}
+
+	//a closed cache can't be started again
+	c.Start()
+	if _, err := c.Get(ctx, "1", ""); err != ErrDatasetCacheClosed {
+		t.Errorf("expected the request after the shutdown to fail, got %v", err)
+	}
+	if n := agg.count("1"); n != 0 {
+		t.Errorf("expected no loads, got %d", n)
+	}
+}
+
+func TestShutdownDrainsTheRequestsInProgress(t *testing.T) {
+	agg := stalledAggregator{release: make(chan struct{})}
+	c := startCache(agg, DefaultDatasetCacheConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := c.Get(ctx, "1", "")
+		got <- err
+	}()
+	inflight := eventually(func() bool {
+		c.lm.Lock()
+		defer c.lm.Unlock()
+		return c.inflight == 1
+	})
+	if !inflight {
+		t.Fatal("expected the get to be in progress")
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- c.Shutdown(ctx)
+	}()
+	draining := eventually(func() bool {
+		return !c.running()
+	})
+	if !draining {
+		t.Fatal("expected the cache to be draining")
+	}
+	if _, err := c.Get(ctx, "2", ""); err != ErrDatasetCacheClosed {
+		t.Errorf("expected new requests to be rejected while draining, got %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("expected the shutdown to wait for the request in progress, got %v", err)
+	default:
+	}
+
+	close(agg.release)
+	if err := <-got; err != nil {
+		t.Errorf("expected the request in progress to complete, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("expected the shutdown to complete after the drain, got %v", err)
+	}
+}
+
+func TestShutdownGivesUpWithTheContext(t *testing.T) {
+	agg := stalledAggregator{release: make(chan struct{})}
+	defer close(agg.release)
+	c := startCache(agg, DefaultDatasetCacheConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := c.Get(ctx, "1", "")
+		got <- err
+	}()
+	eventually(func() bool {
+		c.lm.Lock()
+		defer c.lm.Unlock()
+		return c.inflight == 1
+	})
+
+	sCtx, sCancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer sCancel()
+	if err := c.Shutdown(sCtx); err != context.DeadlineExceeded {
+		t.Errorf("expected the shutdown to give up with the context, got %v", err)
+	}
+	if err := <-got; err != ErrDatasetCacheClosed {
+		t.Errorf("expected the request in progress to fail on close, got %v", err)
+	}
+}
+
+func TestSettingTheDefaultAggregatorStartsTheDefaultCache(t *testing.T) {
+	agg := newFakeAggregator()
+	def := DefaultDatasetCache
+	DefaultDatasetCache = NewDatasetCache(nil, DefaultDatasetCacheConfig())
+	defer func() {
+		DefaultDatasetCache.Close()
+		DefaultDatasetCache = def
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := DefaultDatasetCache.Get(ctx, "1", ""); err != ErrDatasetCacheNotStarted {
+		t.Errorf("expected the default cache not to be started on import, got %v", err)
+	}
+	SetDefaultDatasetAggregator(agg)
+	if _, err := NewDAgg(nil, nil).cache.Get(ctx, "1", ""); err != nil {
+		t.Errorf("expected the default cache to be started with its aggregator, got %v", err)
+	}
+	if err := Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+	if _, err := DefaultDatasetCache.Get(ctx, "1", ""); err != ErrDatasetCacheClosed {
+		t.Errorf("expected the default cache to be stopped by the shutdown, got %v", err)
+	}
+}
+
+//batchCountingAggregator is the fake batch aggregator counting the batches loaded
+type batchCountingAggregator struct {
+	*fakeAggregator
+	batches chan []string
+}
+
+func (b batchCountingAggregator) GetDatasets(IDs []string) (map[string]Dataset, error) {
+	b.batches <- IDs
+	result := make(map[string]Dataset, len(IDs))
+	for _, ID := range IDs {
+		d, _ := b.GetDataset(ID)
+		result[ID] = d
+	}
+	return result, nil
+}
+
+func TestUpdateManyReloadsTheDatasetsInOneBatch(t *testing.T) {
+	agg := batchCountingAggregator{fakeAggregator: newFakeAggregator(), batches: make(chan []string, 10)}
+	c := startCache(agg, DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	dropped := make(chan []string, 10)
+	defer c.OnDICTsDropped(func(IDs []string, at time.Time) {
+		dropped <- IDs
+	})()
+
+	IDs := []string{"1", "2", "3"}
+	if _, err := c.GetMany(ctx, IDs, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	<-agg.batches
+	datasets, err := c.UpdateMany(ctx, IDs, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datasets) != len(IDs) {
+		t.Fatalf("expected %d datasets, got %d", len(IDs), len(datasets))
+	}
+	if len(agg.batches) != 1 {
+		t.Fatalf("expected the datasets to be reloaded in a single batch, got %d batches", len(agg.batches))
+	}
+	if batch := <-agg.batches; len(batch) != len(IDs) {
+		t.Errorf("expected all the datasets in the batch, got %v", batch)
+	}
+	for _, ID := range IDs {
+		if n := agg.count(ID); n != 2 {
+			t.Errorf("expected the dataset %s to be loaded twice, got %d", ID, n)
+		}
+		if subs, _ := c.Subscribers(ctx, ID); !reflect.DeepEqual(subs, []string{"user-1"}) {
+			t.Errorf("expected the subscription to the dataset %s to be kept, got %v", ID, subs)
+		}
+	}
+	//the DICTs of the subscribers are dropped for each dataset before the reload
+	if len(dropped) != len(IDs) {
+		t.Errorf("expected the DICT of the subscriber to be dropped for each dataset, got %d drops", len(dropped))
+	}
+}
+
+func TestMaxBytesEvictsTheLeastRecentlyUsed(t *testing.T) {
+	agg := newFakeAggregator()
+	d, _ := newFakeAggregator().GetDataset("1")
+	conf := DefaultDatasetCacheConfig()
+	//the fake datasets of single digit ids have the same size
+	conf.MaxBytes = 2*EstimateDatasetSize(d) + EstimateDatasetSize(d)/2
+	c := startCache(agg, conf)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for _, ID := range []string{"1", "2", "1", "3"} {
+		if _, err := c.Get(ctx, ID, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.Metrics().Evictions(EvictionLRU); n != 1 {
+		t.Errorf("expected a single lru eviction to keep the cache within the limit, got %d", n)
+	}
+	//the dataset used recently is kept and the least recently used one is evicted
+	for i, ID := range []string{"1", "2"} {
+		if _, err := c.Get(ctx, ID, ""); err != nil {
+			t.Fatal(err)
+		}
+		if n := agg.count(ID); n != i+1 {
+			t.Errorf("expected the dataset %s to be loaded %d times, got %d", ID, i+1, n)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the report of the words colliding across the datasets of a user
+ */
+
+//CollisionNode is a node of a colliding token
+type CollisionNode struct {
+	//DatasetID is the id of the dataset owning the node. It is empty for the nodes of the system dictionary
+	DatasetID string
+	//Type is the type of the node
+	Type interpreter.Type
+	//Name is the name of the node. For operator nodes it is the operation
+	Name string
+	//UID is the unique id of the node
+	UID string
+}
+
+//Collision is a token of the user's dictionary which maps to more than one node
+type Collision struct {
+	//Word is the normalised word of the token
+	Word string
+	//Nodes are the nodes the word maps to
+	Nodes []CollisionNode
+	//CrossDataset indicates that the nodes belong to more than one dataset
+	CrossDataset bool
+}
+
+//Collisions returns the report of the tokens in the user's dictionary mapping to more than one node, ordered by their word.
+//Collisions within a dataset and across the datasets the user has access to, directly or through the user's teams, are reported.
+//The date phrases are not reported since they are generated for the default date field of each table
+func (d DAgg) Collisions(ctx context.Context, ID string) ([]Collision, error) {
+	/*
+	 * We will get the datasets the user has access to and those shared with the user's teams
+	 * Then we will report the colliding tokens of the datasets and the system dict
+	 */
+	result := []Collision{}
+	//getting the datasets
+	ID, ctx = userLocale(ctx, ID)
+	id, err := strconv.Atoi(ID)
+	if err != nil {
+		d.l.Error("error while parsing the id from string to integer", ID)
+		return result, err
+	}
+	datasets := []models.DatsetUserMapping{}
+	err = d.db.Where("user_id = ?", id).Find(&datasets).Error
+	if err != nil {
+		d.l.Error("error while getting the list of datasets the user has access to", ID)
+		return result, err
+	}
+	teams, err := models.GetUserTeams(d.db, uint(id))
+	if err != nil {
+		d.l.Error("error while getting the list of teams of the user", ID)
+		return result, err
+	}
+
+	//getting the datasets without subscribing the user to them
+	dIDs := make([]string, 0, len(datasets))
+	seen := map[string]struct{}{}
+	for _, v := range datasets {
+		dID := strconv.Itoa(int(v.DatasetID))
+		seen[dID] = struct{}{}
+		dIDs = append(dIDs, dID)
+	}
+	for _, t := range teams {
+		tIDs, err := d.teamDatasetIDs(t)
+		if err != nil {
+			return result, err
+		}
+		for _, dID := range tIDs {
+			if _, ok := seen[dID]; ok {
+				continue
+			}
+			seen[dID] = struct{}{}
+			dIDs = append(dIDs, dID)
+		}
+	}
+	cached, err := d.cache.GetMany(ctx, dIDs, "")
+	if err != nil {
+		d.l.Error("error while getting the datasets for the collision report of the user", ID)
+		return result, err
+	}
+	return d.collisions(cached, SystemDICTForLocale(d.Locale(ctx, ID))), nil
+}
+
+//collisions returns the tokens of the datasets and the system dict mapping to more than one node, ordered by their word.
+//The nodes of a token are ordered by their dataset and name
+func (d DAgg) collisions(datasets map[string]Dataset, system interpreter.DICT) []Collision {
+	/*
+	 * We will collect the nodes of each token from the datasets and the system dict
+	 * Then we will report the tokens having more than one node
+	 */
+	result := []Collision{}
+	nodes := map[string][]CollisionNode{}
+	for dID, dataset := range datasets {
+		for k, t := range dataset.D {
+			for _, n := range t.Nodes {
+				if vN, ok := n.(*interpreter.ValueNode); ok && IsDatePhraseNode(vN) {
+					continue
+				}
+				nodes[k] = append(nodes[k], CollisionNode{DatasetID: dID, Type: n.Type(), Name: nodeName(n), UID: NodeUID(n)})
+			}
+		}
+	}
+	for k, t := range system.Map {
+		k = d.Normalise(k)
+		for _, n := range t.Nodes {
+			nodes[k] = append(nodes[k], CollisionNode{Type: n.Type(), Name: nodeName(n), UID: NodeUID(n)})
+		}
+	}
+
+	//reporting the tokens having more than one node
+	for k, ns := range nodes {
+		if len(ns) < 2 {
+			continue
+		}
+		c := Collision{Word: k, Nodes: ns}
+		for _, n := range ns[1:] {
+			if n.DatasetID != ns[0].DatasetID {
+				c.CrossDataset = true
+				break
+			}
+		}
+		sort.SliceStable(c.Nodes, func(i, j int) bool {
+			if c.Nodes[i].DatasetID != c.Nodes[j].DatasetID {
+				return c.Nodes[i].DatasetID < c.Nodes[j].DatasetID
+			}
+			return c.Nodes[i].Name < c.Nodes[j].Name
+		})
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Word < result[j].Word
+	})
+	return result
+}
+
+//nodeName returns the name of the node. For operator nodes the operation is returned
+func nodeName(n interpreter.Node) string {
+	switch v := n.(type) {
+	case *interpreter.ColumnNode:
+		return v.Name
+	case *interpreter.TableNode:
+		return v.Name
+	case *interpreter.KnowledgeBaseNode:
+		return v.Name
+	case *interpreter.OperatorNode:
+		return v.Operation
+	case *interpreter.ValueNode:
+		return v.Name
+	default:
+		return string(n.TokenWord())
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+func TestCollisions(t *testing.T) {
+	token := func(nodes ...interpreter.Node) interpreter.Token {
+		return interpreter.Token{Nodes: nodes}
+	}
+	orders := &interpreter.TableNode{UID: "orders", Name: "orders"}
+	dateField := &interpreter.ColumnNode{UID: "order-date", Name: "order date"}
+	datasets := map[string]Dataset{
+		"1": {D: map[string]interpreter.Token{
+			"region":      token(&interpreter.ColumnNode{UID: "region-1", Name: "region"}),
+			"date":        token(&interpreter.ColumnNode{UID: "ship-date", Name: "ship date"}, &interpreter.ColumnNode{UID: "order-date", Name: "order date"}),
+			"orders":      token(orders),
+			"last month":  token(newDatePhraseNode("last month", dateField)),
+			"not":         token(&interpreter.ValueNode{UID: "not", Name: "NOT"}),
+			"unambiguous": token(&interpreter.ColumnNode{UID: "unambiguous", Name: "unambiguous"}),
+		}},
+		"2": {D: map[string]interpreter.Token{
+			"region":     token(&interpreter.ColumnNode{UID: "region-2", Name: "sales region"}),
+			"last month": token(newDatePhraseNode("last month", &interpreter.ColumnNode{UID: "created"})),
+		}},
+	}
+	system := interpreter.DICT{Map: map[string]interpreter.Token{
+		"NOT": token(&interpreter.OperatorNode{UID: "not-equal", Operation: interpreter.NotEqOperator}),
+	}}
+
+	got := NewDAggWithCache(nil, nil, nil).collisions(datasets, system)
+	expected := []Collision{
+		{Word: "date", Nodes: []CollisionNode{
+			{DatasetID: "1", Type: interpreter.Column, Name: "order date", UID: "order-date"},
+			{DatasetID: "1", Type: interpreter.Column, Name: "ship date", UID: "ship-date"},
+		}},
+		{Word: "not", CrossDataset: true, Nodes: []CollisionNode{
+			{Type: interpreter.Operator, Name: interpreter.NotEqOperator, UID: "not-equal"},
+			{DatasetID: "1", Type: interpreter.Value, Name: "NOT", UID: "not"},
+		}},
+		{Word: "region", CrossDataset: true, Nodes: []CollisionNode{
+			{DatasetID: "1", Type: interpreter.Column, Name: "region", UID: "region-1"},
+			{DatasetID: "2", Type: interpreter.Column, Name: "sales region", UID: "region-2"},
+		}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the collisions\n%+v\ngot\n%+v", expected, got)
+	}
+}
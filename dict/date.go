@@ -0,0 +1,333 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the relative date phrases like "last month", "year to date", "Q3 2025" or "past 7 days".
+ * The phrases are indexed as value nodes of the default date field of the tables and are resolved
+ * into date ranges when the query is run.
+ */
+
+//DateConfig has the configuration for resolving the date phrases
+type DateConfig struct {
+	//WeekStart is the first day of the week
+	WeekStart time.Weekday
+	//FiscalYearOffset is the no. of months by which the fiscal year starts after january.
+	//eg:- 3 for a fiscal year starting in april. A fiscal year is named after the calendar year in which it ends
+	FiscalYearOffset int
+}
+
+//DefaultDateConfig returns the default date configuration. Week starts on monday and the fiscal year is the calendar year
+func DefaultDateConfig() DateConfig {
+	return DateConfig{WeekStart: time.Monday}
+}
+
+//DateRange is the range of time a date phrase resolves to. From is inclusive and To is exclusive
+type DateRange struct {
+	From time.Time
+	To   time.Time
+}
+
+//dateUnit is a unit of time a date phrase is made of
+type dateUnit int
+
+const (
+	unitDay dateUnit = iota
+	unitWeek
+	unitMonth
+	unitQuarter
+	unitYear
+	unitFiscalQuarter
+	unitFiscalYear
+)
+
+//dateUnits maps the words of the units to the units. Both singular and plural forms are accepted
+var dateUnits = map[string]dateUnit{
+	"day": unitDay, "days": unitDay,
+	"week": unitWeek, "weeks": unitWeek,
+	"month": unitMonth, "months": unitMonth,
+	"quarter": unitQuarter, "quarters": unitQuarter,
+	"year": unitYear, "years": unitYear,
+	"fiscal quarter": unitFiscalQuarter, "fiscal quarters": unitFiscalQuarter,
+	"fiscal year": unitFiscalYear, "fiscal years": unitFiscalYear,
+}
+
+//dateToDate maps the period to date phrases to their units
+var dateToDate = map[string]dateUnit{
+	"week to date": unitWeek, "wtd": unitWeek,
+	"month to date": unitMonth, "mtd": unitMonth,
+	"quarter to date": unitQuarter, "qtd": unitQuarter,
+	"year to date": unitYear, "ytd": unitYear,
+	"fiscal year to date": unitFiscalYear, "fytd": unitFiscalYear,
+}
+
+//dateOffsets maps the words referring to a period relative to the current one to their offsets
+var dateOffsets = map[string]int{
+	"this": 0, "current": 0,
+	"last": -1, "previous": -1, "prior": -1,
+	"next": 1, "coming": 1,
+}
+
+//datePhrasePeriods has the no. of periods of each unit up to which the phrases like "past 7 days" are indexed
+var datePhrasePeriods = []struct {
+	unit string
+	n    int
+}{{"day", 31}, {"week", 12}, {"month", 24}, {"quarter", 8}, {"year", 5}}
+
+const (
+	//datePhrasePastYears is the no. of years before the current year for which the quarters and fiscal years are indexed
+	datePhrasePastYears = 5
+	//datePhraseNextYears is the no. of years after the current year for which the quarters and fiscal years are indexed
+	datePhraseNextYears = 1
+)
+
+//DatePhrases returns the date phrases indexed in the dictionary for the default date field of the tables.
+//The phrases with a no. of periods like "past 7 days" are indexed up to a few periods of each unit and
+//the quarters and fiscal years like "Q3 2025" are indexed for the years around the current one.
+//ParseDatePhrase recognises the phrases beyond them
+func DatePhrases() []string {
+	result := []string{"today", "yesterday", "tomorrow", "q1", "q2", "q3", "q4"}
+	for _, u := range []string{"week", "month", "quarter", "year", "fiscal quarter", "fiscal year"} {
+		for _, o := range []string{"this", "last", "next"} {
+			result = append(result, o+" "+u)
+		}
+	}
+	for k := range dateToDate {
+		result = append(result, k)
+	}
+	for _, p := range datePhrasePeriods {
+		for n := 1; n <= p.n; n++ {
+			u := p.unit
+			if n > 1 {
+				u += "s"
+			}
+			for _, o := range []string{"past", "last", "next"} {
+				result = append(result, o+" "+strconv.Itoa(n)+" "+u)
+			}
+		}
+	}
+	year := time.Now().Year()
+	for y := year - datePhrasePastYears; y <= year+datePhraseNextYears; y++ {
+		fy := "fy" + strconv.Itoa(y)
+		result = append(result, fy)
+		for q := 1; q <= 4; q++ {
+			result = append(result, "q"+strconv.Itoa(q)+" "+strconv.Itoa(y), "q"+strconv.Itoa(q)+" "+fy)
+		}
+	}
+	return result
+}
+
+//ParseDatePhrase resolves the date phrase into a date range relative to now. Returns false if the phrase is not
+//a date phrase. The recognised phrases are
+//	today, yesterday, tomorrow
+//	this|last|next week|month|quarter|year|fiscal quarter|fiscal year
+//	past|last|next <n> days|weeks|months|quarters|years
+//	week|month|quarter|year|fiscal year to date and their abbreviations wtd, mtd, qtd, ytd, fytd
+//	q<n> [<year>], q<n> fy<year>, fy<year>
+//The past and next <n> units include the current unit. eg:- "past 7 days" is the last 6 days and today
+func ParseDatePhrase(phrase string, now time.Time, conf DateConfig) (DateRange, bool) {
+	parts := strings.Fields(strings.ToLower(phrase))
+	if len(parts) == 0 {
+		return DateRange{}, false
+	}
+	p := strings.Join(parts, " ")
+
+	//single days
+	switch p {
+	case "today":
+		return periodRange(now, unitDay, 0, 1, conf), true
+	case "yesterday":
+		return periodRange(now, unitDay, -1, 1, conf), true
+	case "tomorrow":
+		return periodRange(now, unitDay, 1, 1, conf), true
+	}
+
+	//period to date
+	if u, ok := dateToDate[p]; ok {
+		return DateRange{From: startOf(now, u, conf), To: startOf(now, unitDay, conf).AddDate(0, 0, 1)}, true
+	}
+
+	//quarters and fiscal years
+	if r, ok := parseNamedPeriod(parts, now, conf); ok {
+		return r, true
+	}
+
+	//periods relative to the current one
+	o, ok := dateOffsets[parts[0]]
+	if !ok && parts[0] != "past" {
+		return DateRange{}, false
+	}
+	if u, ok := dateUnits[strings.Join(parts[1:], " ")]; ok && parts[0] != "past" {
+		return periodRange(now, u, o, 1, conf), true
+	}
+
+	//no. of periods including the current one
+	if len(parts) < 3 || parts[0] == "this" || parts[0] == "current" {
+		return DateRange{}, false
+	}
+	n, err := strconv.Atoi(parts[1])
+	u, ok := dateUnits[strings.Join(parts[2:], " ")]
+	if err != nil || n <= 0 || !ok {
+		return DateRange{}, false
+	}
+	if o > 0 {
+		return periodRange(now, u, 0, n, conf), true
+	}
+	return periodRange(now, u, 1-n, n, conf), true
+}
+
+//parseNamedPeriod resolves the quarters like "q3", "q3 2025", "q3 fy2025" and fiscal years like "fy2025"
+func parseNamedPeriod(parts []string, now time.Time, conf DateConfig) (DateRange, bool) {
+	if len(parts) > 2 {
+		return DateRange{}, false
+	}
+	//fiscal year
+	if len(parts) == 1 && strings.HasPrefix(parts[0], "fy") {
+		y, ok := parseYear(parts[0][2:])
+		if !ok {
+			return DateRange{}, false
+		}
+		from := fiscalYearStart(y, now.Location(), conf)
+		return DateRange{From: from, To: from.AddDate(1, 0, 0)}, true
+	}
+	//quarter
+	if len(parts[0]) != 2 || parts[0][0] != 'q' || parts[0][1] < '1' || parts[0][1] > '4' {
+		return DateRange{}, false
+	}
+	q := int(parts[0][1] - '1')
+	if len(parts) == 1 {
+		from := time.Date(now.Year(), time.Month(q*3+1), 1, 0, 0, 0, 0, now.Location())
+		return DateRange{From: from, To: from.AddDate(0, 3, 0)}, true
+	}
+	if strings.HasPrefix(parts[1], "fy") {
+		y, ok := parseYear(parts[1][2:])
+		if !ok {
+			return DateRange{}, false
+		}
+		from := fiscalYearStart(y, now.Location(), conf).AddDate(0, q*3, 0)
+		return DateRange{From: from, To: from.AddDate(0, 3, 0)}, true
+	}
+	y, ok := parseYear(parts[1])
+	if !ok {
+		return DateRange{}, false
+	}
+	from := time.Date(y, time.Month(q*3+1), 1, 0, 0, 0, 0, now.Location())
+	return DateRange{From: from, To: from.AddDate(0, 3, 0)}, true
+}
+
+//parseYear parses a four digit year
+func parseYear(s string) (int, bool) {
+	if len(s) != 4 {
+		return 0, false
+	}
+	y, err := strconv.Atoi(s)
+	return y, err == nil
+}
+
+//fiscalYearStart returns the start of the fiscal year named after the calendar year in which it ends
+func fiscalYearStart(year int, loc *time.Location, conf DateConfig) time.Time {
+	offset := fiscalOffset(conf)
+	if offset == 0 {
+		return time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	}
+	return time.Date(year-1, time.Month(offset+1), 1, 0, 0, 0, 0, loc)
+}
+
+//fiscalOffset returns the fiscal year offset of the configuration within 0 and 11
+func fiscalOffset(conf DateConfig) int {
+	return (conf.FiscalYearOffset%12 + 12) % 12
+}
+
+//periodRange returns the range of n units starting from the unit at the offset from the current unit
+func periodRange(now time.Time, u dateUnit, offset, n int, conf DateConfig) DateRange {
+	from := addUnits(startOf(now, u, conf), u, offset)
+	return DateRange{From: from, To: addUnits(from, u, n)}
+}
+
+//startOf returns the start of the unit of time in which t falls
+func startOf(t time.Time, u dateUnit, conf DateConfig) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch u {
+	case unitWeek:
+		return day.AddDate(0, 0, -((int(day.Weekday()) - int(conf.WeekStart) + 7) % 7))
+	case unitMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	case unitQuarter:
+		return time.Date(t.Year(), time.Month((int(t.Month())-1)/3*3+1), 1, 0, 0, 0, 0, t.Location())
+	case unitYear:
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	case unitFiscalYear, unitFiscalQuarter:
+		//months elapsed since the start of the fiscal year
+		elapsed := (int(t.Month()) - 1 - fiscalOffset(conf) + 12) % 12
+		if u == unitFiscalQuarter {
+			elapsed %= 3
+		}
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location()).AddDate(0, -elapsed, 0)
+	}
+	return day
+}
+
+//addUnits adds n units of time to t
+func addUnits(t time.Time, u dateUnit, n int) time.Time {
+	switch u {
+	case unitWeek:
+		return t.AddDate(0, 0, 7*n)
+	case unitMonth:
+		return t.AddDate(0, n, 0)
+	case unitQuarter, unitFiscalQuarter:
+		return t.AddDate(0, 3*n, 0)
+	case unitYear, unitFiscalYear:
+		return t.AddDate(n, 0, 0)
+	}
+	return t.AddDate(0, 0, n)
+}
+
+//DatePhraseUIDPrefix is the prefix of the uid of the value nodes of the date phrases
+const DatePhraseUIDPrefix = "date-phrase:"
+
+//DatePhraseNode returns the value node of the date phrase for the default date field of the table.
+//Returns false if the phrase is not a date phrase or the table has no default date field
+func DatePhraseNode(phrase string, table *interpreter.TableNode) (*interpreter.ValueNode, bool) {
+	if table == nil || table.DefaultDateField == nil {
+		return nil, false
+	}
+	if _, ok := ParseDatePhrase(phrase, time.Now(), DefaultDateConfig()); !ok {
+		return nil, false
+	}
+	return newDatePhraseNode(strings.Join(strings.Fields(strings.ToLower(phrase)), " "), table.DefaultDateField), true
+}
+
+//newDatePhraseNode returns the value node of the date phrase for the date column
+func newDatePhraseNode(phrase string, column *interpreter.ColumnNode) *interpreter.ValueNode {
+	return &interpreter.ValueNode{
+		UID:  DatePhraseUIDPrefix + column.UID + ":" + phrase,
+		Word: []rune(phrase),
+		PUID: column.UID,
+		Name: phrase,
+		PN:   column,
+	}
+}
+
+//IsDatePhraseNode returns true if the value node is of a date phrase
+func IsDatePhraseNode(v *interpreter.ValueNode) bool {
+	return strings.HasPrefix(v.UID, DatePhraseUIDPrefix)
+}
+
+//ResolveDatePhraseNode resolves the value node of a date phrase into a date range relative to now.
+//Returns false if the node is not of a date phrase
+func ResolveDatePhraseNode(v *interpreter.ValueNode, now time.Time, conf DateConfig) (DateRange, bool) {
+	if !IsDatePhraseNode(v) {
+		return DateRange{}, false
+	}
+	return ParseDatePhrase(v.Name, now, conf)
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+//day returns the start of the given day in UTC
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParseDatePhrase(t *testing.T) {
+	//wednesday
+	now := time.Date(2025, time.August, 13, 15, 30, 0, 0, time.UTC)
+	conf := DefaultDateConfig()
+	cases := map[string]DateRange{
+		"today":               {day(2025, 8, 13), day(2025, 8, 14)},
+		"Yesterday":           {day(2025, 8, 12), day(2025, 8, 13)},
+		"tomorrow":            {day(2025, 8, 14), day(2025, 8, 15)},
+		"this week":           {day(2025, 8, 11), day(2025, 8, 18)},
+		"last  month":         {day(2025, 7, 1), day(2025, 8, 1)},
+		"next quarter":        {day(2025, 10, 1), day(2026, 1, 1)},
+		"previous year":       {day(2024, 1, 1), day(2025, 1, 1)},
+		"past 7 days":         {day(2025, 8, 7), day(2025, 8, 14)},
+		"last 2 weeks":        {day(2025, 8, 4), day(2025, 8, 18)},
+		"next 3 months":       {day(2025, 8, 1), day(2025, 11, 1)},
+		"past 45 days":        {day(2025, 6, 30), day(2025, 8, 14)},
+		"year to date":        {day(2025, 1, 1), day(2025, 8, 14)},
+		"mtd":                 {day(2025, 8, 1), day(2025, 8, 14)},
+		"wtd":                 {day(2025, 8, 11), day(2025, 8, 14)},
+		"Q3":                  {day(2025, 7, 1), day(2025, 10, 1)},
+		"Q3 2025":             {day(2025, 7, 1), day(2025, 10, 1)},
+		"q1 2019":             {day(2019, 1, 1), day(2019, 4, 1)},
+		"fy2024":              {day(2024, 1, 1), day(2025, 1, 1)},
+		"this fiscal year":    {day(2025, 1, 1), day(2026, 1, 1)},
+		"last fiscal quarter": {day(2025, 4, 1), day(2025, 7, 1)},
+	}
+	for phrase, expected := range cases {
+		r, ok := ParseDatePhrase(phrase, now, conf)
+		if !ok {
+			t.Errorf("expected %q to be a date phrase", phrase)
+			continue
+		}
+		if !r.From.Equal(expected.From) || !r.To.Equal(expected.To) {
+			t.Errorf("expected %q to resolve to %v - %v, got %v - %v", phrase, expected.From, expected.To, r.From, r.To)
+		}
+	}
+	for _, phrase := range []string{"", "revenue", "this 3 days", "past days", "past 0 days", "q5", "q3 25", "fy25", "last fortnight"} {
+		if _, ok := ParseDatePhrase(phrase, now, conf); ok {
+			t.Errorf("expected %q not to be a date phrase", phrase)
+		}
+	}
+}
+
+func TestStartOfTheWeek(t *testing.T) {
+	//sunday
+	now := time.Date(2025, time.August, 17, 10, 0, 0, 0, time.UTC)
+	if got := startOf(now, unitWeek, DateConfig{WeekStart: time.Monday}); !got.Equal(day(2025, 8, 11)) {
+		t.Errorf("expected the week starting on monday to start on the 11th, got %v", got)
+	}
+	if got := startOf(now, unitWeek, DateConfig{WeekStart: time.Sunday}); !got.Equal(day(2025, 8, 17)) {
+		t.Errorf("expected the week starting on sunday to start on the day itself, got %v", got)
+	}
+	if got := startOf(now, unitWeek, DateConfig{WeekStart: time.Saturday}); !got.Equal(day(2025, 8, 16)) {
+		t.Errorf("expected the week starting on saturday to start on the 16th, got %v", got)
+	}
+	if got := startOf(now, unitQuarter, DefaultDateConfig()); !got.Equal(day(2025, 7, 1)) {
+		t.Errorf("expected the quarter to start in july, got %v", got)
+	}
+}
+
+func TestFiscalYearBoundaries(t *testing.T) {
+	//fiscal year starting in april
+	conf := DateConfig{WeekStart: time.Monday, FiscalYearOffset: 3}
+	cases := []struct {
+		now      time.Time
+		phrase   string
+		expected DateRange
+	}{
+		{day(2025, 3, 31), "this fiscal year", DateRange{day(2024, 4, 1), day(2025, 4, 1)}},
+		{day(2025, 4, 1), "this fiscal year", DateRange{day(2025, 4, 1), day(2026, 4, 1)}},
+		{day(2025, 4, 1), "last fiscal year", DateRange{day(2024, 4, 1), day(2025, 4, 1)}},
+		{day(2025, 6, 30), "this fiscal quarter", DateRange{day(2025, 4, 1), day(2025, 7, 1)}},
+		{day(2025, 7, 1), "this fiscal quarter", DateRange{day(2025, 7, 1), day(2025, 10, 1)}},
+		{day(2025, 5, 20), "fiscal year to date", DateRange{day(2025, 4, 1), day(2025, 5, 21)}},
+		{day(2025, 5, 20), "fy2025", DateRange{day(2024, 4, 1), day(2025, 4, 1)}},
+		{day(2025, 5, 20), "q1 fy2026", DateRange{day(2025, 4, 1), day(2025, 7, 1)}},
+		{day(2025, 5, 20), "q4 fy2025", DateRange{day(2025, 1, 1), day(2025, 4, 1)}},
+	}
+	for _, c := range cases {
+		r, ok := ParseDatePhrase(c.phrase, c.now, conf)
+		if !ok || !r.From.Equal(c.expected.From) || !r.To.Equal(c.expected.To) {
+			t.Errorf("expected %q on %v to resolve to %v - %v, got %v - %v", c.phrase, c.now, c.expected.From, c.expected.To, r.From, r.To)
+		}
+	}
+
+	//offsets beyond a year wrap around
+	r, _ := ParseDatePhrase("fy2025", day(2025, 1, 1), DateConfig{FiscalYearOffset: -9})
+	if !r.From.Equal(day(2024, 4, 1)) {
+		t.Errorf("expected the negative offset to wrap around to april, got %v", r.From)
+	}
+}
+
+func TestDatePhrasesAreIndexed(t *testing.T) {
+	year := strconv.Itoa(time.Now().Year())
+	phrases := map[string]struct{}{}
+	for _, p := range DatePhrases() {
+		if _, ok := ParseDatePhrase(p, time.Now(), DefaultDateConfig()); !ok {
+			t.Errorf("expected the indexed phrase %q to be a date phrase", p)
+		}
+		phrases[p] = struct{}{}
+	}
+	for _, p := range []string{"q3 " + year, "q1 fy" + year, "fy" + year, "past 7 days", "past 1 day", "next 6 months", "past 2 years"} {
+		if _, ok := phrases[p]; !ok {
+			t.Errorf("expected the phrase %q to be indexed", p)
+		}
+	}
+
+	table := &interpreter.TableNode{UID: "table"}
+	if _, ok := DatePhraseNode("past 7 days", table); ok {
+		t.Error("expected no date phrase node for a table without a default date field")
+	}
+	table.DefaultDateField = &interpreter.ColumnNode{UID: "created"}
+	n, ok := DatePhraseNode("Past  7 Days", table)
+	if !ok || n.Name != "past 7 days" || n.PUID != "created" || !IsDatePhraseNode(n) {
+		t.Errorf("expected the normalised date phrase node of the default date field, got %+v", n)
+	}
+}
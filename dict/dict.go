@@ -2,13 +2,18 @@
 // Use of this source code is governed by a MIT-style
 // license that can be found in the LICENSE file.
 
-//Package dict has the implementation of the dictionary api for the platform
+//Package dict has the implementation of the dictionary api for the platform.
+//
+//The datasets of the dictionaries are cached by a DatasetCache. No go routines are started on importing the package.
+//The default dataset cache is started by Start, SetDefaultDatasetAggregator or NewDAgg and requests made to it before
+//that fail with ErrDatasetCacheNotStarted. Sends on the deprecated DatasetInputChannel block till it is started.
+//Services embedding the package are to stop it with Shutdown for a graceful exit. Caches created with NewDatasetCache
+//are to be started with their Start method and stopped with their Shutdown or Close methods
 package dict
 
 import (
+	"context"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/cuttle-ai/brain/log"
@@ -17,27 +22,214 @@ import (
 	"github.com/jinzhu/gorm"
 )
 
+//DatasetRequestTimeout is the maximum time the dict aggregator waits for the dataset cache while building a dict
+const DatasetRequestTimeout = time.Minute * 2
+
 //DAgg is the dict aggregator for getting the dict from the database
 type DAgg struct {
-	db *gorm.DB
-	l  log.Log
+	db    *gorm.DB
+	l     log.Log
+	cache *DatasetCache
+	//fuzzy has the fuzzy indexes built along with the user dictionaries. It is nil if fuzzy indexing is not enabled
+	fuzzy *fuzzyIndexes
+	//fuzzyMaxDistance is the maximum edit distance for the fuzzy matches
+	fuzzyMaxDistance int
+	//phrases has the phrase indexes built along with the user dictionaries. It is nil if phrase indexing is not enabled
+	phrases *phraseIndexes
+	//normaliser normalises the token words into their keys in the dictionary
+	normaliser Normaliser
+	//localeResolver resolves the locale of the users whose locale is not given in the request context
+	localeResolver LocaleResolver
+	//dateConf is the configuration for resolving the date phrases
+	dateConf DateConfig
+	//values is the source of the distinct values of the columns. It is nil if value indexing is not enabled
+	values ValueSource
+	//valueLimit is the maximum no. of distinct values of a column to be indexed
+	valueLimit int
+	//ranking has the weights for ranking the nodes of the merged tokens
+	ranking RankingWeights
+	//usage is the source of the users' usage of the nodes. It is nil if the usage is not tracked
+	usage UsageSource
+	//locales has the locales of the system dictionaries in the built dictionaries. It is nil if the system dictionaries are not reloaded
+	locales *localeIndex
+	//unobserve removes the registration keeping the indexes in sync with the cache. It is nil if the cache is not observed
+	unobserve func()
 }
 
-//NewDAgg returns an instance of DAgg dict aggregator
+//NewDAgg returns an instance of DAgg dict aggregator which uses the default dataset cache.
+//The default dataset cache is started if not started yet. It is to be stopped with Shutdown
 func NewDAgg(db *gorm.DB, l log.Log) *DAgg {
-	return &DAgg{db, l}
+	DefaultDatasetCache.Start()
+	return &DAgg{db: db, l: l, cache: DefaultDatasetCache, normaliser: DefaultNormaliser, dateConf: DefaultDateConfig(), ranking: DefaultRankingWeights()}
+}
+
+//NewDAggWithCache returns an instance of DAgg dict aggregator which uses the given dataset cache
+func NewDAggWithCache(db *gorm.DB, l log.Log, cache *DatasetCache) *DAgg {
+	return &DAgg{db: db, l: l, cache: cache, normaliser: DefaultNormaliser, dateConf: DefaultDateConfig(), ranking: DefaultRankingWeights()}
+}
+
+//SetNormaliser sets the normaliser used for the keys of the tokens in the dataset token maps and the user dictionaries.
+//Since the cached datasets were built with the previous normaliser, it is to be set before the dictionaries are built
+func (d *DAgg) SetNormaliser(n Normaliser) {
+	d.normaliser = n
+}
+
+//Normalise normalises the word with the normaliser of the dict aggregator. Words looked up in the
+//dictionaries built by the aggregator are to be normalised with it
+func (d DAgg) Normalise(word string) string {
+	return normalise(d.normaliser, word)
+}
+
+//SetLocaleResolver sets the resolver of the users' locale. The system dictionary of the resolved locale is added to
+//the user dictionaries built without a locale in the request context
+func (d *DAgg) SetLocaleResolver(r LocaleResolver) {
+	d.localeResolver = r
+}
+
+//Locale returns the locale of the user's dictionary. The locale in the context is preferred over the locale resolved
+//for the user. If neither is available DefaultLocale is returned. The locale isn't part of the user id, so a dictionary
+//requested with the user id is built in a single locale. Locale dictionaries are requested with LocaleDICTID instead
+func (d DAgg) Locale(ctx context.Context, ID string) string {
+	if l, ok := LocaleFromContext(ctx); ok {
+		return l
+	}
+	if d.localeResolver != nil {
+		if l, ok := d.localeResolver(ID); ok && len(l) > 0 {
+			return l
+		}
+	}
+	return DefaultLocale
+}
+
+//SetDateConfig sets the configuration for resolving the date phrases like the start of the week and the fiscal year offset
+func (d *DAgg) SetDateConfig(conf DateConfig) {
+	d.dateConf = conf
+}
+
+//ResolveDate resolves the value node of a date phrase in the dictionary into a date range relative to now.
+//The range applies to the column of the node which is the default date field of its table.
+//Returns false if the node is not of a date phrase
+func (d DAgg) ResolveDate(v *interpreter.ValueNode, now time.Time) (DateRange, bool) {
+	return ResolveDatePhraseNode(v, now, d.dateConf)
+}
+
+//SetRankingWeights sets the weights for ranking the nodes of the tokens merged from the user's datasets
+func (d *DAgg) SetRankingWeights(w RankingWeights) {
+	d.ranking = w
+}
+
+//SetUsageSource sets the source of the no. of times the users have queried the nodes. It is used for ranking the nodes
+func (d *DAgg) SetUsageSource(u UsageSource) {
+	d.usage = u
+}
+
+//EnableFuzzyIndex enables building a fuzzy index along with each user dictionary. The fuzzy index can be used
+//for typo tolerant lookups through Suggest. Non positive maxDistance falls back to DefaultFuzzyMaxDistance.
+//The index is removed when the dictionary is dropped and built again along with it
+func (d *DAgg) EnableFuzzyIndex(maxDistance int) {
+	d.fuzzy = &fuzzyIndexes{indexes: map[string]*FuzzyIndex{}, built: map[string]time.Time{}}
+	d.fuzzyMaxDistance = maxDistance
+	d.observeIndexes()
+}
+
+//observeIndexes registers with the cache to remove the indexes of the dictionaries along with the dictionaries dropped by it.
+//The indexes are removed synchronously so that they never outlive their dictionaries
+func (d *DAgg) observeIndexes() {
+	if d.unobserve != nil || d.cache == nil {
+		return
+	}
+	d.unobserve = d.cache.OnDICTsDropped(func(IDs []string, at time.Time) {
+		d.dropIndexes(at, IDs...)
+	})
+}
+
+//Close removes the registration of the aggregator with its dataset cache for keeping the indexes in sync.
+//It is to be called once the aggregator is no longer used. The cache itself is not stopped
+func (d *DAgg) Close() {
+	if d.unobserve != nil {
+		d.unobserve()
+		d.unobserve = nil
+	}
+}
+
+//dropIndexes removes the indexes of the dictionaries built before the given time. It is to be called along with dropping the dictionaries
+func (d DAgg) dropIndexes(before time.Time, IDs ...string) {
+	if d.fuzzy != nil {
+		d.fuzzy.remove(before, IDs...)
+	}
+	if d.locales != nil {
+		d.locales.remove(before, IDs...)
+	}
+	if d.phrases != nil {
+		d.phrases.remove(before, IDs...)
+	}
+}
+
+//Suggest returns the candidate tokens for the word from the fuzzy index of the user's dictionary.
+//For a scoped dictionary, the id given by ScopedDICTID is to be used.
+//Returns false if the fuzzy index is not enabled or the user's dictionary is not built yet or was dropped
+func (d DAgg) Suggest(ID, word string, limit int) ([]FuzzyMatch, bool) {
+	if d.fuzzy == nil {
+		return nil, false
+	}
+	i, ok := d.fuzzy.get(ID)
+	if !ok {
+		return nil, false
+	}
+	return i.Lookup(d.Normalise(word), limit), true
+}
+
+//EnablePhraseIndex enables building a phrase index along with each user dictionary. The phrase index can be used
+//to find the multi word tokens in a query through Scan. The index is removed when the dictionary is dropped
+//and built again along with it
+func (d *DAgg) EnablePhraseIndex() {
+	d.phrases = &phraseIndexes{indexes: map[string]*PhraseIndex{}, shared: map[string]struct{}{}, built: map[string]time.Time{}}
+	d.observeIndexes()
+}
+
+//Phrases returns the phrase index of the user's dictionary.
+//Returns false if the phrase index is not enabled or the user's dictionary is not built yet or was dropped
+func (d DAgg) Phrases(ID string) (*PhraseIndex, bool) {
+	if d.phrases == nil {
+		return nil, false
+	}
+	return d.phrases.get(ID)
 }
 
-//Get returns the user dictionary from the database
+//Scan returns the longest matching tokens of the user's dictionary found in the query from left to right.
+//For a scoped dictionary, the id given by ScopedDICTID is to be used.
+//Returns false if the phrase index is not enabled or the user's dictionary is not built yet or was dropped
+func (d DAgg) Scan(ID, query string) ([]PhraseMatch, bool) {
+	i, ok := d.Phrases(ID)
+	if !ok {
+		return nil, false
+	}
+	return i.Scan(query), true
+}
+
+//Get returns the user dictionary from the database.
+//It will give up waiting for the dataset cache after DatasetRequestTimeout
 func (d DAgg) Get(ID string, update bool) (interpreter.DICT, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DatasetRequestTimeout)
+	defer cancel()
+	return d.GetWithContext(ctx, ID, update)
+}
+
+//GetWithContext returns the user dictionary from the database. The dataset cache requests honour the given context.
+//The system dictionary added is of the user's locale. See Locale. The id can be a LocaleDICTID for the dictionary of
+//the user in that locale. Members of teams share the dictionaries of their teams with their own datasets layered on top. See GetTeam
+func (d DAgg) GetWithContext(ctx context.Context, ID string, update bool) (interpreter.DICT, error) {
 	/*
 	 * We will convert the id to integer
 	 * We will get all the datasets the user has access to
-	 * Then we will get the nodes belonging to those datasets
-	 * Then we will add the system dict
+	 * Then we will get the teams of the user
+	 * Then we will build the dictionary from those datasets and the system dict.
+	 * Members of teams get their datasets layered over the shared dictionaries of the teams
 	 */
 	result := interpreter.DICT{Map: map[string]interpreter.Token{}}
-	//parsing the user id
+	//parsing the user id. the dictionary is subscribed to the datasets with the id it is requested for
+	key := ID
+	ID, ctx = userLocale(ctx, ID)
 	id, err := strconv.Atoi(ID)
 	if err != nil {
 		d.l.Error("error while parsing the id from string to integer", ID)
@@ -52,44 +244,130 @@ func (d DAgg) Get(ID string, update bool) (interpreter.DICT, error) {
 		return result, err
 	}
 
-	//iterating through the list and getting the datasets
+	//finding the teams of the user
+	teams, err := models.GetUserTeams(d.db, uint(id))
+	if err != nil {
+		d.l.Error("error while getting the list of teams of the user", ID)
+		return result, err
+	}
+
+	//building the dictionary
+	dIDs := make([]string, 0, len(datasets))
 	for _, v := range datasets {
-		req := DatasetRequest{ID: strconv.Itoa(int(v.DatasetID)), SubscribeID: ID, Type: DatasetGet, Out: make(chan DatasetRequest)}
-		if update {
-			req.Type = DatasetUpdate
-		}
-		DatasetInputChannel <- req
-		req = <-req.Out
-		if !req.Valid {
+		dIDs = append(dIDs, strconv.Itoa(int(v.DatasetID)))
+	}
+	if len(teams) > 0 {
+		return d.buildLayered(ctx, key, ID, teams, dIDs, update)
+	}
+	return d.build(ctx, key, ID, dIDs, update)
+}
+
+//build builds the dictionary with the given key for the user from the given datasets and the system dict.
+//The key is subscribed to the datasets and unsubscribed from the datasets not in the list
+func (d DAgg) build(ctx context.Context, key, ID string, dIDs []string, update bool) (interpreter.DICT, error) {
+	/*
+	 * We will sync the subscriptions of the key with the datasets
+	 * Then we will get the datasets and merge their tokens
+	 * Then we will rank the nodes of the tokens
+	 * Then we will add the system dict
+	 */
+	result := interpreter.DICT{Map: map[string]interpreter.Token{}}
+	//the key is unsubscribed from the datasets it doesn't include anymore
+	err := d.cache.SyncSubscriptions(key, dIDs)
+	if err != nil {
+		d.l.Error("error while syncing the dataset subscriptions of", key)
+		return result, err
+	}
+
+	//getting the datasets. the cached ones are served at once and the rest are loaded together.
+	//the datasets are reloaded together if they have to be updated
+	var datasets map[string]Dataset
+	if update {
+		datasets, err = d.cache.UpdateMany(ctx, dIDs, key)
+	} else {
+		datasets, err = d.cache.GetMany(ctx, dIDs, key)
+	}
+	if err != nil {
+		d.l.Error("error while getting the datasets", dIDs, "for", key)
+		return result, err
+	}
+	nodeDatasets := map[interpreter.Node]string{}
+	for _, dID := range dIDs {
+		dataset, ok := datasets[dID]
+		if !ok {
 			continue
 		}
 		//iterating through the result and adding to the token list
-		for k, t := range req.Dataset.D {
-			existing, ok := result.Map[k]
-			if ok {
-				t.Nodes = append(t.Nodes, existing.Nodes...)
+		for k, t := range dataset.D {
+			mergeToken(result.Map, k, t)
+			for _, n := range t.Nodes {
+				nodeDatasets[n] = dID
 			}
-			result.Map[k] = t
 		}
 	}
 
-	//adding the system dict
-	systemnDict := SystemDICT()
+	//ranking the nodes of the merged tokens
+	d.rank(ID, result.Map, nodeDatasets, datasets)
+
+	//adding the system dict of the user's locale
+	locale := d.Locale(ctx, ID)
+	systemnDict := SystemDICTForLocale(locale)
 	for k, v := range systemnDict.Map {
-		existing, ok := result.Map[k]
-		if ok {
-			v.Nodes = append(v.Nodes, existing.Nodes...)
-		}
-		result.Map[strings.ToLower(k)] = v
+		mergeToken(result.Map, d.Normalise(k), v)
+	}
+	if d.locales != nil {
+		d.locales.set(key, locale)
+	}
+
+	//building the fuzzy index
+	if d.fuzzy != nil {
+		d.fuzzy.set(key, NewFuzzyIndex(result, d.fuzzyMaxDistance))
+	}
+
+	//syncing the phrase index
+	if d.phrases != nil {
+		d.phrases.sync(key, result, d.normaliser)
 	}
 
 	return result, nil
 }
 
+//rank orders the nodes of the user's tokens by their ranking score. The recency of the datasets is taken from the
+//update time of the given datasets. The usage of the user is skipped for the shared dictionaries.
+//Failing to get the usage is not an error since the dictionary is usable without it
+func (d DAgg) rank(ID string, tokens map[string]interpreter.Token, nodeDatasets map[interpreter.Node]string, datasets map[string]Dataset) {
+	/*
+	 * We will get the update time of the datasets
+	 * Then we will get the usage of the user
+	 * Then we will rank the tokens
+	 */
+	//getting the update time of the datasets
+	updated := make(map[string]time.Time, len(datasets))
+	for k, v := range datasets {
+		if !v.UpdatedAt.IsZero() {
+			updated[k] = v.UpdatedAt
+		}
+	}
+
+	//getting the usage of the user
+	usage := map[string]int{}
+	if d.usage != nil && !sharedDICT(ID) {
+		u, err := d.usage.NodeUsage(ID)
+		if err != nil {
+			d.l.Error("error while getting the usage of the user for ranking the nodes", ID, err)
+		} else {
+			usage = u
+		}
+	}
+
+	newRanker(d.ranking, nodeDatasets, updated, usage).rank(tokens)
+}
+
 //GetDataset will get the dataset required for the given id
 func (d DAgg) GetDataset(ID string) (Dataset, error) {
 	/*
 	 * We will parse the id of the dataset
+	 * We will find the update time of the dataset
 	 * We will find all the nodes associated with the dataset
 	 * We will find all the node metadata associated with the dataset
 	 * Will convert them into token
@@ -102,6 +380,16 @@ func (d DAgg) GetDataset(ID string) (Dataset, error) {
 		return result, err
 	}
 
+	//finding the update time of the dataset. it is found before the nodes so that a change during the build
+	//leaves the dataset older than its latest update
+	dataset := models.Dataset{}
+	err = d.db.Where("id = ?", id).First(&dataset).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		d.l.Error("error while getting the dataset", ID)
+		return result, err
+	}
+	result.UpdatedAt = dataset.UpdatedAt
+
 	//finding all the nodes associated with the dataset
 	nodes := []models.Node{}
 	err = d.db.Where("dataset_id = ?", id).Find(&nodes).Error
@@ -118,12 +406,106 @@ func (d DAgg) GetDataset(ID string) (Dataset, error) {
 		return result, err
 	}
 
+	//finding the indexed values of the columns
+	values, err := d.getColumnValues(uint(id))
+	if err != nil {
+		d.l.Error("error while getting the indexed values of the columns of the dataset", ID)
+		return result, err
+	}
+
 	//converting the nodes to tokens
-	//we will iterate through the nodes and store them in map
-	//then we will iterate through the node metadatas and store them to the correspoding nodes in the map
-	//finally will convert them to interpreter nodes
+	d.addNodeTokens(result.D, nodes, nodeMetadatas, values)
+
+	return result, nil
+}
+
+//GetDatasets returns the datasets of the given ids mapped to their ids. Unlike GetDataset called for each of them,
+//the nodes, the node metadata and the indexed values of all the datasets are found with a single query each
+func (d DAgg) GetDatasets(IDs []string) (map[string]Dataset, error) {
+	/*
+	 * We will parse the ids of the datasets
+	 * We will find the update time of the datasets
+	 * We will find all the nodes, the node metadata and the indexed values of the datasets
+	 * Will group them by the dataset and convert them into tokens
+	 */
+	result := map[string]Dataset{}
+	//parsing the ids of the datasets
+	ids := make([]uint, 0, len(IDs))
+	for _, ID := range IDs {
+		id, err := strconv.Atoi(ID)
+		if err != nil {
+			d.l.Error("error while parsing the id from string to integer", ID)
+			return result, err
+		}
+		ids = append(ids, uint(id))
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	//finding the update time of the datasets. it is found before the nodes as in GetDataset
+	datasets := []models.Dataset{}
+	err := d.db.Where("id IN (?)", ids).Find(&datasets).Error
+	if err != nil {
+		d.l.Error("error while getting the datasets", IDs)
+		return result, err
+	}
+	updated := make(map[uint]time.Time, len(datasets))
+	for _, v := range datasets {
+		updated[v.ID] = v.UpdatedAt
+	}
+
+	//finding all the nodes of the datasets
+	nodes := []models.Node{}
+	err = d.db.Where("dataset_id IN (?)", ids).Find(&nodes).Error
+	if err != nil {
+		d.l.Error("error while getting the list of nodes of the datasets", IDs)
+		return result, err
+	}
+
+	//finding all the node metadata of the datasets
+	nodeMetadatas := []models.NodeMetadata{}
+	err = d.db.Where("dataset_id IN (?)", ids).Find(&nodeMetadatas).Error
+	if err != nil {
+		d.l.Error("error while getting the list of node metadata of the datasets", IDs)
+		return result, err
+	}
+
+	//finding the indexed values of the columns
+	values, err := d.getDatasetsColumnValues(ids)
+	if err != nil {
+		d.l.Error("error while getting the indexed values of the columns of the datasets", IDs)
+		return result, err
+	}
+
+	//grouping them by the dataset and converting them to tokens
+	dNodes := map[uint][]models.Node{}
+	for _, n := range nodes {
+		dNodes[n.DatasetID] = append(dNodes[n.DatasetID], n)
+	}
+	dMetadatas := map[uint][]models.NodeMetadata{}
+	for _, m := range nodeMetadatas {
+		dMetadatas[m.DatasetID] = append(dMetadatas[m.DatasetID], m)
+	}
+	for i, id := range ids {
+		dataset := Dataset{D: map[string]interpreter.Token{}, UpdatedAt: updated[id]}
+		d.addNodeTokens(dataset.D, dNodes[id], dMetadatas[id], values[id])
+		result[IDs[i]] = dataset
+	}
+
+	return result, nil
+}
+
+//addNodeTokens converts the nodes of a dataset along with their metadata and the indexed values of the columns into tokens
+func (d DAgg) addNodeTokens(tokens map[string]interpreter.Token, nodes []models.Node, nodeMetadatas []models.NodeMetadata, values map[uint][]models.ColumnValue) {
+	/*
+	 * We will iterate through the nodes and store them in map
+	 * Then we will iterate through the node metadatas and store them to the correspoding nodes in the map
+	 * Then we will find the tables along with their default date fields
+	 * Then will convert them to interpreter nodes attached to their tables
+	 * Finally we will add the date phrases of each table and disambiguate the columns having the same word in different tables
+	 */
 	nMap := map[uint]models.Node{}
-	var tableNode *models.Node
 	for _, n := range nodes {
 		nMap[n.ID] = n
 	}
@@ -137,13 +519,24 @@ func (d DAgg) GetDataset(ID string) (Dataset, error) {
 		}
 		n.NodeMetadatas = append(n.NodeMetadatas, m)
 		nMap[m.NodeID] = n
-		if n.Type == interpreter.Table {
-			tableNode = &n
+	}
+
+	//finding the tables. if default date exists add it to the table node
+	tables := map[string]*models.Node{}
+	dateFieldUIDs := map[string]string{}
+	for _, n := range nMap {
+		if n.Type != interpreter.Table {
+			continue
 		}
+		tableNode := n
+		tables[n.UID.String()] = &tableNode
 	}
-	//if default date exists add it to the node
-	if tableNode != nil && len(tableNode.TableNode().DefaultDateFieldUID) > 0 {
+	for _, tableNode := range tables {
 		tConverted := tableNode.TableNode()
+		if len(tConverted.DefaultDateFieldUID) == 0 {
+			continue
+		}
+		dateFieldUIDs[tConverted.UID] = tConverted.DefaultDateFieldUID
 		for _, n := range nMap {
 			if n.Type != interpreter.Table && tConverted.DefaultDateFieldUID == n.UID.String() {
 				c := n.ColumnNode()
@@ -153,195 +546,312 @@ func (d DAgg) GetDataset(ID string) (Dataset, error) {
 			}
 		}
 	}
+	//a dataset with a single table has all its nodes attached to it irrespective of their parent
+	var onlyTable *models.Node
+	if len(tables) == 1 {
+		for _, t := range tables {
+			onlyTable = t
+		}
+	}
+
+	//converting the nodes to interpreter nodes
+	columns := map[string][]*interpreter.ColumnNode{}
+	dateFields := map[string]*interpreter.ColumnNode{}
 	for _, n := range nMap {
-		if n.Type != interpreter.Table && tableNode != nil {
-			n.Parent = tableNode
-			n.PUID = tableNode.UID
+		if n.Type == interpreter.Table {
+			n = *tables[n.UID.String()]
+		} else if t, ok := tables[n.PUID.String()]; ok {
+			n.Parent = t
+		} else if onlyTable != nil {
+			n.Parent = onlyTable
+			n.PUID = onlyTable.UID
 		}
 		iN, ok := n.InterpreterNode()
 		if !ok {
 			continue
 		}
-		tok, ok := result.D[string(iN.TokenWord())]
+		//the node is indexed with its word and each of its synonyms
+		k := d.Normalise(string(iN.TokenWord()))
+		addToken(tokens, k, iN.TokenWord(), iN)
+		for _, s := range n.Synonyms() {
+			addToken(tokens, d.Normalise(s), []rune(s), iN)
+		}
+		c, ok := iN.(*interpreter.ColumnNode)
 		if !ok {
-			tok = interpreter.Token{Word: iN.TokenWord(), Nodes: []interpreter.Node{}}
+			continue
+		}
+		columns[k] = append(columns[k], c)
+		if uid, ok := dateFieldUIDs[c.PUID]; ok && uid == c.UID {
+			dateFields[c.PUID] = c
+		}
+		if v, ok := values[n.ID]; ok {
+			d.addValueTokens(tokens, c, v)
 		}
-		tok.Nodes = append(tok.Nodes, iN)
-		result.D[strings.ToLower(string(iN.TokenWord()))] = tok
 	}
 
-	return result, nil
+	//the date phrases are indexed as the values of the default date field of each table
+	phrases := DatePhrases()
+	for _, dateField := range dateFields {
+		for _, p := range phrases {
+			addToken(tokens, d.Normalise(p), []rune(p), newDatePhraseNode(p, dateField))
+		}
+	}
+
+	//the columns having the same word in different tables are also indexed with the word of their table as prefix
+	for _, cs := range columns {
+		if !acrossTables(cs) {
+			continue
+		}
+		for _, c := range cs {
+			if c.PN == nil || len(c.PN.Word) == 0 {
+				continue
+			}
+			word := []rune(string(c.PN.Word) + " " + string(c.Word))
+			addToken(tokens, d.Normalise(string(word)), word, c)
+		}
+	}
 }
 
-//DatasetRequestType is the type of the request for the dataset
-type DatasetRequestType uint
+//acrossTables returns true if the columns belong to more than one table
+func acrossTables(columns []*interpreter.ColumnNode) bool {
+	for _, c := range columns[1:] {
+		if c.PUID != columns[0].PUID {
+			return true
+		}
+	}
+	return false
+}
 
-const (
-	//DatasetUpdate comes to update and datatset and update corresponding subscribed ids
-	DatasetUpdate DatasetRequestType = 1
-	//DatasetGet returns the dataset of a given id
-	DatasetGet DatasetRequestType = 2
-	//DatasetRemove to remove the dataset from the cache
-	DatasetRemove DatasetRequestType = 3
-)
+//DatasetsUpdatedAt returns the update time of the datasets mapped to their ids. The datasets not existing are omitted
+func (d DAgg) DatasetsUpdatedAt(IDs []string) (map[string]time.Time, error) {
+	result := map[string]time.Time{}
+	ids := make([]int, 0, len(IDs))
+	for _, v := range IDs {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+	datasets := []models.Dataset{}
+	err := d.db.Where("id in (?)", ids).Find(&datasets).Error
+	if err != nil {
+		d.l.Error("error while getting the update time of the datasets", IDs)
+		return result, err
+	}
+	for _, v := range datasets {
+		result[strconv.Itoa(int(v.ID))] = v.UpdatedAt
+	}
+	return result, nil
+}
 
-//DatasetClearCheckInterval is the interval after which the datatset removal check has to run
-const DatasetClearCheckInterval = time.Minute * 20
+//RevokeAccess removes the access of the user to the dataset. The user is unsubscribed from the dataset
+//and the DICTs of the user, including the scoped and the locale ones, are dropped so that they get rebuilt without the dataset
+func (d DAgg) RevokeAccess(datasetID, userID uint) error {
+	err := d.db.Where("dataset_id = ? and user_id = ?", datasetID, userID).Delete(&models.DatsetUserMapping{}).Error
+	if err != nil {
+		d.l.Error("error while removing the access of the user", userID, "to the dataset", datasetID)
+		return err
+	}
+	uID := strconv.Itoa(int(userID))
+	dID := strconv.Itoa(int(datasetID))
 
-//DatasetExpiry is the expiry time after which the datatset expiries without any active usage
-const DatasetExpiry = time.Hour * 4
+	//the scoped and the locale dictionaries of the user including the dataset are dropped along with the user dictionary
+	ctx, cancel := context.WithTimeout(context.Background(), DatasetRequestTimeout)
+	defer cancel()
+	subs, err := d.cache.Subscribers(ctx, dID)
+	if err != nil {
+		d.l.Error("error while getting the subscribers of the dataset", datasetID)
+		return err
+	}
+	keys := []string{uID}
+	for _, k := range subs {
+		if k != uID && dictUser(k) == uID {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		err = d.cache.Unsubscribe(dID, k)
+		if err != nil {
+			d.l.Error("error while unsubscribing", k, "of the user", userID, "from the dataset", datasetID)
+			return err
+		}
+	}
+	removeSubscribedDICTs(keys)
+	d.dropIndexes(time.Now(), keys...)
+	return nil
+}
 
-//DatasetAggregator is the aggregator to get the dict from a service or database
-type DatasetAggregator interface {
-	GetDataset(ID string) (Dataset, error)
+//addToken adds the node to the token with the given key in the token map. The token is created with the given word if not existing
+func addToken(tokens map[string]interpreter.Token, k string, word []rune, n interpreter.Node) {
+	tok, ok := tokens[k]
+	if !ok {
+		tok = interpreter.Token{Word: word, Nodes: []interpreter.Node{}}
+	}
+	tok.Nodes = append(tok.Nodes, n)
+	tokens[k] = tok
 }
 
-//defaultAggregator to be used in the dictionary
-var defaultAggregator aggregator
+//mergeToken merges the token into the token with the given key in the token map. The nodes of the merged token come first.
+//The node lists are copied so that the tokens shared with the dataset cache are never modified
+func mergeToken(tokens map[string]interpreter.Token, k string, t interpreter.Token) {
+	existing, ok := tokens[k]
+	nodes := make([]interpreter.Node, 0, len(t.Nodes)+len(existing.Nodes))
+	nodes = append(nodes, t.Nodes...)
+	if ok {
+		nodes = append(nodes, existing.Nodes...)
+	}
+	t.Nodes = nodes
+	tokens[k] = t
+}
 
-type aggregator struct {
-	agg DatasetAggregator
-	m   sync.Mutex
+//UpdateColumns updates the columns of the dataset in the database. Instead of reloading the whole dataset,
+//the node level diff of the columns is patched on the cached dataset and the DICTs subscribed to it are built again.
+//Datasets having several tables are invalidated instead. If value indexing is enabled and the dimension columns
+//change, the values are indexed again in the background, which invalidates the dataset once done.
+//Since only the given metadata of the columns are saved, the synonyms of a column are to be removed through UpdateSynonyms
+func (d DAgg) UpdateColumns(ctx context.Context, dataset *models.Dataset, cols []models.Node) ([]models.Node, error) {
+	/*
+	 * We will get the existing columns of the dataset
+	 * Then we will update the columns
+	 * Then we will get the columns after the update and find the diff
+	 * Finally we will patch the diff on the cache
+	 */
+	//getting the existing columns
+	old, err := dataset.GetColumns(d.db)
+	if err != nil {
+		d.l.Error("error while getting the existing columns of the dataset", dataset.ID)
+		return nil, err
+	}
+
+	//updating the columns
+	cols, err = dataset.UpdateColumns(d.l, d.db, cols)
+	if err != nil {
+		d.l.Error("error while updating the columns of the dataset", dataset.ID)
+		return nil, err
+	}
+
+	return cols, d.patchColumns(ctx, dataset, old)
 }
 
-//SetDefaultDatasetAggregator sets the default aggregator as the passed param
-func SetDefaultDatasetAggregator(agg DatasetAggregator) {
-	defaultAggregator.m.Lock()
-	defaultAggregator.agg = agg
-	defaultAggregator.m.Unlock()
+//UpdateSynonyms adds and removes the synonyms of the column of the dataset having the given node id.
+//Like UpdateColumns, the change is patched on the cached dataset and the DICTs subscribed to it are built again. It returns the updated column
+func (d DAgg) UpdateSynonyms(ctx context.Context, dataset *models.Dataset, nodeID uint, add, remove []string) (models.Node, error) {
+	/*
+	 * We will get the existing columns of the dataset and find the column
+	 * Then we will remove and add the synonyms of the column
+	 * Finally we will patch the diff on the cache
+	 */
+	//getting the existing columns
+	old, err := dataset.GetColumns(d.db)
+	if err != nil {
+		d.l.Error("error while getting the existing columns of the dataset", dataset.ID)
+		return models.Node{}, err
+	}
+	node := models.Node{}
+	found := false
+	for _, v := range old {
+		if v.ID == nodeID {
+			node = v
+			node.NodeMetadatas = append([]models.NodeMetadata{}, v.NodeMetadatas...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		d.l.Error("couldn't find the column", nodeID, "in the dataset", dataset.ID)
+		return node, gorm.ErrRecordNotFound
+	}
+
+	//updating the synonyms
+	err = models.RemoveNodeSynonyms(d.l, d.db, &node, remove)
+	if err != nil {
+		d.l.Error("error while removing the synonyms of the column", nodeID, "of the dataset", dataset.ID)
+		return node, err
+	}
+	err = models.AddNodeSynonyms(d.l, d.db, &node, add)
+	if err != nil {
+		d.l.Error("error while adding the synonyms to the column", nodeID, "of the dataset", dataset.ID)
+		return node, err
+	}
+
+	return node, d.patchColumns(ctx, dataset, old)
 }
 
-func getDataset(ID string) (Dataset, bool) {
-	defaultAggregator.m.Lock()
-	if defaultAggregator.agg == nil {
-		return Dataset{}, false
+//patchColumns finds the diff between the given columns of the dataset and its columns in the database
+//and patches it on the cached dataset. Datasets having several tables are invalidated instead
+func (d DAgg) patchColumns(ctx context.Context, dataset *models.Dataset, old []models.Node) error {
+	//getting the updated columns and their tables
+	updated, err := dataset.GetColumns(d.db)
+	if err != nil {
+		d.l.Error("error while getting the updated columns of the dataset", dataset.ID)
+		return err
 	}
-	d, err := defaultAggregator.agg.GetDataset(ID)
+	tables, err := dataset.GetTables(d.db)
 	if err != nil {
-		return Dataset{}, false
-	}
-	defaultAggregator.m.Unlock()
-	return d, true
-}
-
-//Dataset is the dataset instance having the node tokens
-type Dataset struct {
-	D        map[string]interpreter.Token
-	LastUsed time.Time
-}
-
-//DatasetRequest can be used to make a request to get the dataset cache
-type DatasetRequest struct {
-	//ID of the dataset
-	ID string
-	//SubscribeID is the id which subscribes to the dataset
-	SubscribeID string
-	//Type is the type of the dictionary request. It can have Add, Get, Remove
-	Type DatasetRequestType
-	//Dataset has the tokens mapped to the token string for the dataset
-	Dataset Dataset
-	//Valid indicates that the dict is valid. During get requests, if valid is false then cache couldn't find the dict
-	Valid bool
-	//Out channel for sending response to the requester
-	Out chan DatasetRequest
-}
-
-//DatasetInputChannel is the input channel to communicate with the cache
-var DatasetInputChannel chan DatasetRequest
-
-//SendDatasetToChannel sends a dataset request to the channel. This function is to be used with go routines so that
-//datasets isn't blocked by the requests
-func SendDatasetToChannel(ch chan DatasetRequest, req DatasetRequest) {
-	ch <- req
-}
-
-func init() {
-	DatasetInputChannel = make(chan DatasetRequest)
-	defaultAggregator = aggregator{}
-	go Datasets(DatasetInputChannel)
-	go cacheClearCheck(DatasetInputChannel)
-}
-
-//Datasets is the cache providing the datatsets. When a dataset is updated, coresponding users who all have
-//access to that dataset get their DICTs updated automatically
-func Datasets(in chan DatasetRequest) {
-	subscribedMap := map[string][]string{}
-	datasets := map[string]Dataset{}
-	for {
-		req := <-in
-		switch req.Type {
-		case DatasetGet:
-			req.Dataset, req.Valid = datasets[req.ID]
-			if !req.Valid {
-				req.Dataset, req.Valid = getDataset(req.ID)
-			}
-			req.Dataset.LastUsed = time.Now()
-			datasets[req.ID] = req.Dataset
-			s, ok := subscribedMap[req.ID]
-			if !ok {
-				s = []string{}
-			}
-			s = append(s, req.SubscribeID)
-			subscribedMap[req.ID] = s
-			go SendDatasetToChannel(req.Out, req)
-			break
-		case DatasetUpdate:
-			delete(datasets, req.ID)
-			req.Dataset, req.Valid = getDataset(req.ID)
-			req.Dataset.LastUsed = time.Now()
-			v, _ := subscribedMap[req.ID]
-			for _, k := range v {
-				go interpreter.SendDICTToChannel(interpreter.DICTInputChannel, interpreter.DICTRequest{ID: k, Type: interpreter.DICTRemove})
-			}
-			go SendDatasetToChannel(req.Out, req)
-			break
-		case DatasetRemove:
-			//we will iterate over the cache and check the last usage
-			t := time.Now()
-			for k, v := range datasets {
-				if v.LastUsed.Add(DatasetExpiry).After(t) {
-					delete(datasets, k)
-					delete(subscribedMap, k)
-				}
+		d.l.Error("error while getting the tables of the dataset", dataset.ID)
+		return err
+	}
+	for i := 0; i < len(updated); i++ {
+		for j := range tables {
+			if updated[i].PUID == tables[j].UID {
+				updated[i].Parent = &tables[j]
+				break
 			}
 		}
 	}
+
+	//patching the diff
+	diff := DiffNodes(old, updated, d.normaliser)
+	if diff.Empty() {
+		return nil
+	}
+	if d.values != nil && dimensionsChanged(old, updated) {
+		//the values of the dimension columns are indexed again in the background. it invalidates the dataset once done
+		d.IndexValuesInBackground(*dataset)
+	}
+	if len(tables) > 1 {
+		//the columns of a dataset with several tables are disambiguated across the tables which a node level diff can't do
+		err = d.cache.Invalidate(strconv.Itoa(int(dataset.ID)))
+		if err != nil {
+			d.l.Error("error while invalidating the cached dataset", dataset.ID)
+		}
+		return err
+	}
+	err = d.cache.Patch(ctx, strconv.Itoa(int(dataset.ID)), diff)
+	if err != nil {
+		d.l.Error("error while patching the cached dataset", dataset.ID)
+	}
+	return err
 }
 
-func cacheClearCheck(in chan DatasetRequest) {
-	for {
-		time.Sleep(DatasetClearCheckInterval)
-		go SendDatasetToChannel(in, DatasetRequest{Type: DatasetRemove})
+//dimensionsChanged reports whether the dimension columns differ between the two versions of the columns of a dataset
+func dimensionsChanged(old, updated []models.Node) bool {
+	dimensions := func(cols []models.Node) map[uint]string {
+		result := map[uint]string{}
+		for _, c := range cols {
+			if cN := c.ColumnNode(); cN.Dimension {
+				result[c.ID] = cN.Name
+			}
+		}
+		return result
+	}
+	o, u := dimensions(old), dimensions(updated)
+	if len(o) != len(u) {
+		return true
+	}
+	for k, v := range o {
+		if n, ok := u[k]; !ok || n != v {
+			return true
+		}
 	}
+	return false
 }
 
-//SystemDICT returns the system dictionary available for all the users
+//SystemDICT returns the system dictionary of the default locale available for all the users
 func SystemDICT() interpreter.DICT {
-	d := map[string]interpreter.Token{
-		"is": {
-			Word:  []rune("is"),
-			Nodes: []interpreter.Node{&interpreter.OperatorNode{UID: "equal-is", Word: []rune("is"), Operation: interpreter.EqOperator}},
-		},
-		"not": {
-			Word:  []rune("not"),
-			Nodes: []interpreter.Node{&interpreter.OperatorNode{UID: "not-equal", Word: []rune("not"), Operation: interpreter.NotEqOperator}},
-		},
-		"<": {
-			Word:  []rune("<"),
-			Nodes: []interpreter.Node{&interpreter.OperatorNode{UID: "less-than", Word: []rune("<="), Operation: interpreter.LessOperator}},
-		},
-		">": {
-			Word:  []rune(">"),
-			Nodes: []interpreter.Node{&interpreter.OperatorNode{UID: "greater-than", Word: []rune(">="), Operation: interpreter.GreaterOperator}},
-		},
-		"less than": {
-			Word:  []rune("less than"),
-			Nodes: []interpreter.Node{&interpreter.OperatorNode{UID: "less-than", Word: []rune("<="), Operation: interpreter.LessOperator}},
-		},
-		"greater than": {
-			Word:  []rune("greater than"),
-			Nodes: []interpreter.Node{&interpreter.OperatorNode{UID: "greater-than", Word: []rune(">="), Operation: interpreter.GreaterOperator}},
-		},
-	}
-	return interpreter.DICT{Map: d}
+	return SystemDICTForLocale(DefaultLocale)
 }
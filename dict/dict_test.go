@@ -0,0 +1,192 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+	"github.com/google/uuid"
+)
+
+//benchmarkRoundTrip is the time taken by the fake aggregators for each call, standing in for a query to the database
+const benchmarkRoundTrip = time.Millisecond
+
+//roundTripAggregator is the fake aggregator taking a round trip to the database for each dataset
+type roundTripAggregator struct {
+	*fakeAggregator
+}
+
+func (r roundTripAggregator) GetDataset(ID string) (Dataset, error) {
+	time.Sleep(benchmarkRoundTrip)
+	return r.fakeAggregator.GetDataset(ID)
+}
+
+//batchAggregator is the fake batch aggregator taking a single round trip to the database for all the datasets
+type batchAggregator struct {
+	roundTripAggregator
+}
+
+func (b batchAggregator) GetDatasets(IDs []string) (map[string]Dataset, error) {
+	time.Sleep(benchmarkRoundTrip)
+	result := make(map[string]Dataset, len(IDs))
+	for _, ID := range IDs {
+		d, err := b.fakeAggregator.GetDataset(ID)
+		if err != nil {
+			return nil, err
+		}
+		result[ID] = d
+	}
+	return result, nil
+}
+
+//benchmarkGetMany benchmarks getting 200 datasets missing in the cache through the aggregator
+func benchmarkGetMany(b *testing.B, agg DatasetAggregator) {
+	IDs := make([]string, 200)
+	for i := range IDs {
+		IDs[i] = strconv.Itoa(i + 1)
+	}
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := startCache(agg, DefaultDatasetCacheConfig())
+		b.StartTimer()
+		datasets, err := c.GetMany(ctx, IDs, "")
+		b.StopTimer()
+		c.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(datasets) != len(IDs) {
+			b.Fatalf("expected %d datasets, got %d", len(IDs), len(datasets))
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkGetManyPerDataset(b *testing.B) {
+	benchmarkGetMany(b, roundTripAggregator{newFakeAggregator()})
+}
+
+func BenchmarkGetManyBatch(b *testing.B) {
+	benchmarkGetMany(b, batchAggregator{roundTripAggregator{newFakeAggregator()}})
+}
+
+//testNodes builds the nodes of a dataset along with their metadata for converting them into tokens
+type testNodes struct {
+	nodes     []models.Node
+	metadatas []models.NodeMetadata
+}
+
+//add adds a node with the uid, the type, the parent and the word and returns its uid
+func (t *testNodes) add(UID uuid.UUID, typ interpreter.Type, parent uuid.UUID, word string, metadatas ...models.NodeMetadata) uuid.UUID {
+	n := models.Node{UID: UID, Type: typ, PUID: parent}
+	n.ID = uint(len(t.nodes) + 1)
+	t.nodes = append(t.nodes, n)
+	metadatas = append(metadatas, models.NodeMetadata{Prop: models.NodeMetadataPropWord, Value: word}, models.NodeMetadata{Prop: models.NodeMetadataPropName, Value: word})
+	for _, m := range metadatas {
+		m.NodeID = n.ID
+		t.metadatas = append(t.metadatas, m)
+	}
+	return n.UID
+}
+
+//table adds a table node with the default date field
+func (t *testNodes) table(word string, dateField uuid.UUID) uuid.UUID {
+	return t.add(uuid.New(), interpreter.Table, uuid.Nil, word, models.NodeMetadata{Prop: models.NodeMetadataPropDefaultDateFieldUID, Value: dateField.String()})
+}
+
+func TestAddNodeTokensOfSeveralTables(t *testing.T) {
+	d := NewDAggWithCache(nil, nil, nil)
+	ordersDate, customersDate := uuid.New(), uuid.New()
+	nodes := &testNodes{}
+	orders := nodes.table("orders", ordersDate)
+	customers := nodes.table("customers", customersDate)
+	ordersID := nodes.add(uuid.New(), interpreter.Column, orders, "id")
+	customersID := nodes.add(uuid.New(), interpreter.Column, customers, "id")
+	nodes.add(uuid.New(), interpreter.Column, customers, "city")
+	nodes.add(ordersDate, interpreter.Column, orders, "date")
+	nodes.add(customersDate, interpreter.Column, customers, "joined on")
+	tokens := map[string]interpreter.Token{}
+	d.addNodeTokens(tokens, nodes.nodes, nodes.metadatas, nil)
+
+	//the columns are attached to their own tables
+	if n := len(tokens["id"].Nodes); n != 2 {
+		t.Fatalf("expected the id columns of both the tables, got %d nodes", n)
+	}
+	for _, n := range tokens["id"].Nodes {
+		c := n.(*interpreter.ColumnNode)
+		if c.PN == nil || c.PN.UID != c.PUID {
+			t.Errorf("expected the column %s to be attached to its own table, got %+v", c.UID, c.PN)
+		}
+	}
+
+	//the columns having the same word are disambiguated with the word of their table
+	for k, want := range map[string]uuid.UUID{"orders id": ordersID, "customers id": customersID} {
+		if ns := tokens[k].Nodes; len(ns) != 1 || NodeUID(ns[0]) != want.String() {
+			t.Errorf("expected %s to be the column of its table alone, got %+v", k, ns)
+		}
+	}
+	if _, ok := tokens["customers city"]; ok {
+		t.Error("expected the columns with a word unique across the tables not to be prefixed")
+	}
+
+	//each table keeps its own default date field and the date phrases are indexed for each of them
+	for k, want := range map[string]uuid.UUID{"orders": ordersDate, "customers": customersDate} {
+		table := tokens[k].Nodes[0].(*interpreter.TableNode)
+		if table.DefaultDateField == nil || table.DefaultDateField.UID != want.String() {
+			t.Errorf("expected the default date field of %s to be its own, got %+v", k, table.DefaultDateField)
+		}
+	}
+	fields := map[string]struct{}{}
+	for _, n := range tokens["today"].Nodes {
+		fields[n.(*interpreter.ValueNode).PUID] = struct{}{}
+	}
+	if _, ok := fields[ordersDate.String()]; !ok || len(fields) != 2 {
+		t.Errorf("expected the date phrases to be indexed for the date field of each table, got %v", fields)
+	}
+}
+
+func TestAddNodeTokensOfASingleTable(t *testing.T) {
+	d := NewDAggWithCache(nil, nil, nil)
+	nodes := &testNodes{}
+	sales := nodes.table("sales", uuid.Nil)
+	//the column doesn't refer to the table
+	nodes.add(uuid.New(), interpreter.Column, uuid.Nil, "region")
+	tokens := map[string]interpreter.Token{}
+	d.addNodeTokens(tokens, nodes.nodes, nodes.metadatas, nil)
+
+	c, ok := tokens["region"].Nodes[0].(*interpreter.ColumnNode)
+	if !ok || c.PUID != sales.String() || c.PN == nil {
+		t.Errorf("expected the column to be attached to the only table of the dataset, got %+v", tokens["region"].Nodes)
+	}
+	if _, ok := tokens["today"]; ok {
+		t.Error("expected no date phrases for a table without a default date field")
+	}
+}
+
+func TestAddNodeTokensIndexesTheSynonyms(t *testing.T) {
+	d := NewDAggWithCache(nil, nil, nil)
+	nodes := &testNodes{}
+	sales := nodes.table("sales", uuid.Nil)
+	revenue := nodes.add(uuid.New(), interpreter.Column, sales, "revenue",
+		models.NodeMetadata{Prop: models.NodeMetadataPropSynonym, Value: "Turnover"},
+		models.NodeMetadata{Prop: models.NodeMetadataPropSynonym, Value: "total sales"})
+	tokens := map[string]interpreter.Token{}
+	d.addNodeTokens(tokens, nodes.nodes, nodes.metadatas, nil)
+
+	//the synonyms map to the same node as the word of the column
+	column := tokens["revenue"].Nodes[0]
+	for _, k := range []string{"turnover", "total sales"} {
+		ns := tokens[k].Nodes
+		if len(ns) != 1 || ns[0] != column || NodeUID(ns[0]) != revenue.String() {
+			t.Errorf("expected %s to be indexed to the column, got %+v", k, ns)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the fuzzy index of a dictionary for typo tolerant token lookup
+ */
+
+//DefaultFuzzyMaxDistance is the default maximum edit distance for a word to be considered as a fuzzy match
+const DefaultFuzzyMaxDistance = 2
+
+//phoneticBoost is the share of the remaining confidence added to a match which sounds the same as the word looked up
+const phoneticBoost = 0.25
+
+//minPhoneticSimilarity is the minimum similarity required for a match found only through the phonetic key
+const minPhoneticSimilarity = 0.5
+
+//FuzzyMatch is a candidate token found by the fuzzy lookup
+type FuzzyMatch struct {
+	//Word is the word of the token in the dictionary
+	Word string
+	//Token is the matched token
+	Token interpreter.Token
+	//Distance is the edit distance between the looked up word and the token's word
+	Distance int
+	//Phonetic indicates that the looked up word and the token's word sound the same
+	Phonetic bool
+	//Score is the confidence of the match between 0 and 1
+	Score float64
+}
+
+//FuzzyIndex is the index of a dictionary's words by their length and phonetic keys for the fuzzy lookup.
+//It is read only once built and safe for concurrent use
+type FuzzyIndex struct {
+	//maxDistance is the maximum edit distance for a word to be considered as a match
+	maxDistance int
+	//tokens has the tokens of the dictionary
+	tokens map[string]interpreter.Token
+	//byLength has the words of the dictionary grouped by their length in runes
+	byLength map[int][]string
+	//byPhonetic has the words of the dictionary grouped by their phonetic key
+	byPhonetic map[string][]string
+}
+
+//NewFuzzyIndex builds the fuzzy index for the dictionary. Non positive maxDistance falls back to DefaultFuzzyMaxDistance
+func NewFuzzyIndex(d interpreter.DICT, maxDistance int) *FuzzyIndex {
+	if maxDistance <= 0 {
+		maxDistance = DefaultFuzzyMaxDistance
+	}
+	result := &FuzzyIndex{
+		maxDistance: maxDistance,
+		tokens:      d.Map,
+		byLength:    map[int][]string{},
+		byPhonetic:  map[string][]string{},
+	}
+	for k := range d.Map {
+		l := len([]rune(k))
+		result.byLength[l] = append(result.byLength[l], k)
+		if p := PhoneticKey(k); len(p) > 0 {
+			result.byPhonetic[p] = append(result.byPhonetic[p], k)
+		}
+	}
+	return result
+}
+
+//Patch returns a new fuzzy index with the diff applied on the tokens of the index. The index itself is not modified
+func (f *FuzzyIndex) Patch(diff NodeDiff) *FuzzyIndex {
+	return NewFuzzyIndex(interpreter.DICT{Map: ApplyDiff(f.tokens, diff)}, f.maxDistance)
+}
+
+//Lookup returns the candidate tokens for the word ordered by their score. At most limit candidates are
+//returned if limit is positive. An exact match is returned with score 1
+func (f *FuzzyIndex) Lookup(word string, limit int) []FuzzyMatch {
+	/*
+	 * We will find the candidates within the max edit distance among the words of similar length
+	 * Then we will add the words having the same phonetic key
+	 * Finally we will score them and sort
+	 */
+	word = strings.ToLower(strings.TrimSpace(word))
+	w := []rune(word)
+	if len(w) == 0 {
+		return []FuzzyMatch{}
+	}
+	phonetic := PhoneticKey(word)
+	candidates := map[string]FuzzyMatch{}
+
+	//finding the candidates by the edit distance
+	for l := len(w) - f.maxDistance; l <= len(w)+f.maxDistance; l++ {
+		for _, k := range f.byLength[l] {
+			d := EditDistance(w, []rune(k))
+			if d > f.maxDistance {
+				continue
+			}
+			candidates[k] = FuzzyMatch{Word: k, Distance: d}
+		}
+	}
+
+	//adding the candidates by the phonetic key
+	if len(phonetic) > 0 {
+		for _, k := range f.byPhonetic[phonetic] {
+			m, ok := candidates[k]
+			if !ok {
+				m = FuzzyMatch{Word: k, Distance: EditDistance(w, []rune(k))}
+			}
+			m.Phonetic = true
+			candidates[k] = m
+		}
+	}
+
+	//scoring the candidates
+	result := make([]FuzzyMatch, 0, len(candidates))
+	for k, m := range candidates {
+		m.Token = f.tokens[k]
+		m.Score = similarity(len(w), len([]rune(k)), m.Distance)
+		if m.Phonetic && m.Distance > f.maxDistance && m.Score < minPhoneticSimilarity {
+			continue
+		}
+		if m.Phonetic && m.Distance > 0 {
+			m.Score += (1 - m.Score) * phoneticBoost
+		}
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Word < result[j].Word
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+//similarity returns the similarity between two words of the given lengths and edit distance between 0 and 1
+func similarity(a, b, distance int) float64 {
+	max := a
+	if b > max {
+		max = b
+	}
+	if max == 0 {
+		return 1
+	}
+	return 1 - float64(distance)/float64(max)
+}
+
+//EditDistance returns the optimal string alignment distance between the two words. It is the levenshtein distance
+//where transposition of two adjacent runes is counted as a single edit
+func EditDistance(a, b []rune) int {
+	//we keep only the last three rows of the matrix
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = minInt(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func minInt(v ...int) int {
+	m := v[0]
+	for _, i := range v[1:] {
+		if i < m {
+			m = i
+		}
+	}
+	return m
+}
+
+//soundexCodes has the soundex digit for the consonants
+var soundexCodes = map[rune]byte{
+	'b': '1', 'f': '1', 'p': '1', 'v': '1',
+	'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+	'd': '3', 't': '3',
+	'l': '4',
+	'm': '5', 'n': '5',
+	'r': '6',
+}
+
+//PhoneticKey returns the phonetic key of the word. Words of multiple parts get the soundex code of
+//each part joined by space. Returns empty string if the word has no latin letters
+func PhoneticKey(word string) string {
+	parts := strings.FieldsFunc(strings.ToLower(word), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	keys := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if k := soundex(p); len(k) > 0 {
+			keys = append(keys, k)
+		}
+	}
+	return strings.Join(keys, " ")
+}
+
+//soundex returns the american soundex code of the word
+func soundex(word string) string {
+	code := make([]byte, 0, 4)
+	var last byte
+	for _, r := range word {
+		if r > unicode.MaxASCII || !unicode.IsLetter(r) {
+			continue
+		}
+		d, consonant := soundexCodes[r]
+		if len(code) == 0 {
+			code = append(code, byte(unicode.ToUpper(r)))
+			last = d
+			continue
+		}
+		if !consonant {
+			//h and w don't separate the consonants with the same code while the vowels do
+			if r != 'h' && r != 'w' {
+				last = 0
+			}
+			continue
+		}
+		if d != last {
+			code = append(code, d)
+			if len(code) == 4 {
+				break
+			}
+		}
+		last = d
+	}
+	if len(code) == 0 {
+		return ""
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+//fuzzyIndexes has the fuzzy indexes built for the dictionaries mapped to the dictionary id
+type fuzzyIndexes struct {
+	m       sync.RWMutex
+	indexes map[string]*FuzzyIndex
+	//built has the time at which the index of each dictionary was built
+	built map[string]time.Time
+}
+
+func (f *fuzzyIndexes) get(ID string) (*FuzzyIndex, bool) {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	i, ok := f.indexes[ID]
+	return i, ok
+}
+
+func (f *fuzzyIndexes) set(ID string, i *FuzzyIndex) {
+	f.m.Lock()
+	f.indexes[ID] = i
+	f.built[ID] = time.Now()
+	f.m.Unlock()
+}
+
+//remove removes the indexes of the dictionaries built before the given time.
+//The indexes built after it are of the dictionaries built again after they were dropped
+func (f *fuzzyIndexes) remove(before time.Time, IDs ...string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, ID := range IDs {
+		if t, ok := f.built[ID]; ok && t.Before(before) {
+			delete(f.indexes, ID)
+			delete(f.built, ID)
+		}
+	}
+}
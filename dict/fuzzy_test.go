@@ -0,0 +1,126 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+//eventually polls the condition till it holds or a few seconds pass
+func eventually(cond func() bool) bool {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
+//renameDiff returns the diff renaming the column of the fake aggregator's dataset
+func renameDiff(ID, word string) NodeDiff {
+	n := &interpreter.ColumnNode{UID: "column-" + ID, Word: []rune(word), Name: word}
+	return NodeDiff{Changed: []interpreter.Node{n}, Keys: map[string][]string{n.UID: {word}}}
+}
+
+func TestFuzzyIndexFollowsTheDICT(t *testing.T) {
+	c := startCache(newFakeAggregator(), DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	d := NewDAggWithCache(nil, nil, c)
+	d.EnableFuzzyIndex(0)
+
+	dataset, err := c.Get(ctx, "1", "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.fuzzy.set("user-1", NewFuzzyIndex(interpreter.DICT{Map: dataset.D}, 0))
+
+	//the index is removed along with the dictionary when the dataset is patched
+	if err := c.Patch(ctx, "1", renameDiff("1", "colour")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Suggest("user-1", "colour", 1); ok {
+		t.Fatal("expected the fuzzy index to be removed when the dataset is patched")
+	}
+
+	//and when the dataset is invalidated
+	d.fuzzy.set("user-1", NewFuzzyIndex(interpreter.DICT{Map: dataset.D}, 0))
+	if err := c.Invalidate("1"); err != nil {
+		t.Fatal(err)
+	}
+	dropped := eventually(func() bool {
+		_, ok := d.Suggest("user-1", "column 1", 1)
+		return !ok
+	})
+	if !dropped {
+		t.Error("expected the fuzzy index to be removed when the dictionary is dropped")
+	}
+	d.fuzzy.m.RLock()
+	defer d.fuzzy.m.RUnlock()
+	if len(d.fuzzy.indexes) != 0 || len(d.fuzzy.built) != 0 {
+		t.Errorf("expected no fuzzy indexes left, got %d", len(d.fuzzy.indexes))
+	}
+}
+
+func TestIndexesAreDroppedWithTheDICTs(t *testing.T) {
+	conf := DefaultDatasetCacheConfig()
+	conf.MaxEntries = 1
+	c := startCache(newFakeAggregator(), conf)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	d := NewDAggWithCache(nil, nil, c)
+	d.EnableFuzzyIndex(0)
+	d.EnablePhraseIndex()
+	build := func(ID, user string) {
+		dataset, err := c.Get(ctx, ID, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.fuzzy.set(user, NewFuzzyIndex(interpreter.DICT{Map: dataset.D}, 0))
+		d.phrases.sync(user, interpreter.DICT{Map: dataset.D}, d.normaliser)
+	}
+	built := func(user string) (bool, bool) {
+		_, fuzzy := d.fuzzy.get(user)
+		_, phrases := d.Phrases(user)
+		return fuzzy, phrases
+	}
+
+	//a failed update drops the dictionaries without an updated event
+	build("1", "user-1")
+	c.SetAggregator(failingAggregator{})
+	if _, err := c.Update(ctx, "1"); err == nil {
+		t.Fatal("expected the update to fail")
+	}
+	if fuzzy, phrases := built("user-1"); fuzzy || phrases {
+		t.Errorf("expected the indexes to be dropped along with the dictionary on a failed update, got %v and %v", fuzzy, phrases)
+	}
+
+	//evicting the dataset drops the dictionaries
+	c.SetAggregator(newFakeAggregator())
+	build("1", "user-1")
+	if _, err := c.Get(ctx, "2", "user-2"); err != nil {
+		t.Fatal(err)
+	}
+	if fuzzy, phrases := built("user-1"); fuzzy || phrases {
+		t.Errorf("expected the indexes to be dropped along with the dictionary on eviction, got %v and %v", fuzzy, phrases)
+	}
+
+	//the indexes are left as such once the aggregator is closed
+	d.Close()
+	build("2", "user-2")
+	if err := c.Patch(ctx, "2", renameDiff("2", "colour")); err != nil {
+		t.Fatal(err)
+	}
+	if fuzzy, phrases := built("user-2"); !fuzzy || !phrases {
+		t.Errorf("expected the indexes not to be synced after closing the aggregator, got %v and %v", fuzzy, phrases)
+	}
+}
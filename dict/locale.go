@@ -0,0 +1,261 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the system dictionaries registered for each locale
+ */
+
+const (
+	//LocaleEnglish is the locale for english
+	LocaleEnglish = "en"
+	//LocaleSpanish is the locale for spanish
+	LocaleSpanish = "es"
+	//LocaleGerman is the locale for german
+	LocaleGerman = "de"
+)
+
+//DefaultLocale is the locale used when no locale is given or the given locale has no system dictionary
+const DefaultLocale = LocaleEnglish
+
+//systemDICTs has the system dictionaries registered for each locale
+var systemDICTs = struct {
+	m     sync.RWMutex
+	dicts map[string]interpreter.DICT
+}{dicts: map[string]interpreter.DICT{}}
+
+//RegisterSystemDICT registers the system dictionary for the locale. Registering a dictionary for a locale
+//already registered replaces it
+func RegisterSystemDICT(locale string, d interpreter.DICT) {
+	systemDICTs.m.Lock()
+	systemDICTs.dicts[NormaliseLocale(locale)] = d
+	systemDICTs.m.Unlock()
+}
+
+//unregisterSystemDICT removes the system dictionary registered for the locale
+func unregisterSystemDICT(locale string) {
+	systemDICTs.m.Lock()
+	delete(systemDICTs.dicts, NormaliseLocale(locale))
+	systemDICTs.m.Unlock()
+}
+
+//SystemLocales returns the locales having a system dictionary registered
+func SystemLocales() []string {
+	systemDICTs.m.RLock()
+	defer systemDICTs.m.RUnlock()
+	result := make([]string, 0, len(systemDICTs.dicts))
+	for k := range systemDICTs.dicts {
+		result = append(result, k)
+	}
+	return result
+}
+
+//SystemDICTForLocale returns the system dictionary of the locale. If the locale has no dictionary registered,
+//the dictionary of its language is returned. eg:- "es" for "es-MX". Otherwise the dictionary of the default locale is returned
+func SystemDICTForLocale(locale string) interpreter.DICT {
+	systemDICTs.m.RLock()
+	defer systemDICTs.m.RUnlock()
+	locale = NormaliseLocale(locale)
+	d, ok := systemDICTs.dicts[locale]
+	if !ok {
+		d, ok = systemDICTs.dicts[strings.SplitN(locale, "-", 2)[0]]
+	}
+	if !ok {
+		d = systemDICTs.dicts[DefaultLocale]
+	}
+	//the map is copied so that the callers can't modify the registered dictionary
+	result := interpreter.DICT{Map: make(map[string]interpreter.Token, len(d.Map))}
+	for k, v := range d.Map {
+		result.Map[k] = v
+	}
+	return result
+}
+
+//NormaliseLocale normalises the locale to lower case language tag separated by hyphen. eg:- "es_MX" becomes "es-mx"
+func NormaliseLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+//localeSeparator separates the id of a dictionary from its locale in the id of a locale dictionary
+const localeSeparator = "@"
+
+//LocaleDICTID returns the id of the user's dictionary in the given locale. It is to be used as the id of the dictionary
+//in the interpreter when a user is served in several locales, so that the dictionaries of the locales don't replace each other.
+//It can be passed to DAgg.Get, DAgg.GetWithContext and DAgg.GetScoped in place of the user id
+func LocaleDICTID(ID, locale string) string {
+	return ID + localeSeparator + NormaliseLocale(locale)
+}
+
+//ParseLocaleDICTID returns the user id and the locale from the id of a locale dictionary.
+//Returns false if the id is not of a locale dictionary
+func ParseLocaleDICTID(key string) (string, string, bool) {
+	i := strings.LastIndex(key, localeSeparator)
+	if i <= 0 || i == len(key)-len(localeSeparator) {
+		return "", "", false
+	}
+	return key[:i], key[i+len(localeSeparator):], true
+}
+
+//userLocale returns the user id of the dictionary id along with the context in which the dictionary is to be built.
+//The locale of a locale dictionary id is set in the context
+func userLocale(ctx context.Context, ID string) (string, context.Context) {
+	if u, l, ok := ParseLocaleDICTID(ID); ok {
+		return u, WithLocale(ctx, l)
+	}
+	return ID, ctx
+}
+
+//dictUser returns the user id of a user dictionary id, a scoped dictionary id or a locale dictionary id
+func dictUser(key string) string {
+	if u, _, ok := ParseScopedDICTID(key); ok {
+		key = u
+	}
+	if u, _, ok := ParseLocaleDICTID(key); ok {
+		key = u
+	}
+	return key
+}
+
+//localeKey is the key of the locale in the context
+type localeKey struct{}
+
+//WithLocale returns a context carrying the locale. DAgg.GetWithContext builds the dictionary with the
+//system dictionary of the locale in the context. Since the interpreter stores the dictionary with the id it is
+//requested for, the locale applies to that id alone. Use LocaleDICTID to serve a user in several locales
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeKey{}, locale)
+}
+
+//LocaleFromContext returns the locale in the context
+func LocaleFromContext(ctx context.Context) (string, bool) {
+	l, ok := ctx.Value(localeKey{}).(string)
+	return l, ok && len(l) > 0
+}
+
+//LocaleResolver resolves the locale of a user. It returns false if the user has no locale set
+type LocaleResolver func(userID string) (string, bool)
+
+//SystemDICTEntry is an entry of a system dictionary. Each of its words is mapped to the same operator node
+type SystemDICTEntry struct {
+	//UID is the unique id of the operator node
+	UID string `json:"uid" yaml:"uid"`
+	//Operator is the operator of the node. It has to be one of the NodeMetadataPropValue*Operator values
+	Operator string `json:"operator" yaml:"operator"`
+	//Words are the words mapped to the operator node
+	Words []string `json:"words" yaml:"words"`
+	//NodeWord is the word of the operator node. If empty, the word of the token is used
+	NodeWord string `json:"node_word,omitempty" yaml:"node_word,omitempty"`
+}
+
+//NewSystemDICT returns the system dictionary having the entries. The entries are validated and the words of the
+//later entries override the earlier ones
+func NewSystemDICT(entries []SystemDICTEntry) (interpreter.DICT, error) {
+	result := interpreter.DICT{Map: map[string]interpreter.Token{}}
+	err := addSystemDICTEntries(result.Map, entries)
+	return result, err
+}
+
+//addSystemDICTEntries validates the entries and adds them to the tokens of a system dictionary
+func addSystemDICTEntries(tokens map[string]interpreter.Token, entries []SystemDICTEntry) error {
+	for i, e := range entries {
+		operation, ok := models.NodeMetadataOperators[e.Operator]
+		if !ok {
+			return fmt.Errorf("invalid operator %q for the entry %d of the system dictionary", e.Operator, i)
+		}
+		if len(strings.TrimSpace(e.UID)) == 0 {
+			return fmt.Errorf("uid is missing for the entry %d of the system dictionary", i)
+		}
+		if len(e.Words) == 0 {
+			return fmt.Errorf("words are missing for the entry %d of the system dictionary", i)
+		}
+		for _, w := range e.Words {
+			k := strings.ToLower(strings.TrimSpace(w))
+			if len(k) == 0 {
+				return fmt.Errorf("empty word in the entry %d of the system dictionary", i)
+			}
+			nodeWord := e.NodeWord
+			if len(nodeWord) == 0 {
+				nodeWord = k
+			}
+			tokens[k] = interpreter.Token{
+				Word:  []rune(k),
+				Nodes: []interpreter.Node{&interpreter.OperatorNode{UID: e.UID, Word: []rune(nodeWord), Operation: operation}},
+			}
+		}
+	}
+	return nil
+}
+
+//builtinSystemDICTEntries has the entries of the system dictionaries shipped with the platform for each locale
+var builtinSystemDICTEntries = map[string][]SystemDICTEntry{
+	LocaleEnglish: {
+		{UID: "equal-is", Operator: models.NodeMetadataPropValueEqOperator, Words: []string{"is"}},
+		{UID: "not-equal", Operator: models.NodeMetadataPropValueNotEqOperator, Words: []string{"not"}},
+		{UID: "less-than", Operator: models.NodeMetadataPropValueLessOperator, Words: []string{"<", "less than"}, NodeWord: "<="},
+		{UID: "greater-than", Operator: models.NodeMetadataPropValueGreaterOperator, Words: []string{">", "greater than"}, NodeWord: ">="},
+		{UID: "equals", Operator: models.NodeMetadataPropValueEqOperator, Words: []string{"equals", "equal to"}, NodeWord: "="},
+		{UID: "not-equal-to", Operator: models.NodeMetadataPropValueNotEqOperator, Words: []string{"not equal to", "not equals"}, NodeWord: "<>"},
+		{UID: "at-least", Operator: models.NodeMetadataPropValueGreaterOperator, Words: []string{"at least"}, NodeWord: ">="},
+		{UID: "at-most", Operator: models.NodeMetadataPropValueLessOperator, Words: []string{"at most"}, NodeWord: "<="},
+		{UID: "contains", Operator: models.NodeMetadataPropValueContainsOperator, Words: []string{"contains"}},
+		{UID: "starts-with", Operator: models.NodeMetadataPropValuePrefixOperator, Words: []string{"starts with", "begins with"}},
+	},
+	LocaleSpanish: {
+		{UID: "equal-es", Operator: models.NodeMetadataPropValueEqOperator, Words: []string{"es"}},
+		{UID: "not-equal", Operator: models.NodeMetadataPropValueNotEqOperator, Words: []string{"no"}},
+		{UID: "less-than", Operator: models.NodeMetadataPropValueLessOperator, Words: []string{"<", "menor que"}, NodeWord: "<="},
+		{UID: "greater-than", Operator: models.NodeMetadataPropValueGreaterOperator, Words: []string{">", "mayor que"}, NodeWord: ">="},
+		{UID: "equals", Operator: models.NodeMetadataPropValueEqOperator, Words: []string{"igual a"}, NodeWord: "="},
+		{UID: "not-equal-to", Operator: models.NodeMetadataPropValueNotEqOperator, Words: []string{"no igual a", "distinto de"}, NodeWord: "<>"},
+		{UID: "at-least", Operator: models.NodeMetadataPropValueGreaterOperator, Words: []string{"al menos"}, NodeWord: ">="},
+		{UID: "at-most", Operator: models.NodeMetadataPropValueLessOperator, Words: []string{"como máximo", "a lo sumo"}, NodeWord: "<="},
+		{UID: "contains", Operator: models.NodeMetadataPropValueContainsOperator, Words: []string{"contiene"}},
+		{UID: "starts-with", Operator: models.NodeMetadataPropValuePrefixOperator, Words: []string{"empieza con", "comienza con"}},
+	},
+	LocaleGerman: {
+		{UID: "equal-ist", Operator: models.NodeMetadataPropValueEqOperator, Words: []string{"ist"}},
+		{UID: "not-equal", Operator: models.NodeMetadataPropValueNotEqOperator, Words: []string{"nicht"}},
+		{UID: "less-than", Operator: models.NodeMetadataPropValueLessOperator, Words: []string{"<", "kleiner als"}, NodeWord: "<="},
+		{UID: "greater-than", Operator: models.NodeMetadataPropValueGreaterOperator, Words: []string{">", "größer als"}, NodeWord: ">="},
+		{UID: "equals", Operator: models.NodeMetadataPropValueEqOperator, Words: []string{"gleich"}, NodeWord: "="},
+		{UID: "not-equal-to", Operator: models.NodeMetadataPropValueNotEqOperator, Words: []string{"ungleich", "nicht gleich"}, NodeWord: "<>"},
+		{UID: "at-least", Operator: models.NodeMetadataPropValueGreaterOperator, Words: []string{"mindestens"}, NodeWord: ">="},
+		{UID: "at-most", Operator: models.NodeMetadataPropValueLessOperator, Words: []string{"höchstens"}, NodeWord: "<="},
+		{UID: "contains", Operator: models.NodeMetadataPropValueContainsOperator, Words: []string{"enthält"}},
+		{UID: "starts-with", Operator: models.NodeMetadataPropValuePrefixOperator, Words: []string{"beginnt mit", "fängt an mit"}},
+	},
+}
+
+//builtinSystemDICT returns the system dictionary shipped with the platform for the locale.
+//Returns false if the platform doesn't ship a dictionary for the locale
+func builtinSystemDICT(locale string) (interpreter.DICT, bool) {
+	entries, ok := builtinSystemDICTEntries[locale]
+	if !ok {
+		return interpreter.DICT{Map: map[string]interpreter.Token{}}, false
+	}
+	d, err := NewSystemDICT(entries)
+	if err != nil {
+		//the built-in entries are always valid
+		panic(err)
+	}
+	return d, true
+}
+
+func init() {
+	for k := range builtinSystemDICTEntries {
+		d, _ := builtinSystemDICT(k)
+		RegisterSystemDICT(k, d)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+func TestLocaleDICTID(t *testing.T) {
+	key := LocaleDICTID("7", "es_MX")
+	if key != "7@es-mx" {
+		t.Fatalf("expected 7@es-mx, got %s", key)
+	}
+	ID, locale, ok := ParseLocaleDICTID(key)
+	if !ok || ID != "7" || locale != "es-mx" {
+		t.Errorf("expected 7 and es-mx, got %s and %s", ID, locale)
+	}
+	for _, k := range []string{"7", "@es", "7@", "team:1"} {
+		if _, _, ok := ParseLocaleDICTID(k); ok {
+			t.Errorf("expected %s not to be a locale dictionary id", k)
+		}
+	}
+
+	//the locale of the id is used for building the dictionary
+	ID, ctx := userLocale(context.Background(), key)
+	if l, ok := LocaleFromContext(ctx); !ok || ID != "7" || l != "es-mx" {
+		t.Errorf("expected the user 7 in es-mx, got %s in %s", ID, l)
+	}
+	d := NewDAggWithCache(nil, nil, nil)
+	if l := d.Locale(ctx, ID); l != "es-mx" {
+		t.Errorf("expected the locale of the id to be preferred, got %s", l)
+	}
+}
+
+func TestDICTUser(t *testing.T) {
+	cases := map[string]string{
+		"7":                             "7",
+		LocaleDICTID("7", "de"):         "7",
+		ScopedDICTID("7", []uint{3, 1}): "7",
+		ScopedDICTID(LocaleDICTID("7", "de"), []uint{1}): "7",
+	}
+	for k, expected := range cases {
+		if u := dictUser(k); u != expected {
+			t.Errorf("%s: expected the user %s, got %s", k, expected, u)
+		}
+	}
+}
+
+func TestOperatorVocabulary(t *testing.T) {
+	cases := map[string]map[string]string{
+		LocaleEnglish: {
+			"greater than": interpreter.GreaterOperator,
+			"less than":    interpreter.LessOperator,
+			">":            interpreter.GreaterOperator,
+			"<":            interpreter.LessOperator,
+			"at least":     interpreter.GreaterOperator,
+			"at most":      interpreter.LessOperator,
+			"equal to":     interpreter.EqOperator,
+			"not equal to": interpreter.NotEqOperator,
+			"contains":     interpreter.ContainsOperator,
+			"starts with":  models.PrefixOperator,
+			"begins with":  models.PrefixOperator,
+		},
+		LocaleSpanish: {
+			"mayor que":   interpreter.GreaterOperator,
+			"menor que":   interpreter.LessOperator,
+			"al menos":    interpreter.GreaterOperator,
+			"empieza con": models.PrefixOperator,
+		},
+		LocaleGerman: {
+			"größer als":  interpreter.GreaterOperator,
+			"kleiner als": interpreter.LessOperator,
+			"höchstens":   interpreter.LessOperator,
+			"beginnt mit": models.PrefixOperator,
+		},
+	}
+	for locale, words := range cases {
+		d := SystemDICTForLocale(locale)
+		for w, operation := range words {
+			tok, ok := d.Map[w]
+			if !ok || len(tok.Nodes) == 0 {
+				t.Errorf("%s: expected the word %q in the system dictionary", locale, w)
+				continue
+			}
+			o, ok := tok.Nodes[0].(*interpreter.OperatorNode)
+			if !ok || o.Operation != operation {
+				t.Errorf("%s: expected %q to be the operation %s, got %#v", locale, w, operation, tok.Nodes[0])
+			}
+		}
+	}
+}
+
+func TestSystemDICTForLocale(t *testing.T) {
+	//the locale falls back to its language and then to the default locale
+	cases := map[string]string{
+		"es_MX": "contiene",
+		"DE":    "enthält",
+		"fr-ca": "contains",
+		"":      "contains",
+	}
+	for locale, word := range cases {
+		if _, ok := SystemDICTForLocale(locale).Map[word]; !ok {
+			t.Errorf("%q: expected the word %q in the system dictionary", locale, word)
+		}
+	}
+
+	//a registered dictionary is served for its locale and can't be modified by the callers
+	RegisterSystemDICT("fr_CA", interpreter.DICT{Map: map[string]interpreter.Token{"contient": {Word: []rune("contient")}}})
+	defer unregisterSystemDICT("fr-ca")
+	d := SystemDICTForLocale("fr-CA")
+	if _, ok := d.Map["contient"]; !ok {
+		t.Fatal("expected the registered system dictionary of the locale")
+	}
+	delete(d.Map, "contient")
+	if _, ok := SystemDICTForLocale("fr-ca").Map["contient"]; !ok {
+		t.Error("expected the registered system dictionary not to change with the returned one")
+	}
+	if _, ok := SystemDICTForLocale("fr").Map["contient"]; ok {
+		t.Error("expected the dictionary of a region not to be served for its language")
+	}
+}
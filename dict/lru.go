@@ -0,0 +1,247 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"container/list"
+	"time"
+	"unsafe"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the size bounded lru store used by the dataset cache
+ */
+
+//lruEntry is an entry in the lru store
+type lruEntry struct {
+	id      string
+	dataset Dataset
+	size    int64
+}
+
+//lruStore stores the datasets with least recently used eviction.
+//It is not safe for concurrent use and is to be owned by the cache go routine.
+type lruStore struct {
+	//maxEntries is the maximum no. of datasets to be kept. Zero means no limit
+	maxEntries int
+	//maxBytes is the maximum estimated size of the datasets to be kept. Zero means no limit
+	maxBytes int64
+	//bytes is the current estimated size of the datasets in the store
+	bytes int64
+	//ll has the entries with the most recently used at the front
+	ll *list.List
+	//items maps the dataset id to its element in ll
+	items map[string]*list.Element
+	//pinned has the no. of pins of the datasets which mustn't be evicted
+	pinned map[string]int
+}
+
+//newLRUStore returns a new lru store with the given limits
+func newLRUStore(maxEntries int, maxBytes int64) *lruStore {
+	return &lruStore{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+		pinned:     map[string]int{},
+	}
+}
+
+//get returns the dataset with the given id and marks it as recently used
+func (l *lruStore) get(id string) (Dataset, bool) {
+	e, ok := l.items[id]
+	if !ok {
+		return Dataset{}, false
+	}
+	l.ll.MoveToFront(e)
+	en := e.Value.(*lruEntry)
+	en.dataset.LastUsed = time.Now()
+	return en.dataset, true
+}
+
+//peek returns the dataset with the given id without marking it as recently used
+func (l *lruStore) peek(id string) (Dataset, bool) {
+	e, ok := l.items[id]
+	if !ok {
+		return Dataset{}, false
+	}
+	return e.Value.(*lruEntry).dataset, true
+}
+
+//add adds the dataset to the store and returns the ids of the datasets evicted to make room for it
+func (l *lruStore) add(id string, d Dataset) []string {
+	size := EstimateDatasetSize(d)
+	if e, ok := l.items[id]; ok {
+		en := e.Value.(*lruEntry)
+		l.bytes += size - en.size
+		en.dataset = d
+		en.size = size
+		l.ll.MoveToFront(e)
+	} else {
+		l.items[id] = l.ll.PushFront(&lruEntry{id: id, dataset: d, size: size})
+		l.bytes += size
+	}
+	return l.evict(id)
+}
+
+//remove removes the dataset with the given id from the store
+func (l *lruStore) remove(id string) bool {
+	e, ok := l.items[id]
+	if !ok {
+		return false
+	}
+	l.removeElement(e)
+	return true
+}
+
+//expire removes the datasets which weren't used after the given time and returns their ids
+func (l *lruStore) expire(before time.Time) []string {
+	removed := []string{}
+	for e := l.ll.Back(); e != nil; {
+		prev := e.Prev()
+		en := e.Value.(*lruEntry)
+		if en.dataset.LastUsed.Before(before) {
+			l.removeElement(e)
+			removed = append(removed, en.id)
+		}
+		e = prev
+	}
+	return removed
+}
+
+//all returns all the datasets in the store mapped to their ids
+func (l *lruStore) all() map[string]Dataset {
+	result := make(map[string]Dataset, len(l.items))
+	for k, e := range l.items {
+		result[k] = e.Value.(*lruEntry).dataset
+	}
+	return result
+}
+
+//pin keeps the dataset with the given id from being evicted till it is unpinned as many times
+func (l *lruStore) pin(id string) {
+	l.pinned[id]++
+}
+
+//unpin removes a pin of the dataset with the given id
+func (l *lruStore) unpin(id string) {
+	if l.pinned[id] <= 1 {
+		delete(l.pinned, id)
+		return
+	}
+	l.pinned[id]--
+}
+
+//len returns the no. of datasets in the store
+func (l *lruStore) len() int {
+	return l.ll.Len()
+}
+
+//evict evicts the least recently used datasets till the store is within its limits.
+//The dataset with the id keep and the pinned datasets won't be evicted, so the store may stay over its limits
+func (l *lruStore) evict(keep string) []string {
+	evicted := []string{}
+	for e := l.ll.Back(); e != nil && l.overLimit(); {
+		prev := e.Prev()
+		en := e.Value.(*lruEntry)
+		if en.id != keep && l.pinned[en.id] == 0 {
+			l.removeElement(e)
+			evicted = append(evicted, en.id)
+		}
+		e = prev
+	}
+	return evicted
+}
+
+//overLimit returns true if the store has exceeded any of its limits
+func (l *lruStore) overLimit() bool {
+	if l.maxEntries > 0 && l.ll.Len() > l.maxEntries {
+		return true
+	}
+	return l.maxBytes > 0 && l.bytes > l.maxBytes
+}
+
+//removeElement removes the element from the store
+func (l *lruStore) removeElement(e *list.Element) {
+	en := e.Value.(*lruEntry)
+	l.ll.Remove(e)
+	delete(l.items, en.id)
+	l.bytes -= en.size
+}
+
+const (
+	//sizeOfRune is the size of a rune in bytes
+	sizeOfRune = int64(unsafe.Sizeof(rune(0)))
+	//sizeOfString is the size of a string header in bytes
+	sizeOfString = int64(unsafe.Sizeof(""))
+	//sizeOfSlice is the size of a slice header in bytes
+	sizeOfSlice = int64(unsafe.Sizeof([]rune{}))
+	//sizeOfInterface is the size of an interface value in bytes
+	sizeOfInterface = int64(unsafe.Sizeof(interpreter.Node(nil)))
+	//sizeOfMapEntry is the approximate overhead of a map entry in bytes
+	sizeOfMapEntry = 48
+)
+
+//EstimateDatasetSize returns the approximate memory in bytes held by the tokens of the dataset
+func EstimateDatasetSize(d Dataset) int64 {
+	var size int64
+	for k, t := range d.D {
+		size += sizeOfMapEntry + sizeOfString + int64(len(k))
+		size += EstimateTokenSize(t)
+	}
+	return size
+}
+
+//EstimateTokenSize returns the approximate memory in bytes held by the token
+func EstimateTokenSize(t interpreter.Token) int64 {
+	size := sizeOfSlice*2 + int64(len(t.Word))*sizeOfRune
+	for _, n := range t.Nodes {
+		size += sizeOfInterface + estimateNodeSize(n)
+	}
+	return size
+}
+
+//estimateNodeSize returns the approximate memory in bytes held by an interpreter node
+func estimateNodeSize(n interpreter.Node) int64 {
+	switch v := n.(type) {
+	case *interpreter.ColumnNode:
+		return estimateColumnSize(*v)
+	case *interpreter.TableNode:
+		size := int64(unsafe.Sizeof(*v)) + int64(len(v.Word))*sizeOfRune +
+			int64(len(v.UID)+len(v.PUID)+len(v.Name)+len(v.DefaultDateFieldUID)+len(v.Description))
+		for _, c := range v.Children {
+			size += estimateColumnSize(c)
+		}
+		if v.DefaultDateField != nil {
+			size += estimateColumnSize(*v.DefaultDateField)
+		}
+		return size
+	case *interpreter.KnowledgeBaseNode:
+		size := int64(unsafe.Sizeof(*v)) + int64(len(v.Word))*sizeOfRune +
+			int64(len(v.UID)+len(v.Name)+len(v.Description))
+		for _, c := range v.Children {
+			size += sizeOfInterface + estimateNodeSize(c)
+		}
+		return size
+	case *interpreter.OperatorNode:
+		return int64(unsafe.Sizeof(*v)) + int64(len(v.Word))*sizeOfRune + int64(len(v.UID)+len(v.PUID)+len(v.Operation))
+	case *interpreter.ValueNode:
+		return int64(unsafe.Sizeof(*v)) + int64(len(v.Word))*sizeOfRune + int64(len(v.UID)+len(v.PUID)+len(v.Name))
+	default:
+		return sizeOfInterface + int64(len(n.TokenWord()))*sizeOfRune
+	}
+}
+
+//estimateColumnSize returns the approximate memory in bytes held by a column node
+func estimateColumnSize(c interpreter.ColumnNode) int64 {
+	size := int64(unsafe.Sizeof(c)) + int64(len(c.Word))*sizeOfRune +
+		int64(len(c.UID)+len(c.PUID)+len(c.Name)+len(c.AggregationFn)+len(c.DataType)+len(c.Description)+len(c.DateFormat))
+	for _, v := range c.Children {
+		size += int64(unsafe.Sizeof(v)) + int64(len(v.TokenWord()))*sizeOfRune
+	}
+	return size
+}
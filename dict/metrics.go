@@ -0,0 +1,218 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * This file contains the metrics of the dataset cache and their exposition in the prometheus text format
+ */
+
+//EvictionReason is the reason for which a dataset was evicted from the cache
+type EvictionReason string
+
+const (
+	//EvictionLRU is the reason when a dataset is evicted to keep the cache within its size limits
+	EvictionLRU EvictionReason = "lru"
+	//EvictionExpired is the reason when a dataset is evicted since it wasn't used within the ttl
+	EvictionExpired EvictionReason = "expired"
+)
+
+//LoadLatencyBuckets are the upper bounds in seconds of the buckets of the dataset load latency histogram
+var LoadLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+//CacheMetrics has the metrics of a dataset cache. It is safe for concurrent use
+type CacheMetrics struct {
+	//counters are kept at the start of the struct for the 64 bit alignment required by the atomic operations
+	hits         uint64
+	misses       uint64
+	aggErrors    uint64
+	lruEvictions uint64
+	expirations  uint64
+
+	m sync.Mutex
+	//loadBuckets has the no. of loads in each of LoadLatencyBuckets. It isn't cumulative
+	loadBuckets []uint64
+	loadCount   uint64
+	loadSum     float64
+	//cached is the no. of datasets in the cache
+	cached int
+	//cachedBytes is the estimated memory held by the datasets in the cache
+	cachedBytes int64
+	//subscribers has the no. of subscribers for each dataset
+	subscribers map[string]int
+}
+
+//newCacheMetrics returns new metrics for a dataset cache
+func newCacheMetrics() *CacheMetrics {
+	return &CacheMetrics{
+		loadBuckets: make([]uint64, len(LoadLatencyBuckets)),
+		subscribers: map[string]int{},
+	}
+}
+
+//Hits returns the no. of get requests served from the cache
+func (c *CacheMetrics) Hits() uint64 {
+	return atomic.LoadUint64(&c.hits)
+}
+
+//Misses returns the no. of get requests which had to load the dataset
+func (c *CacheMetrics) Misses() uint64 {
+	return atomic.LoadUint64(&c.misses)
+}
+
+//AggregatorErrors returns the no. of times the aggregator failed to load a dataset
+func (c *CacheMetrics) AggregatorErrors() uint64 {
+	return atomic.LoadUint64(&c.aggErrors)
+}
+
+//Evictions returns the no. of datasets evicted from the cache for the given reason
+func (c *CacheMetrics) Evictions(reason EvictionReason) uint64 {
+	if reason == EvictionExpired {
+		return atomic.LoadUint64(&c.expirations)
+	}
+	return atomic.LoadUint64(&c.lruEvictions)
+}
+
+//CachedDatasets returns the no. of datasets in the cache
+func (c *CacheMetrics) CachedDatasets() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cached
+}
+
+//Subscribers returns the no. of subscribers of the given dataset
+func (c *CacheMetrics) Subscribers(datasetID string) int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.subscribers[datasetID]
+}
+
+func (c *CacheMetrics) hit() {
+	atomic.AddUint64(&c.hits, 1)
+}
+
+func (c *CacheMetrics) miss() {
+	atomic.AddUint64(&c.misses, 1)
+}
+
+func (c *CacheMetrics) aggregatorError() {
+	atomic.AddUint64(&c.aggErrors, 1)
+}
+
+func (c *CacheMetrics) evicted(reason EvictionReason, n int) {
+	if reason == EvictionExpired {
+		atomic.AddUint64(&c.expirations, uint64(n))
+		return
+	}
+	atomic.AddUint64(&c.lruEvictions, uint64(n))
+}
+
+//observeLoad records the latency of a dataset load
+func (c *CacheMetrics) observeLoad(d time.Duration) {
+	s := d.Seconds()
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.loadCount++
+	c.loadSum += s
+	for i, b := range LoadLatencyBuckets {
+		if s <= b {
+			c.loadBuckets[i]++
+			break
+		}
+	}
+}
+
+//setCached records the no. of datasets and their estimated size in the cache
+func (c *CacheMetrics) setCached(n int, bytes int64) {
+	c.m.Lock()
+	c.cached = n
+	c.cachedBytes = bytes
+	c.m.Unlock()
+}
+
+//setSubscribers records the no. of subscribers of a dataset. Zero removes the dataset from the metrics
+func (c *CacheMetrics) setSubscribers(datasetID string, n int) {
+	c.m.Lock()
+	if n == 0 {
+		delete(c.subscribers, datasetID)
+	} else {
+		c.subscribers[datasetID] = n
+	}
+	c.m.Unlock()
+}
+
+//ServeHTTP writes the metrics in the prometheus text exposition format
+func (c *CacheMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	c.WritePrometheus(bw)
+	bw.Flush()
+}
+
+//WritePrometheus writes the metrics in the prometheus text exposition format to the given writer
+func (c *CacheMetrics) WritePrometheus(w io.Writer) {
+	/*
+	 * We will write the counters
+	 * Then we will take a snapshot of the histogram and gauges and write them
+	 */
+	writeMetric(w, "brain_dataset_cache_hits_total", "counter", "No. of dataset get requests served from the cache.")
+	fmt.Fprintf(w, "brain_dataset_cache_hits_total %d\n", c.Hits())
+	writeMetric(w, "brain_dataset_cache_misses_total", "counter", "No. of dataset get requests which had to load the dataset.")
+	fmt.Fprintf(w, "brain_dataset_cache_misses_total %d\n", c.Misses())
+	writeMetric(w, "brain_dataset_cache_aggregator_errors_total", "counter", "No. of dataset loads failed in the aggregator.")
+	fmt.Fprintf(w, "brain_dataset_cache_aggregator_errors_total %d\n", c.AggregatorErrors())
+	writeMetric(w, "brain_dataset_cache_evictions_total", "counter", "No. of datasets evicted from the cache.")
+	fmt.Fprintf(w, "brain_dataset_cache_evictions_total{reason=%q} %d\n", EvictionLRU, c.Evictions(EvictionLRU))
+	fmt.Fprintf(w, "brain_dataset_cache_evictions_total{reason=%q} %d\n", EvictionExpired, c.Evictions(EvictionExpired))
+
+	//taking the snapshot
+	c.m.Lock()
+	buckets := make([]uint64, len(c.loadBuckets))
+	copy(buckets, c.loadBuckets)
+	count, sum := c.loadCount, c.loadSum
+	cached, cachedBytes := c.cached, c.cachedBytes
+	ids := make([]string, 0, len(c.subscribers))
+	subscribers := make(map[string]int, len(c.subscribers))
+	for k, v := range c.subscribers {
+		ids = append(ids, k)
+		subscribers[k] = v
+	}
+	c.m.Unlock()
+	sort.Strings(ids)
+
+	writeMetric(w, "brain_dataset_cache_load_duration_seconds", "histogram", "Latency of the dataset loads from the aggregator.")
+	var cumulative uint64
+	for i, b := range LoadLatencyBuckets {
+		cumulative += buckets[i]
+		fmt.Fprintf(w, "brain_dataset_cache_load_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "brain_dataset_cache_load_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "brain_dataset_cache_load_duration_seconds_sum %s\n", strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(w, "brain_dataset_cache_load_duration_seconds_count %d\n", count)
+	writeMetric(w, "brain_dataset_cache_datasets", "gauge", "No. of datasets in the cache.")
+	fmt.Fprintf(w, "brain_dataset_cache_datasets %d\n", cached)
+	writeMetric(w, "brain_dataset_cache_bytes", "gauge", "Estimated memory in bytes held by the tokens of the cached datasets.")
+	fmt.Fprintf(w, "brain_dataset_cache_bytes %d\n", cachedBytes)
+	writeMetric(w, "brain_dataset_cache_subscribers", "gauge", "No. of subscribers of a dataset.")
+	for _, k := range ids {
+		fmt.Fprintf(w, "brain_dataset_cache_subscribers{dataset_id=%q} %d\n", k, subscribers[k])
+	}
+}
+
+//writeMetric writes the help and type lines of a metric
+func writeMetric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//failingAggregator is the aggregator failing every load
+type failingAggregator struct{}
+
+func (failingAggregator) GetDataset(ID string) (Dataset, error) {
+	return Dataset{}, errors.New("aggregator failed")
+}
+
+func TestCacheMetrics(t *testing.T) {
+	conf := DefaultDatasetCacheConfig()
+	conf.MaxEntries = 1
+	c := startCache(newFakeAggregator(), conf)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for _, ID := range []string{"1", "1", "2"} {
+		if _, err := c.Get(ctx, ID, "user-"+ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.Metrics().Hits() != 1 || c.Metrics().Misses() != 2 {
+		t.Errorf("expected 1 hit and 2 misses, got %d and %d", c.Metrics().Hits(), c.Metrics().Misses())
+	}
+	if n := c.Metrics().Evictions(EvictionLRU); n != 1 {
+		t.Errorf("expected 1 lru eviction, got %d", n)
+	}
+	if n := c.Metrics().Subscribers("2"); n != 1 {
+		t.Errorf("expected 1 subscriber of the cached dataset, got %d", n)
+	}
+
+	c.SetAggregator(failingAggregator{})
+	if _, err := c.Get(ctx, "3", ""); err == nil {
+		t.Fatal("expected the failed load to return an error")
+	}
+	if n := c.Metrics().AggregatorErrors(); n != 1 {
+		t.Errorf("expected 1 aggregator error, got %d", n)
+	}
+	//the gauges are updated once the cache go routine serves the next request
+	if _, err := c.Subscribers(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Metrics().CachedDatasets(); n != 1 {
+		t.Errorf("expected 1 cached dataset, got %d", n)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	c := startCache(newFakeAggregator(), DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := c.Get(ctx, "1", "user-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected the prometheus text format, got %s", ct)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE brain_dataset_cache_hits_total counter",
+		"brain_dataset_cache_misses_total 1",
+		`brain_dataset_cache_evictions_total{reason="lru"} 0`,
+		`brain_dataset_cache_load_duration_seconds_bucket{le="+Inf"} 1`,
+		"brain_dataset_cache_load_duration_seconds_count 1",
+		`brain_dataset_cache_subscribers{dataset_id="1"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected the line %q in the metrics, got\n%s", line, body)
+		}
+	}
+}
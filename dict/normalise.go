@@ -0,0 +1,166 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"strings"
+	"unicode"
+)
+
+/*
+ * This file contains the normalisation of the token words into their keys in the dictionary
+ */
+
+//Normaliser normalises a token word into its key in the dictionary
+type Normaliser interface {
+	//Normalise returns the normalised form of the word
+	Normalise(word string) string
+}
+
+//NormaliserFunc is a function which can be used as a normaliser
+type NormaliserFunc func(word string) string
+
+//Normalise returns the normalised form of the word
+func (n NormaliserFunc) Normalise(word string) string {
+	return n(word)
+}
+
+//Pipeline is a normaliser applying each of its steps in order
+type Pipeline []Normaliser
+
+//Normalise returns the word normalised by each step of the pipeline in order
+func (p Pipeline) Normalise(word string) string {
+	for _, s := range p {
+		word = s.Normalise(word)
+	}
+	return word
+}
+
+var (
+	//LowerCase normalises the word to lower case
+	LowerCase Normaliser = NormaliserFunc(strings.ToLower)
+	//FoldUnicode folds the latin letters with diacritics into their base letters. eg:- "Café" becomes "Cafe"
+	FoldUnicode Normaliser = NormaliserFunc(foldUnicode)
+	//NormaliseSeparators replaces hyphens, underscores and repeated white spaces with a single space.
+	//eg:- "order-date" and "order_date" become "order date"
+	NormaliseSeparators Normaliser = NormaliserFunc(normaliseSeparators)
+	//FoldPlurals folds the regular english plurals of each part of the word into singular. eg:- "regions" becomes "region"
+	FoldPlurals Normaliser = NormaliserFunc(func(word string) string {
+		return mapParts(word, foldPlural)
+	})
+	//Stem reduces each part of the word to its stem using light english suffix stripping. It includes plural folding.
+	//eg:- "ordered" and "ordering" become "order"
+	Stem Normaliser = NormaliserFunc(func(word string) string {
+		return mapParts(word, stem)
+	})
+)
+
+//DefaultNormaliser is the normaliser used by the DAgg dict aggregator unless another one is set.
+//It only lower cases the word so that the keys match the interpreter's exact lookups
+var DefaultNormaliser Normaliser = LowerCase
+
+//NewNormaliser returns a pipeline which lower cases the word followed by the given steps
+func NewNormaliser(steps ...Normaliser) Pipeline {
+	return append(Pipeline{LowerCase}, steps...)
+}
+
+//normalise normalises the word with the normaliser. If the normalised word is empty, the lower cased word is
+//returned so that words made only of symbols like "<" are not lost
+func normalise(n Normaliser, word string) string {
+	if n == nil {
+		n = DefaultNormaliser
+	}
+	result := n.Normalise(word)
+	if len(result) == 0 {
+		return strings.ToLower(word)
+	}
+	return result
+}
+
+//diacritics maps the latin letters with diacritics to their base letters
+var diacritics = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a",
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Ā': "A",
+	'ç': "c", 'Ç': "C",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ē': "E",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i",
+	'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I", 'Ī': "I",
+	'ñ': "n", 'Ñ': "N",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o",
+	'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O", 'Ō': "O",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ū': "U",
+	'ý': "y", 'ÿ': "y", 'Ý': "Y",
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE",
+}
+
+func foldUnicode(word string) string {
+	var b strings.Builder
+	for _, r := range word {
+		if f, ok := diacritics[r]; ok {
+			b.WriteString(f)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func normaliseSeparators(word string) string {
+	return strings.Join(strings.FieldsFunc(word, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-' || r == '_'
+	}), " ")
+}
+
+//mapParts applies the function on each space separated part of the word
+func mapParts(word string, fn func(string) string) string {
+	parts := strings.Split(word, " ")
+	for i, p := range parts {
+		parts[i] = fn(p)
+	}
+	return strings.Join(parts, " ")
+}
+
+//foldPlural returns the singular form of a regular english plural
+func foldPlural(w string) string {
+	switch {
+	case len(w) > 4 && strings.HasSuffix(w, "ies"):
+		return w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "sses"), strings.HasSuffix(w, "shes"), strings.HasSuffix(w, "ches"),
+		strings.HasSuffix(w, "xes"), strings.HasSuffix(w, "zes"):
+		return w[:len(w)-2]
+	case len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") &&
+		!strings.HasSuffix(w, "us") && !strings.HasSuffix(w, "is"):
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+//stemSuffixes are the suffixes stripped by the stemmer in the order of preference
+var stemSuffixes = []string{"ational", "ization", "fulness", "ousness", "iveness", "ingly", "ation", "ments", "ment", "ness", "ing", "ies", "ied", "ed", "ly"}
+
+//minStemLength is the minimum length of the stem left after stripping a suffix
+const minStemLength = 3
+
+//stem returns the stem of the english word
+func stem(w string) string {
+	w = foldPlural(w)
+	for _, s := range stemSuffixes {
+		if !strings.HasSuffix(w, s) || len(w)-len(s) < minStemLength {
+			continue
+		}
+		w = w[:len(w)-len(s)]
+		if s == "ies" || s == "ied" {
+			w += "y"
+		}
+		//a doubled consonant left by the suffix is reduced. eg:- "shipped" becomes "ship"
+		if l := len(w); l > minStemLength && w[l-1] == w[l-2] && !strings.ContainsRune("aeiouls", rune(w[l-1])) {
+			w = w[:l-1]
+		}
+		break
+	}
+	return w
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormaliserSteps(t *testing.T) {
+	cases := []struct {
+		step     Normaliser
+		word     string
+		expected string
+	}{
+		{LowerCase, "Order Date", "order date"},
+		{FoldUnicode, "Café Crème", "Cafe Creme"},
+		{FoldUnicode, "Straße", "Strasse"},
+		{NormaliseSeparators, "order-date", "order date"},
+		{NormaliseSeparators, "  order__date\t id ", "order date id"},
+		{FoldPlurals, "regions", "region"},
+		{FoldPlurals, "categories", "category"},
+		{FoldPlurals, "boxes", "box"},
+		{FoldPlurals, "sales regions", "sale region"},
+		{FoldPlurals, "status", "status"},
+		{FoldPlurals, "address", "address"},
+		{FoldPlurals, "analysis", "analysis"},
+		{Stem, "ordered", "order"},
+		{Stem, "ordering", "order"},
+		{Stem, "shipped", "ship"},
+		{Stem, "payments", "pay"},
+		{Stem, "red", "red"},
+	}
+	for _, c := range cases {
+		if got := c.step.Normalise(c.word); got != c.expected {
+			t.Errorf("expected %q to be normalised into %q, got %q", c.word, c.expected, got)
+		}
+	}
+}
+
+func TestNormaliserPipeline(t *testing.T) {
+	//custom steps are applied after lower casing in the given order
+	abbreviations := NormaliserFunc(func(word string) string {
+		return strings.Replace(word, "qty", "quantity", -1)
+	})
+	n := NewNormaliser(FoldUnicode, NormaliseSeparators, abbreviations, FoldPlurals)
+	for _, w := range []string{"Order-Qty", "order_qtys", "ORDER QTY", "Órder  Qty"} {
+		if got := n.Normalise(w); got != "order quantity" {
+			t.Errorf("expected %q to be normalised into %q, got %q", w, "order quantity", got)
+		}
+	}
+
+	//words made only of the removed symbols are kept lower cased
+	if got := normalise(NewNormaliser(NormaliseSeparators), "-"); got != "-" {
+		t.Errorf("expected the word of symbols to be kept, got %q", got)
+	}
+	if got := normalise(nil, "Revenue"); got != "revenue" {
+		t.Errorf("expected the default normaliser to lower case the word, got %q", got)
+	}
+	d := NewDAggWithCache(nil, nil, nil)
+	d.SetNormaliser(n)
+	if got := d.Normalise("Regions"); got != "region" {
+		t.Errorf("expected the normaliser of the aggregator to be used, got %q", got)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+ * This file contains the observers of the changes to the datasets in the dataset cache
+ */
+
+//DatasetObserverBuffer is the no. of events buffered for an observer. Events arriving while the buffer
+//of an observer is full are dropped for that observer so that a slow observer never blocks the cache
+const DatasetObserverBuffer = 1024
+
+//DatasetEventType is the type of an event of a dataset in the cache
+type DatasetEventType uint
+
+const (
+	//DatasetLoaded is the event when a dataset is loaded into the cache from the aggregator
+	DatasetLoaded DatasetEventType = iota + 1
+	//DatasetUpdated is the event when a cached dataset is reloaded, patched or invalidated.
+	//The DICTs of the subscribers are dropped along with it
+	DatasetUpdated
+	//DatasetEvicted is the event when a dataset is evicted from the cache
+	DatasetEvicted
+	//DatasetFailed is the event when a dataset couldn't be loaded from the aggregator
+	DatasetFailed
+)
+
+//String returns the name of the event type
+func (t DatasetEventType) String() string {
+	switch t {
+	case DatasetLoaded:
+		return "loaded"
+	case DatasetUpdated:
+		return "updated"
+	case DatasetEvicted:
+		return "evicted"
+	case DatasetFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+//DatasetEvent is an event of a dataset in the cache
+type DatasetEvent struct {
+	//Type is the type of the event
+	Type DatasetEventType
+	//DatasetID is the id of the dataset
+	DatasetID string
+	//Subscribers has the ids subscribed to the dataset when the event occurred
+	Subscribers []string
+	//Time is the time at which the event occurred
+	Time time.Time
+	//Duration is the time taken to load the dataset from the aggregator. It is zero for the events not involving a load
+	Duration time.Duration
+	//Reason is the reason of the eviction for the evicted events
+	Reason EvictionReason
+	//Err is the error of the load for the failed events
+	Err error
+	//Diff is the node level diff patched on the cached dataset for the updated events of a patch. It is empty for
+	//the other updated events. The DICTs of the subscribers are dropped in either case
+	Diff NodeDiff
+}
+
+//DatasetObserver observes the events of the datasets in a dataset cache
+type DatasetObserver interface {
+	//OnDatasetEvent is called for each event in the order in which they occurred
+	OnDatasetEvent(e DatasetEvent)
+}
+
+//DatasetObserverFunc is a function which can be used as a dataset observer
+type DatasetObserverFunc func(e DatasetEvent)
+
+//OnDatasetEvent calls the function with the event
+func (f DatasetObserverFunc) OnDatasetEvent(e DatasetEvent) {
+	f(e)
+}
+
+//observer is a dataset observer registered with a cache along with its buffer of events
+type observer struct {
+	o      DatasetObserver
+	events chan DatasetEvent
+	stop   chan struct{}
+	once   sync.Once
+}
+
+//observers has the observers and the drop functions registered with a cache
+type observers struct {
+	m     sync.RWMutex
+	next  int
+	obs   map[int]*observer
+	drops map[int]DICTDropFunc
+}
+
+//DICTDropFunc is called with the ids of the DICTs dropped by the cache and the time at which they were dropped
+type DICTDropFunc func(IDs []string, at time.Time)
+
+//Observe registers the observer for the events of the datasets in the cache. The events are delivered to the
+//observer in a separate go routine in the order in which they occurred. Events are dropped for the observer if it
+//falls behind by DatasetObserverBuffer events. The returned function removes the observer
+func (c *DatasetCache) Observe(o DatasetObserver) func() {
+	ob := &observer{o: o, events: make(chan DatasetEvent, DatasetObserverBuffer), stop: make(chan struct{})}
+	c.observers.m.Lock()
+	id := c.observers.next
+	c.observers.next++
+	c.observers.obs[id] = ob
+	c.observers.m.Unlock()
+	go c.deliver(ob)
+	return func() {
+		c.observers.m.Lock()
+		delete(c.observers.obs, id)
+		c.observers.m.Unlock()
+		ob.once.Do(func() {
+			close(ob.stop)
+		})
+	}
+}
+
+//OnDICTsDropped registers the function to be called whenever the cache drops the DICTs of the subscribers of its datasets.
+//Unlike the events of the observers, it is never skipped. It is called synchronously from the cache go routine along with
+//dropping the DICTs, so it must return quickly and must not make requests to the cache. The returned function removes it
+func (c *DatasetCache) OnDICTsDropped(f DICTDropFunc) func() {
+	c.observers.m.Lock()
+	id := c.observers.next
+	c.observers.next++
+	c.observers.drops[id] = f
+	c.observers.m.Unlock()
+	return func() {
+		c.observers.m.Lock()
+		delete(c.observers.drops, id)
+		c.observers.m.Unlock()
+	}
+}
+
+//dropDICTs removes the DICTs of the given ids from the interpreter and calls the drop functions registered with the cache
+func (c *DatasetCache) dropDICTs(IDs []string) {
+	if len(IDs) == 0 {
+		return
+	}
+	removeSubscribedDICTs(IDs)
+	at := time.Now()
+	c.observers.m.RLock()
+	defer c.observers.m.RUnlock()
+	for _, f := range c.observers.drops {
+		f(IDs, at)
+	}
+}
+
+//deliver delivers the events of the observer until it is removed or the cache is closed
+func (c *DatasetCache) deliver(ob *observer) {
+	for {
+		select {
+		case e := <-ob.events:
+			ob.o.OnDatasetEvent(e)
+		case <-ob.stop:
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+//emit sends the event to the observers of the cache without blocking
+func (c *DatasetCache) emit(e DatasetEvent) {
+	c.observers.m.RLock()
+	defer c.observers.m.RUnlock()
+	if len(c.observers.obs) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	for _, ob := range c.observers.obs {
+		select {
+		case ob.events <- e:
+		default:
+			c.conf.Logger.Error("dropping the", e.Type.String(), "event of the dataset", e.DatasetID, "since the observer is falling behind")
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//nextEvent returns the next event delivered to the observer
+func nextEvent(ctx context.Context, t *testing.T, events chan DatasetEvent) DatasetEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.Time.IsZero() {
+			t.Errorf("expected the time of the %s event of the dataset %s", e.Type, e.DatasetID)
+		}
+		return e
+	case <-ctx.Done():
+		t.Fatal("expected an event to be delivered to the observer")
+	}
+	return DatasetEvent{}
+}
+
+func TestDatasetEventPayloads(t *testing.T) {
+	conf := DefaultDatasetCacheConfig()
+	conf.MaxEntries = 1
+	c := startCache(roundTripAggregator{newFakeAggregator()}, conf)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	events := make(chan DatasetEvent, 10)
+	defer c.Observe(DatasetObserverFunc(func(e DatasetEvent) {
+		events <- e
+	}))()
+
+	//loading a dataset
+	if _, err := c.Get(ctx, "1", "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	e := nextEvent(ctx, t, events)
+	if e.Type != DatasetLoaded || e.DatasetID != "1" || !reflect.DeepEqual(e.Subscribers, []string{"user-1"}) {
+		t.Errorf("expected the loaded event of the dataset 1 with its subscriber, got %s %s %v", e.Type, e.DatasetID, e.Subscribers)
+	}
+	if e.Duration < benchmarkRoundTrip {
+		t.Errorf("expected the time taken by the load, got %s", e.Duration)
+	}
+
+	//updating the dataset
+	if _, err := c.Update(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	e = nextEvent(ctx, t, events)
+	if e.Type != DatasetUpdated || e.DatasetID != "1" || !reflect.DeepEqual(e.Subscribers, []string{"user-1"}) {
+		t.Errorf("expected the updated event of the dataset 1 with its subscriber, got %s %s %v", e.Type, e.DatasetID, e.Subscribers)
+	}
+	if e.Duration < benchmarkRoundTrip || !e.Diff.Empty() {
+		t.Errorf("expected the time taken by the reload without a diff, got %s %+v", e.Duration, e.Diff)
+	}
+
+	//patching the dataset
+	diff := renameDiff("1", "sales region")
+	if err := c.Patch(ctx, "1", diff); err != nil {
+		t.Fatal(err)
+	}
+	e = nextEvent(ctx, t, events)
+	if e.Type != DatasetUpdated || e.Duration != 0 || !reflect.DeepEqual(e.Diff, diff) {
+		t.Errorf("expected the updated event of the patch with its diff, got %s %s %+v", e.Type, e.Duration, e.Diff)
+	}
+
+	//loading another dataset evicts the first one
+	if _, err := c.Get(ctx, "2", "user-2"); err != nil {
+		t.Fatal(err)
+	}
+	got := map[DatasetEventType]DatasetEvent{}
+	for i := 0; i < 2; i++ {
+		e = nextEvent(ctx, t, events)
+		got[e.Type] = e
+	}
+	if e, ok := got[DatasetEvicted]; !ok || e.DatasetID != "1" || e.Reason != EvictionLRU || !reflect.DeepEqual(e.Subscribers, []string{"user-1"}) {
+		t.Errorf("expected the lru evicted event of the dataset 1 with its subscriber, got %+v", e)
+	}
+	if e, ok := got[DatasetLoaded]; !ok || e.DatasetID != "2" {
+		t.Errorf("expected the loaded event of the dataset 2, got %+v", e)
+	}
+
+	//failing to load a dataset
+	c.SetAggregator(failingAggregator{})
+	if _, err := c.Get(ctx, "3", "user-3"); err == nil {
+		t.Fatal("expected the load to fail")
+	}
+	e = nextEvent(ctx, t, events)
+	if e.Type != DatasetFailed || e.DatasetID != "3" || e.Err == nil || len(e.Subscribers) != 0 {
+		t.Errorf("expected the failed event of the dataset 3 with the error and no subscribers, got %+v", e)
+	}
+}
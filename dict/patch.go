@@ -0,0 +1,218 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"strings"
+
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the node level diff of a dataset and its application on the token maps
+ */
+
+//NodeDiff is the node level difference between two versions of a dataset
+type NodeDiff struct {
+	//Added has the nodes added to the dataset
+	Added []interpreter.Node
+	//Removed has the uids of the nodes removed from the dataset
+	Removed []string
+	//Changed has the new version of the nodes changed in the dataset
+	Changed []interpreter.Node
+	//Keys has the normalised keys with which the added and changed nodes are indexed in the token map,
+	//mapped to the uid of the node. It includes the keys of the node's word and its synonyms
+	Keys map[string][]string
+}
+
+//Empty returns true if the diff has no changes
+func (n NodeDiff) Empty() bool {
+	return len(n.Added) == 0 && len(n.Removed) == 0 && len(n.Changed) == 0
+}
+
+//DiffNodes returns the diff between the old and new version of the nodes of a dataset.
+//Nodes are matched by their uid. The keys of the nodes are normalised with the given normaliser.
+//The parents of the new nodes have to be set by the caller if required
+func DiffNodes(old, new []models.Node, normaliser Normaliser) NodeDiff {
+	/*
+	 * We will map the old nodes with their uid
+	 * Then we will iterate through the new nodes to find the added and changed nodes
+	 * Whatever remains in the map are the removed nodes
+	 */
+	result := NodeDiff{Keys: map[string][]string{}}
+	oMap := map[string]models.Node{}
+	for _, n := range old {
+		oMap[n.UID.String()] = n
+	}
+
+	for _, n := range new {
+		o, ok := oMap[n.UID.String()]
+		delete(oMap, n.UID.String())
+		if ok && !nodeChanged(o, n) {
+			continue
+		}
+		iN, iOk := n.InterpreterNode()
+		if !iOk {
+			continue
+		}
+		if ok {
+			result.Changed = append(result.Changed, iN)
+		} else {
+			result.Added = append(result.Added, iN)
+		}
+		keys := []string{normalise(normaliser, string(iN.TokenWord()))}
+		for _, s := range n.Synonyms() {
+			keys = append(keys, normalise(normaliser, s))
+		}
+		result.Keys[n.UID.String()] = keys
+	}
+
+	for k := range oMap {
+		result.Removed = append(result.Removed, k)
+	}
+	return result
+}
+
+//nodeChanged returns true if the type, parent or the metadata of the node has changed.
+//Since a property can have multiple values, the metadata are compared as multisets
+func nodeChanged(o, n models.Node) bool {
+	if o.Type != n.Type || o.PUID != n.PUID || len(o.NodeMetadatas) != len(n.NodeMetadatas) {
+		return true
+	}
+	props := map[[2]string]int{}
+	for _, m := range o.NodeMetadatas {
+		props[[2]string{m.Prop, m.Value}]++
+	}
+	for _, m := range n.NodeMetadatas {
+		k := [2]string{m.Prop, m.Value}
+		if props[k] == 0 {
+			return true
+		}
+		props[k]--
+	}
+	return false
+}
+
+//ApplyDiff returns a new token map with the diff applied on the given token map.
+//The value nodes of the changed columns, including their date phrases, are moved to the new version of the columns
+//and the ones of the removed columns are removed. The given token map and the nodes of the diff are not modified
+//so that the readers holding them aren't affected
+func ApplyDiff(tokens map[string]interpreter.Token, diff NodeDiff) map[string]interpreter.Token {
+	/*
+	 * We will find the uids of the nodes to be removed. Changed nodes are removed and added back
+	 * We will copy the tokens while dropping the removed nodes and setting aside the values of the changed columns
+	 * Then we will add the added and changed nodes
+	 * Finally we will add the values of the changed columns attached to their new version
+	 */
+	removed := map[string]struct{}{}
+	for _, uid := range diff.Removed {
+		if len(uid) > 0 {
+			removed[uid] = struct{}{}
+		}
+	}
+	changed := make([]interpreter.Node, 0, len(diff.Changed))
+	columns := map[string]*interpreter.ColumnNode{}
+	for _, n := range diff.Changed {
+		uid := NodeUID(n)
+		if len(uid) > 0 {
+			removed[uid] = struct{}{}
+		}
+		//the changed columns are copied since their values are attached to them
+		if c, ok := n.(*interpreter.ColumnNode); ok {
+			cp := *c
+			cp.Children = nil
+			columns[uid] = &cp
+			n = &cp
+		}
+		changed = append(changed, n)
+	}
+
+	//copying the tokens while dropping the removed nodes and setting aside the values of the changed columns
+	type movedValue struct {
+		key   string
+		value *interpreter.ValueNode
+	}
+	moved := []movedValue{}
+	result := make(map[string]interpreter.Token, len(tokens))
+	for k, t := range tokens {
+		nodes := make([]interpreter.Node, 0, len(t.Nodes))
+		for _, n := range t.Nodes {
+			if _, ok := removed[NodeUID(n)]; ok {
+				continue
+			}
+			if v, ok := n.(*interpreter.ValueNode); ok {
+				if _, ok := columns[v.PUID]; ok {
+					moved = append(moved, movedValue{key: k, value: v})
+					continue
+				}
+				if _, ok := removed[v.PUID]; ok {
+					continue
+				}
+			}
+			nodes = append(nodes, n)
+		}
+		if len(nodes) == 0 {
+			continue
+		}
+		t.Nodes = nodes
+		result[k] = t
+	}
+
+	//adding the new version of the nodes with their keys. nodes without keys are indexed with their lower cased word
+	for _, n := range append(append([]interpreter.Node{}, diff.Added...), changed...) {
+		keys, ok := diff.Keys[NodeUID(n)]
+		if !ok {
+			keys = []string{strings.ToLower(string(n.TokenWord()))}
+		}
+		for _, k := range keys {
+			addToken(result, k, n.TokenWord(), n)
+		}
+	}
+
+	//attaching the values to the new version of their columns. the children are added first
+	//since the value tokens point into them. a value indexed with several keys is attached once
+	children := map[*interpreter.ValueNode]int{}
+	for _, m := range moved {
+		if _, ok := children[m.value]; ok || IsDatePhraseNode(m.value) {
+			continue
+		}
+		c := columns[m.value.PUID]
+		v := *m.value
+		v.PN = c
+		children[m.value] = len(c.Children)
+		c.Children = append(c.Children, v)
+	}
+	for _, m := range moved {
+		c := columns[m.value.PUID]
+		if IsDatePhraseNode(m.value) {
+			v := *m.value
+			v.PN = c
+			addToken(result, m.key, v.Word, &v)
+			continue
+		}
+		i := children[m.value]
+		addToken(result, m.key, c.Children[i].Word, &c.Children[i])
+	}
+	return result
+}
+
+//NodeUID returns the uid of an interpreter node
+func NodeUID(n interpreter.Node) string {
+	switch v := n.(type) {
+	case *interpreter.ColumnNode:
+		return v.UID
+	case *interpreter.TableNode:
+		return v.UID
+	case *interpreter.KnowledgeBaseNode:
+		return v.UID
+	case *interpreter.OperatorNode:
+		return v.UID
+	case *interpreter.ValueNode:
+		return v.UID
+	default:
+		return ""
+	}
+}
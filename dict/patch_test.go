@@ -0,0 +1,96 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"testing"
+
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+	"github.com/google/uuid"
+)
+
+func TestDiffNodesRemovesTheKeysOfRemovedSynonyms(t *testing.T) {
+	column := models.Node{UID: uuid.New(), Type: interpreter.Column, NodeMetadatas: []models.NodeMetadata{
+		{Prop: models.NodeMetadataPropWord, Value: "revenue"},
+		{Prop: models.NodeMetadataPropName, Value: "revenue"},
+	}}
+	column.AddSynonym("sales")
+	column.AddSynonym("turnover")
+	tokens := ApplyDiff(map[string]interpreter.Token{}, DiffNodes(nil, []models.Node{column}, nil))
+	for _, k := range []string{"revenue", "sales", "turnover"} {
+		if _, ok := tokens[k]; !ok {
+			t.Fatalf("expected the key %s in the tokens", k)
+		}
+	}
+
+	updated := column
+	updated.NodeMetadatas = append([]models.NodeMetadata{}, column.NodeMetadatas...)
+	if removed := updated.RemoveSynonym("SALES"); len(removed) != 1 {
+		t.Fatalf("expected the synonym to be removed, got %v", removed)
+	}
+	diff := DiffNodes([]models.Node{column}, []models.Node{updated}, nil)
+	if len(diff.Changed) != 1 {
+		t.Fatalf("expected the column to be changed, got %+v", diff)
+	}
+	tokens = ApplyDiff(tokens, diff)
+	if _, ok := tokens["sales"]; ok {
+		t.Error("expected the key of the removed synonym to be dropped")
+	}
+	for _, k := range []string{"revenue", "turnover"} {
+		if _, ok := tokens[k]; !ok {
+			t.Errorf("expected the key %s to be kept", k)
+		}
+	}
+}
+
+func TestApplyDiffMovesTheValuesToTheChangedColumn(t *testing.T) {
+	column := &interpreter.ColumnNode{UID: "column", Word: []rune("region"), Name: "region"}
+	column.Children = []interpreter.ValueNode{{UID: "value", Word: []rune("north"), PUID: "column", Name: "north", PN: column}}
+	phrase := &interpreter.ValueNode{UID: DatePhraseUIDPrefix + "column", Word: []rune("last month"), PUID: "column", Name: "last month", PN: column}
+	removed := &interpreter.ColumnNode{UID: "removed", Word: []rune("city"), Name: "city"}
+	tokens := map[string]interpreter.Token{
+		"region":     {Word: column.Word, Nodes: []interpreter.Node{column}},
+		"north":      {Word: column.Children[0].Word, Nodes: []interpreter.Node{&column.Children[0]}},
+		"northern":   {Word: column.Children[0].Word, Nodes: []interpreter.Node{&column.Children[0]}},
+		"last month": {Word: phrase.Word, Nodes: []interpreter.Node{phrase}},
+		"city":       {Word: removed.Word, Nodes: []interpreter.Node{removed}},
+		"paris":      {Word: []rune("paris"), Nodes: []interpreter.Node{&interpreter.ValueNode{UID: "paris", PUID: "removed", PN: removed}}},
+	}
+
+	renamed := &interpreter.ColumnNode{UID: "column", Word: []rune("sales region"), Name: "sales region"}
+	result := ApplyDiff(tokens, NodeDiff{
+		Changed: []interpreter.Node{renamed},
+		Removed: []string{"removed"},
+		Keys:    map[string][]string{"column": {"sales region"}},
+	})
+
+	for _, k := range []string{"region", "city", "paris"} {
+		if _, ok := result[k]; ok {
+			t.Errorf("expected the key %s to be removed", k)
+		}
+	}
+	tok, ok := result["sales region"]
+	if !ok || len(tok.Nodes) != 1 {
+		t.Fatalf("expected the renamed column, got %+v", tok)
+	}
+	c := tok.Nodes[0].(*interpreter.ColumnNode)
+	if c == renamed || len(c.Children) != 1 || len(renamed.Children) != 0 {
+		t.Fatalf("expected a copy of the changed column having the value once, got %+v", c)
+	}
+	for _, k := range []string{"north", "northern"} {
+		v := result[k].Nodes[0].(*interpreter.ValueNode)
+		if v != &c.Children[0] || v.PN != c {
+			t.Errorf("expected the value of %s to point at the new version of the column", k)
+		}
+	}
+	p := result["last month"].Nodes[0].(*interpreter.ValueNode)
+	if p == phrase || p.PN != c {
+		t.Error("expected the date phrase to point at the new version of the column")
+	}
+	if column.Children[0].PN != column || phrase.PN != column {
+		t.Error("expected the given token map to be left as such")
+	}
+}
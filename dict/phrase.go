@@ -0,0 +1,274 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the phrase index of a dictionary for scanning the multi word tokens in a query
+ */
+
+//PhraseMatch is a token found while scanning a query
+type PhraseMatch struct {
+	//Key is the key of the token in the dictionary
+	Key string
+	//Token is the matched token
+	Token interpreter.Token
+	//Start is the offset in runes of the first rune of the match in the query
+	Start int
+	//End is the offset in runes just after the last rune of the match in the query
+	End int
+}
+
+//phraseNode is a node of the phrase trie. The edges are the words of the phrases
+type phraseNode struct {
+	//children has the child nodes mapped to the word of the edge
+	children map[string]*phraseNode
+	//parent is the parent node. It is nil for the root
+	parent *phraseNode
+	//word is the word of the edge from the parent
+	word string
+	//key is the key of the token ending at the node. It is empty if no token ends at the node
+	key string
+	//token is the token ending at the node
+	token interpreter.Token
+}
+
+//PhraseIndex is a trie of the keys of a dictionary split into words. It is used to scan a query for the longest
+//matching tokens without trying every n-gram of the query. It is kept in sync with the dictionary through Sync
+//and is safe for concurrent use
+type PhraseIndex struct {
+	m sync.RWMutex
+	//n is the normaliser used for the words of the scanned queries
+	n Normaliser
+	//root is the root of the trie
+	root *phraseNode
+	//phrases has the nodes at which the keys of the dictionary end mapped to the key
+	phrases map[string]*phraseNode
+}
+
+//NewPhraseIndex builds the phrase index for the dictionary. The words of the scanned queries are normalised with the
+//normaliser, which is to be the one used for the keys of the dictionary. Nil normaliser falls back to DefaultNormaliser
+func NewPhraseIndex(d interpreter.DICT, n Normaliser) *PhraseIndex {
+	result := &PhraseIndex{
+		n:       n,
+		root:    &phraseNode{children: map[string]*phraseNode{}},
+		phrases: map[string]*phraseNode{},
+	}
+	result.Sync(d.Map)
+	return result
+}
+
+//Sync brings the index in sync with the tokens of the dictionary. Only the keys added to or removed from the
+//dictionary change the trie, so that the index need not be built again when a dataset of the dictionary updates
+func (p *PhraseIndex) Sync(tokens map[string]interpreter.Token) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.sync(tokens)
+}
+
+//Patch applies the node level diff on the tokens of the index the same way it is applied on the dictionary
+func (p *PhraseIndex) Patch(diff NodeDiff) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	tokens := make(map[string]interpreter.Token, len(p.phrases))
+	for k, n := range p.phrases {
+		tokens[k] = n.token
+	}
+	p.sync(ApplyDiff(tokens, diff))
+}
+
+//sync brings the trie in sync with the tokens. The caller has to hold the lock of the index
+func (p *PhraseIndex) sync(tokens map[string]interpreter.Token) {
+	for k, n := range p.phrases {
+		if _, ok := tokens[k]; !ok {
+			p.remove(n)
+			delete(p.phrases, k)
+		}
+	}
+	for k, t := range tokens {
+		if n, ok := p.phrases[k]; ok {
+			n.token = t
+			continue
+		}
+		p.insert(k, t)
+	}
+}
+
+//Len returns the no. of phrases in the index
+func (p *PhraseIndex) Len() int {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return len(p.phrases)
+}
+
+//insert adds the key to the trie
+func (p *PhraseIndex) insert(k string, t interpreter.Token) {
+	words := strings.Fields(k)
+	if len(words) == 0 {
+		return
+	}
+	n := p.root
+	for _, w := range words {
+		c, ok := n.children[w]
+		if !ok {
+			c = &phraseNode{children: map[string]*phraseNode{}, parent: n, word: w}
+			n.children[w] = c
+		}
+		n = c
+	}
+	n.key = k
+	n.token = t
+	p.phrases[k] = n
+}
+
+//remove removes the token ending at the node and prunes the nodes left without any phrase
+func (p *PhraseIndex) remove(n *phraseNode) {
+	n.key = ""
+	n.token = interpreter.Token{}
+	for n.parent != nil && len(n.key) == 0 && len(n.children) == 0 {
+		delete(n.parent.children, n.word)
+		n = n.parent
+	}
+}
+
+//queryWord is a normalised word of a scanned query
+type queryWord struct {
+	word  string
+	start int
+	end   int
+}
+
+//words splits the query into its normalised words along with their offsets in runes.
+//The punctuations around a word are dropped unless the word is made only of them
+func (p *PhraseIndex) words(query string) []queryWord {
+	result := []queryWord{}
+	q := []rune(query)
+	for i := 0; i < len(q); {
+		if unicode.IsSpace(q[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(q) && !unicode.IsSpace(q[i]) {
+			i++
+		}
+		s, e := start, i
+		for s < e && unicode.IsPunct(q[s]) {
+			s++
+		}
+		for e > s && unicode.IsPunct(q[e-1]) {
+			e--
+		}
+		if s == e {
+			s, e = start, i
+		}
+		//a word may be normalised into several words like "order_date" into "order date"
+		for _, w := range strings.Fields(normalise(p.n, string(q[s:e]))) {
+			result = append(result, queryWord{word: w, start: s, end: e})
+		}
+	}
+	return result
+}
+
+//Scan returns the tokens found in the query from left to right. At each word the longest phrase of the
+//dictionary starting there is matched and the scan continues after it. Words not part of any phrase are skipped
+func (p *PhraseIndex) Scan(query string) []PhraseMatch {
+	/*
+	 * We will split the query into its normalised words
+	 * From each word we will walk the trie as far as the words match, remembering the last phrase ending
+	 * If a phrase is found we will continue after it, else from the next word
+	 */
+	result := []PhraseMatch{}
+	words := p.words(query)
+	p.m.RLock()
+	defer p.m.RUnlock()
+	for i := 0; i < len(words); {
+		n := p.root
+		last := -1
+		var match *phraseNode
+		for j := i; j < len(words); j++ {
+			c, ok := n.children[words[j].word]
+			if !ok {
+				break
+			}
+			n = c
+			if len(n.key) > 0 {
+				last = j
+				match = n
+			}
+		}
+		if match == nil {
+			i++
+			continue
+		}
+		result = append(result, PhraseMatch{Key: match.key, Token: match.token, Start: words[i].start, End: words[last].end})
+		i = last + 1
+	}
+	return result
+}
+
+//phraseIndexes has the phrase indexes built for the dictionaries mapped to the dictionary id
+type phraseIndexes struct {
+	m       sync.RWMutex
+	indexes map[string]*PhraseIndex
+	//shared has the ids of the dictionaries using the phrase index of another dictionary
+	shared map[string]struct{}
+	//built has the time at which the index of each dictionary was last built or synced
+	built map[string]time.Time
+}
+
+func (p *phraseIndexes) get(ID string) (*PhraseIndex, bool) {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	i, ok := p.indexes[ID]
+	return i, ok
+}
+
+//share makes the dictionary use the phrase index of another dictionary
+func (p *phraseIndexes) share(ID string, i *PhraseIndex) {
+	p.m.Lock()
+	p.indexes[ID] = i
+	p.shared[ID] = struct{}{}
+	p.built[ID] = time.Now()
+	p.m.Unlock()
+}
+
+//sync brings the phrase index of the dictionary in sync with its tokens. A new index is built if the dictionary
+//doesn't have one of its own yet
+func (p *phraseIndexes) sync(ID string, d interpreter.DICT, n Normaliser) {
+	p.m.Lock()
+	i, ok := p.indexes[ID]
+	_, shared := p.shared[ID]
+	if !ok || shared {
+		i = NewPhraseIndex(interpreter.DICT{Map: map[string]interpreter.Token{}}, n)
+		p.indexes[ID] = i
+		delete(p.shared, ID)
+	}
+	p.built[ID] = time.Now()
+	p.m.Unlock()
+	i.Sync(d.Map)
+}
+
+//remove removes the indexes of the dictionaries synced before the given time.
+//The indexes synced after it are of the dictionaries built again after they were dropped
+func (p *phraseIndexes) remove(before time.Time, IDs ...string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, ID := range IDs {
+		if t, ok := p.built[ID]; ok && t.Before(before) {
+			delete(p.indexes, ID)
+			delete(p.shared, ID)
+			delete(p.built, ID)
+		}
+	}
+}
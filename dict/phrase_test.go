@@ -0,0 +1,97 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+func TestPhraseIndexFollowsTheDICT(t *testing.T) {
+	c := startCache(newFakeAggregator(), DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	d := NewDAggWithCache(nil, nil, c)
+	d.EnablePhraseIndex()
+
+	dataset, err := c.Get(ctx, "1", "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "1", "user-2"); err != nil {
+		t.Fatal(err)
+	}
+	d.phrases.sync("user-1", interpreter.DICT{Map: dataset.D}, d.normaliser)
+	d.phrases.share("user-2", mustPhrases(t, d, "user-1"))
+	if m, _ := d.Scan("user-1", "show the column 1 by month"); len(m) != 1 || m[0].Key != "column 1" {
+		t.Fatalf("expected the column to be found, got %+v", m)
+	}
+
+	//the indexes are removed along with the dictionaries when the dataset is patched
+	if err := c.Patch(ctx, "1", renameDiff("1", "sales region")); err != nil {
+		t.Fatal(err)
+	}
+	_, ok1 := d.Phrases("user-1")
+	_, ok2 := d.Phrases("user-2")
+	if ok1 || ok2 {
+		t.Fatal("expected the phrase indexes to be removed when the dataset is patched")
+	}
+
+	//and when the dataset is invalidated. the index is removed by the cache along with the dictionary, before the
+	//cache serves the next request
+	d.phrases.sync("user-1", interpreter.DICT{Map: dataset.D}, d.normaliser)
+	if err := c.Invalidate("1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Subscribers(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Phrases("user-1"); ok {
+		t.Error("expected the phrase index to be removed when the dictionary is dropped")
+	}
+}
+
+func TestPhraseIndexIsDroppedBeforeTheUpdateReturns(t *testing.T) {
+	c := startCache(newFakeAggregator(), DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	d := NewDAggWithCache(nil, nil, c)
+	d.EnablePhraseIndex()
+
+	dataset, err := c.Get(ctx, "1", "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.phrases.sync("user-1", interpreter.DICT{Map: dataset.D}, d.normaliser)
+	updated, err := c.Update(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Phrases("user-1"); ok {
+		t.Fatal("expected the phrase index to be removed by the time the update returns")
+	}
+
+	//the index built again from the updated dataset is kept
+	d.phrases.sync("user-1", interpreter.DICT{Map: updated.D}, d.normaliser)
+	if _, err := c.Subscribers(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := d.Scan("user-1", "column 1"); len(m) != 1 {
+		t.Errorf("expected the index built after the update to be kept, got %+v", m)
+	}
+}
+
+func mustPhrases(t *testing.T, d *DAgg, ID string) *PhraseIndex {
+	i, ok := d.Phrases(ID)
+	if !ok {
+		t.Fatalf("expected the phrase index of %s", ID)
+	}
+	return i
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the ranking of the nodes of a token merged from several datasets
+ */
+
+//RankingWeights has the weights of the signals used to score the nodes of a token.
+//A node's score is the weighted sum of its signals, each of which is between 0 and 1
+type RankingWeights struct {
+	//Recency is the weight of how recently the dataset of the node was updated
+	Recency float64
+	//RecencyHalfLife is the age of a dataset at which its recency signal halves
+	RecencyHalfLife time.Duration
+	//Frequency is the weight of how often the user has queried the node relative to the user's most queried node
+	Frequency float64
+	//Measure is the weight given to the measure columns
+	Measure float64
+	//Dimension is the weight given to the dimension columns
+	Dimension float64
+}
+
+//DefaultRankingWeights returns the default ranking weights. The user's own usage weighs the most
+func DefaultRankingWeights() RankingWeights {
+	return RankingWeights{
+		Recency:         1,
+		RecencyHalfLife: time.Hour * 24 * 30,
+		Frequency:       2,
+		Measure:         0.5,
+		Dimension:       0.25,
+	}
+}
+
+//UsageSource gives the no. of times the user has queried the nodes
+type UsageSource interface {
+	//NodeUsage returns the no. of times the user has queried each node mapped to the uid of the node
+	NodeUsage(userID string) (map[string]int, error)
+}
+
+//MemoryUsage is the usage source keeping the counts in memory. It is safe for concurrent use
+type MemoryUsage struct {
+	m      sync.RWMutex
+	counts map[string]map[string]int
+}
+
+//NewMemoryUsage returns a new in memory usage source
+func NewMemoryUsage() *MemoryUsage {
+	return &MemoryUsage{counts: map[string]map[string]int{}}
+}
+
+//Record records that the user has queried the nodes with the given uids
+func (m *MemoryUsage) Record(userID string, nodeUIDs ...string) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	c, ok := m.counts[userID]
+	if !ok {
+		c = map[string]int{}
+		m.counts[userID] = c
+	}
+	for _, u := range nodeUIDs {
+		c[u]++
+	}
+}
+
+//NodeUsage returns the no. of times the user has queried each node mapped to the uid of the node
+func (m *MemoryUsage) NodeUsage(userID string) (map[string]int, error) {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	result := make(map[string]int, len(m.counts[userID]))
+	for k, v := range m.counts[userID] {
+		result[k] = v
+	}
+	return result, nil
+}
+
+//ranker scores the nodes of the tokens merged for a user
+type ranker struct {
+	weights RankingWeights
+	now     time.Time
+	//updated has the time at which each dataset was last updated
+	updated map[string]time.Time
+	//usage has the no. of times the user has queried each node
+	usage map[string]int
+	//maxUsage is the usage of the user's most queried node
+	maxUsage int
+	//datasets has the dataset of each node
+	datasets map[interpreter.Node]string
+}
+
+//newRanker returns a ranker for the nodes with the given datasets, update times of the datasets and the user's usage
+func newRanker(weights RankingWeights, datasets map[interpreter.Node]string, updated map[string]time.Time, usage map[string]int) *ranker {
+	r := &ranker{weights: weights, now: time.Now(), updated: updated, usage: usage, datasets: datasets}
+	for _, v := range usage {
+		if v > r.maxUsage {
+			r.maxUsage = v
+		}
+	}
+	return r
+}
+
+//score returns the score of the node
+func (r *ranker) score(n interpreter.Node) float64 {
+	score := 0.0
+	if t, ok := r.updated[r.datasets[n]]; ok && r.weights.RecencyHalfLife > 0 {
+		age := r.now.Sub(t)
+		if age < 0 {
+			age = 0
+		}
+		score += r.weights.Recency * math.Exp2(-float64(age)/float64(r.weights.RecencyHalfLife))
+	}
+	if r.maxUsage > 0 {
+		score += r.weights.Frequency * float64(r.usage[NodeUID(n)]) / float64(r.maxUsage)
+	}
+	if c, ok := n.(*interpreter.ColumnNode); ok {
+		if c.Measure {
+			score += r.weights.Measure
+		}
+		if c.Dimension {
+			score += r.weights.Dimension
+		}
+	}
+	return score
+}
+
+//rank orders the nodes of the tokens having more than one node by their score.
+//Nodes with the same score keep their order
+func (r *ranker) rank(tokens map[string]interpreter.Token) {
+	for _, t := range tokens {
+		if len(t.Nodes) < 2 {
+			continue
+		}
+		scores := make(map[interpreter.Node]float64, len(t.Nodes))
+		for _, n := range t.Nodes {
+			scores[n] = r.score(n)
+		}
+		sort.SliceStable(t.Nodes, func(i, j int) bool {
+			return scores[t.Nodes[i]] > scores[t.Nodes[j]]
+		})
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+func TestRankByRecencyAndUsage(t *testing.T) {
+	old := &interpreter.ColumnNode{UID: "old-region", Word: []rune("region")}
+	recent := &interpreter.ColumnNode{UID: "recent-region", Word: []rune("region")}
+	tokens := map[string]interpreter.Token{"region": {Word: []rune("region"), Nodes: []interpreter.Node{old, recent}}}
+	nodeDatasets := map[interpreter.Node]string{old: "1", recent: "2"}
+	datasets := map[string]Dataset{
+		"1": {UpdatedAt: time.Now().Add(-time.Hour * 24 * 365)},
+		"2": {UpdatedAt: time.Now()},
+	}
+	//the recency is taken from the loaded datasets without reading the database
+	d := NewDAggWithCache(nil, nil, nil)
+	usage := NewMemoryUsage()
+	d.SetUsageSource(usage)
+
+	d.rank("user-1", tokens, nodeDatasets, datasets)
+	if tokens["region"].Nodes[0] != recent {
+		t.Fatalf("expected the node of the recently updated dataset first, got %+v", tokens["region"].Nodes[0])
+	}
+
+	//the user's usage outweighs the recency
+	usage.Record("user-1", old.UID)
+	d.rank("user-1", tokens, nodeDatasets, datasets)
+	if tokens["region"].Nodes[0] != old {
+		t.Errorf("expected the node queried by the user first, got %+v", tokens["region"].Nodes[0])
+	}
+	d.rank("user-2", tokens, nodeDatasets, datasets)
+	if tokens["region"].Nodes[0] != recent {
+		t.Errorf("expected the usage of another user to be ignored, got %+v", tokens["region"].Nodes[0])
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * This file contains the redis pub/sub implementation of the invalidation bus.
+ * It speaks the redis serialization protocol directly so that no client library is required.
+ */
+
+//RedisReconnectInterval is the interval after which a broken redis subscription is reconnected
+const RedisReconnectInterval = time.Second * 2
+
+//RedisInvalidationBus is the invalidation bus using the redis pub/sub. It can be used to share invalidations
+//between the dataset caches of multiple instances
+type RedisInvalidationBus struct {
+	addr     string
+	password string
+	channel  string
+	dialer   net.Dialer
+	//m guards the publishing connection
+	m   sync.Mutex
+	pub *redisConn
+}
+
+//NewRedisInvalidationBus returns a new redis invalidation bus connecting to the redis at the given address.
+//Password can be empty if the redis doesn't require authentication. Messages are published on the given channel
+func NewRedisInvalidationBus(addr, password, channel string) *RedisInvalidationBus {
+	return &RedisInvalidationBus{addr: addr, password: password, channel: channel}
+}
+
+//Publish publishes the message to the redis channel of the bus
+func (r *RedisInvalidationBus) Publish(ctx context.Context, msg InvalidationMessage) error {
+	/*
+	 * We will marshal the message
+	 * We will connect to the redis if not connected already
+	 * Then we will publish the message
+	 */
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.pub == nil {
+		r.pub, err = r.connect(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	//publishing the message. on failure the connection is dropped so that the next publish reconnects
+	if d, ok := ctx.Deadline(); ok {
+		r.pub.conn.SetDeadline(d)
+	} else {
+		r.pub.conn.SetDeadline(time.Time{})
+	}
+	_, err = r.pub.do("PUBLISH", r.channel, string(payload))
+	if err != nil {
+		r.pub.conn.Close()
+		r.pub = nil
+	}
+	return err
+}
+
+//Subscribe subscribes to the redis channel of the bus. If the subscription breaks, it will be reconnected
+//after RedisReconnectInterval till the subscription is cancelled. A message invalidating all the datasets is
+//received after each reconnect since the messages published in between are lost
+func (r *RedisInvalidationBus) Subscribe() (<-chan InvalidationMessage, func(), error) {
+	conn, err := r.subscribe()
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := make(chan InvalidationMessage, 64)
+	done := make(chan struct{})
+	var once sync.Once
+	var m sync.Mutex
+	cancel := func() {
+		once.Do(func() {
+			close(done)
+			m.Lock()
+			conn.conn.Close()
+			m.Unlock()
+		})
+	}
+	go func() {
+		defer close(ch)
+		for {
+			r.receive(conn, ch, done)
+			//the subscription broke. we will reconnect unless cancelled
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(RedisReconnectInterval):
+				}
+				c, err := r.subscribe()
+				if err != nil {
+					continue
+				}
+				m.Lock()
+				conn = c
+				m.Unlock()
+				break
+			}
+			select {
+			case <-done:
+				conn.conn.Close()
+				return
+			default:
+			}
+			//the messages published while the subscription was broken are lost. so all the datasets are invalidated
+			select {
+			case ch <- InvalidationMessage{All: true}:
+			case <-done:
+				conn.conn.Close()
+				return
+			}
+		}
+	}()
+	return ch, cancel, nil
+}
+
+//receive receives the messages from the subscribed connection till the connection breaks
+func (r *RedisInvalidationBus) receive(conn *redisConn, ch chan InvalidationMessage, done chan struct{}) {
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			conn.conn.Close()
+			return
+		}
+		//a pushed message is an array of message kind, channel and the payload
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		if kind, _ := parts[0].(string); kind != "message" {
+			continue
+		}
+		payload, _ := parts[2].(string)
+		msg := InvalidationMessage{}
+		if json.Unmarshal([]byte(payload), &msg) != nil {
+			continue
+		}
+		select {
+		case ch <- msg:
+		case <-done:
+			return
+		}
+	}
+}
+
+//subscribe opens a new connection to the redis and subscribes to the channel of the bus
+func (r *RedisInvalidationBus) subscribe() (*redisConn, error) {
+	c, err := r.connect(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.do("SUBSCRIBE", r.channel)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+//connect opens a new connection to the redis and authenticates if required
+func (r *RedisInvalidationBus) connect(ctx context.Context) (*redisConn, error) {
+	conn, err := r.dialer.DialContext(ctx, "tcp", r.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if len(r.password) > 0 {
+		if _, err := c.do("AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//redisConn is a connection to the redis
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+//errRedisProtocol is returned when the reply from the redis couldn't be understood
+var errRedisProtocol = errors.New("invalid reply from redis")
+
+//do sends the command to the redis and reads its reply
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	/*
+	 * Commands are sent as an array of bulk strings
+	 */
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, a...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+//read reads a reply from the redis. Errors replied by the redis are returned as error
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, fmt.Errorf("redis error: %s", line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		result := make([]interface{}, n)
+		for i := 0; i < n; i++ {
+			result[i], err = c.read()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	return nil, errRedisProtocol
+}
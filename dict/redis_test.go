@@ -0,0 +1,252 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeRedis is a local stand-in for the redis supporting the AUTH, SUBSCRIBE and PUBLISH commands
+type fakeRedis struct {
+	l        net.Listener
+	password string
+	m        sync.Mutex
+	subs     map[string][]net.Conn
+	conns    []net.Conn
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{l: l, password: password, subs: map[string][]net.Conn{}}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.l.Addr().String()
+}
+
+func (f *fakeRedis) close() {
+	f.l.Close()
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		f.m.Lock()
+		f.conns = append(f.conns, conn)
+		f.m.Unlock()
+		go f.handle(conn)
+	}
+}
+
+//handle reads the commands of the connection, which are sent as arrays of bulk strings, and replies to them
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	authed := len(f.password) == 0
+	for {
+		cmd, err := c.read()
+		if err != nil {
+			return
+		}
+		parts, _ := cmd.([]interface{})
+		args := make([]string, 0, len(parts))
+		for _, p := range parts {
+			s, _ := p.(string)
+			args = append(args, s)
+		}
+		if len(args) == 0 {
+			fmt.Fprint(conn, "-ERR empty command\r\n")
+			continue
+		}
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if len(args) != 2 || args[1] != f.password {
+				fmt.Fprint(conn, "-ERR invalid password\r\n")
+				continue
+			}
+			authed = true
+			fmt.Fprint(conn, "+OK\r\n")
+		case "SUBSCRIBE":
+			if !authed {
+				fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+				continue
+			}
+			f.m.Lock()
+			f.subs[args[1]] = append(f.subs[args[1]], conn)
+			f.m.Unlock()
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		case "PUBLISH":
+			if !authed {
+				fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+				continue
+			}
+			f.m.Lock()
+			subs := f.subs[args[1]]
+			for _, s := range subs {
+				fmt.Fprintf(s, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(args[2]), args[2])
+			}
+			f.m.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", len(subs))
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+//drop breaks all the connections to the fake redis
+func (f *fakeRedis) drop() {
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+	f.subs = map[string][]net.Conn{}
+}
+
+//subscribed waits till the channel has the given no. of subscribers on the fake redis
+func (f *fakeRedis) subscribed(channel string, n int) bool {
+	for i := 0; i < 500; i++ {
+		f.m.Lock()
+		l := len(f.subs[channel])
+		f.m.Unlock()
+		if l >= n {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return false
+}
+
+func TestRedisInvalidationBus(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	defer f.close()
+	b := NewRedisInvalidationBus(f.addr(), "secret", "invalidations")
+
+	ch, cancel, err := b.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if !f.subscribed("invalidations", 1) {
+		t.Fatal("the bus didn't subscribe to the channel")
+	}
+
+	ctx, done := context.WithTimeout(context.Background(), time.Second*5)
+	defer done()
+	msg := InvalidationMessage{Origin: "cache-1", DatasetID: "42"}
+	if err := b.Publish(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-ch:
+		if got != msg {
+			t.Errorf("expected %v, got %v", msg, got)
+		}
+	case <-ctx.Done():
+		t.Fatal("the published message wasn't received")
+	}
+
+	//the channel is closed once the subscription is cancelled
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("expected the channel to be closed after cancelling the subscription")
+		}
+	case <-ctx.Done():
+		t.Fatal("the channel wasn't closed after cancelling the subscription")
+	}
+}
+
+func TestRedisInvalidationBusFlushesAfterReconnect(t *testing.T) {
+	f := newFakeRedis(t, "")
+	defer f.close()
+	b := NewRedisInvalidationBus(f.addr(), "", "invalidations")
+
+	ch, cancel, err := b.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if !f.subscribed("invalidations", 1) {
+		t.Fatal("the bus didn't subscribe to the channel")
+	}
+	f.drop()
+	select {
+	case msg := <-ch:
+		if !msg.All {
+			t.Errorf("expected a message invalidating all the datasets after the reconnect, got %+v", msg)
+		}
+	case <-time.After(RedisReconnectInterval * 3):
+		t.Fatal("expected the subscription to be reconnected")
+	}
+	if !f.subscribed("invalidations", 1) {
+		t.Fatal("the bus didn't subscribe to the channel again")
+	}
+}
+
+func TestRedisInvalidationBusWrongPassword(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	defer f.close()
+	b := NewRedisInvalidationBus(f.addr(), "wrong", "invalidations")
+
+	if _, _, err := b.Subscribe(); err == nil {
+		t.Error("expected the subscription to fail with a wrong password")
+	}
+	ctx, done := context.WithTimeout(context.Background(), time.Second*5)
+	defer done()
+	if err := b.Publish(ctx, InvalidationMessage{DatasetID: "1"}); err == nil {
+		t.Error("expected the publish to fail with a wrong password")
+	}
+}
+
+func TestRedisConnRead(t *testing.T) {
+	cases := []struct {
+		reply    string
+		expected interface{}
+		err      bool
+	}{
+		{"+OK\r\n", "OK", false},
+		{":12\r\n", int64(12), false},
+		{"$5\r\nhello\r\n", "hello", false},
+		{"$-1\r\n", nil, false},
+		{"*2\r\n$1\r\na\r\n:1\r\n", []interface{}{"a", int64(1)}, false},
+		{"-ERR failed\r\n", nil, true},
+		{"?what\r\n", nil, true},
+		{"+OK\n", nil, true},
+	}
+	for _, c := range cases {
+		conn := &redisConn{r: bufio.NewReader(strings.NewReader(c.reply))}
+		got, err := conn.read()
+		if (err != nil) != c.err {
+			t.Errorf("%q: expected error %v, got %v", c.reply, c.err, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.expected) {
+			t.Errorf("%q: expected %v, got %v", c.reply, c.expected, got)
+		}
+	}
+}
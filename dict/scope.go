@@ -0,0 +1,112 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the dictionaries scoped to a chosen subset of the user's datasets
+ */
+
+//ErrDatasetAccessDenied is returned when the user doesn't have access to one of the datasets of a scoped dictionary
+var ErrDatasetAccessDenied = errors.New("user doesn't have access to the dataset")
+
+//scopeSeparator separates the user id from the dataset ids in the id of a scoped dictionary
+const scopeSeparator = "/"
+
+//ScopedDICTID returns the id of the user's dictionary scoped to the datasets. The id is the same irrespective of
+//the order or the duplicates of the dataset ids. It is to be used as the id of the scoped dictionary in the interpreter
+func ScopedDICTID(ID string, datasetIDs []uint) string {
+	ids := make([]string, 0, len(datasetIDs))
+	for _, v := range normaliseDatasetIDs(datasetIDs) {
+		ids = append(ids, strconv.Itoa(int(v)))
+	}
+	return ID + scopeSeparator + strings.Join(ids, ",")
+}
+
+//ParseScopedDICTID returns the user id and the dataset ids from the id of a scoped dictionary.
+//Returns false if the id is not of a scoped dictionary
+func ParseScopedDICTID(key string) (string, []uint, bool) {
+	parts := strings.SplitN(key, scopeSeparator, 2)
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	result := []uint{}
+	if len(parts[1]) == 0 {
+		return parts[0], result, true
+	}
+	for _, v := range strings.Split(parts[1], ",") {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return "", nil, false
+		}
+		result = append(result, uint(id))
+	}
+	return parts[0], result, true
+}
+
+//normaliseDatasetIDs returns the sorted dataset ids without the duplicates
+func normaliseDatasetIDs(datasetIDs []uint) []uint {
+	result := make([]uint, 0, len(datasetIDs))
+	seen := map[uint]struct{}{}
+	for _, v := range datasetIDs {
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return result
+}
+
+//GetScoped returns the user dictionary containing only the given datasets and the system dict.
+//ErrDatasetAccessDenied is returned if the user doesn't have access to any of the datasets.
+//The dictionary is subscribed to the updates of its datasets with the id given by ScopedDICTID.
+//The id can be a LocaleDICTID for the scoped dictionary of the user in that locale
+func (d DAgg) GetScoped(ctx context.Context, ID string, datasetIDs []uint, update bool) (interpreter.DICT, error) {
+	/*
+	 * We will convert the id to integer
+	 * We will verify the user's access to the datasets
+	 * Then we will build the dictionary from those datasets and the system dict
+	 */
+	result := interpreter.DICT{Map: map[string]interpreter.Token{}}
+	//parsing the user id
+	uID, ctx := userLocale(ctx, ID)
+	id, err := strconv.Atoi(uID)
+	if err != nil {
+		d.l.Error("error while parsing the id from string to integer", ID)
+		return result, err
+	}
+
+	//verifying the access
+	datasetIDs = normaliseDatasetIDs(datasetIDs)
+	ok, err := models.HasUserAccess(d.l, d.db, datasetIDs, uint(id))
+	if err != nil {
+		d.l.Error("error while verifying the access of the user to the datasets", ID, datasetIDs)
+		return result, err
+	}
+	if !ok {
+		return result, ErrDatasetAccessDenied
+	}
+
+	//building the dictionary
+	dIDs := make([]string, 0, len(datasetIDs))
+	for _, v := range datasetIDs {
+		dIDs = append(dIDs, strconv.Itoa(int(v)))
+	}
+	return d.build(ctx, ScopedDICTID(ID, datasetIDs), uID, dIDs, update)
+}
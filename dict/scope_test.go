@@ -0,0 +1,78 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/brain/log"
+)
+
+func TestScopedDICTID(t *testing.T) {
+	a := ScopedDICTID("7", []uint{2, 1, 2})
+	if a != "7/1,2" {
+		t.Errorf("unexpected scoped dictionary id %s", a)
+	}
+	if b := ScopedDICTID("7", []uint{1, 2}); b != a {
+		t.Errorf("expected the same id irrespective of the order and the duplicates, got %s and %s", a, b)
+	}
+	ID, datasetIDs, ok := ParseScopedDICTID(a)
+	if !ok || ID != "7" || !reflect.DeepEqual(datasetIDs, []uint{1, 2}) {
+		t.Errorf("expected the user 7 and the datasets [1 2], got %s %v %t", ID, datasetIDs, ok)
+	}
+	if ID, datasetIDs, ok := ParseScopedDICTID(ScopedDICTID("7", nil)); !ok || ID != "7" || len(datasetIDs) != 0 {
+		t.Errorf("expected the user 7 without datasets, got %s %v %t", ID, datasetIDs, ok)
+	}
+	for _, key := range []string{"7", "7/1,a"} {
+		if _, _, ok := ParseScopedDICTID(key); ok {
+			t.Errorf("expected %s not to be taken for a scoped dictionary id", key)
+		}
+	}
+}
+
+func TestGetScopedVerifiesTheAccess(t *testing.T) {
+	c := startCache(newFakeAggregator(), DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	//the user has access to no datasets
+	db, driver := openFakeDB(t)
+	defer db.Close()
+	driver.column = "dataset_id"
+	d := NewDAggWithCache(db, log.NewLogger(), c)
+	if _, err := d.GetScoped(ctx, "7", []uint{1}, false); err != ErrDatasetAccessDenied {
+		t.Errorf("expected the access to be denied, got %v", err)
+	}
+	if subs, _ := c.Subscribers(ctx, "1"); len(subs) != 0 {
+		t.Errorf("expected no subscriptions once the access is denied, got %v", subs)
+	}
+	if _, err := d.GetScoped(ctx, "user", []uint{1}, false); err == nil {
+		t.Error("expected an error for an id that isn't a user id")
+	}
+
+	//the user has access to the datasets 1 and 2
+	driver.values = []interface{}{int64(1), int64(2)}
+	dict, err := d.GetScoped(ctx, "7", []uint{2, 1, 2}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"column 1", "column 2"} {
+		if _, ok := dict.Map[k]; !ok {
+			t.Errorf("expected %s in the scoped dictionary", k)
+		}
+	}
+	if _, err := d.GetScoped(ctx, "7", []uint{1, 3}, false); err != ErrDatasetAccessDenied {
+		t.Errorf("expected the access to be denied when one of the datasets isn't shared, got %v", err)
+	}
+	for _, dID := range []string{"1", "2"} {
+		if subs, _ := c.Subscribers(ctx, dID); !reflect.DeepEqual(subs, []string{ScopedDICTID("7", []uint{1, 2})}) {
+			t.Errorf("expected the scoped dictionary to be subscribed to the dataset %s, got %v", dID, subs)
+		}
+	}
+}
@@ -0,0 +1,648 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the snapshots of the datasets written to a local directory for the warm starts of the cache.
+ *
+ * A snapshot is written in the following binary format. Integers are varint encoded and strings are length prefixed
+ *	magic "BDSS", version
+ *	dataset id, has updated at, updated at in unix nano
+ *	no. of nodes, kind of each node, body of each node
+ *	no. of tokens, key, word and the references of the nodes of each token
+ *	crc32 checksum of all the above bytes in big endian
+ * The nodes are written once in a table and are referred by their index in the table so that the pointers shared
+ * between the nodes, like a value node and its column, are restored as such.
+ */
+
+//SnapshotVersion is the version of the snapshot format written by the cache
+const SnapshotVersion = 1
+
+//snapshotMagic is the magic bytes at the start of a snapshot
+const snapshotMagic = "BDSS"
+
+//snapshotExt is the extension of the snapshot files
+const snapshotExt = ".snap"
+
+//maxSnapshotLength is the maximum length of a string or a list in a snapshot. It guards against corrupt lengths
+const maxSnapshotLength = 1 << 26
+
+var (
+	//ErrSnapshotVersion is returned when the snapshot is of a version not supported
+	ErrSnapshotVersion = errors.New("snapshot version is not supported")
+	//ErrSnapshotCorrupt is returned when the snapshot couldn't be decoded
+	ErrSnapshotCorrupt = errors.New("snapshot is corrupt")
+)
+
+//DatasetVersioner gives the latest update time of the datasets. It is used by the cache to discard the stale snapshots
+type DatasetVersioner interface {
+	//DatasetsUpdatedAt returns the update time of the datasets mapped to their ids. The datasets not existing are omitted
+	DatasetsUpdatedAt(IDs []string) (map[string]time.Time, error)
+}
+
+//Snapshot is the snapshot of a dataset
+type Snapshot struct {
+	//ID is the id of the dataset
+	ID string
+	//Dataset is the dataset. Its UpdatedAt is used to validate the snapshot
+	Dataset Dataset
+}
+
+//node kinds in a snapshot
+const (
+	snapshotColumn byte = iota + 1
+	snapshotTable
+	snapshotKnowledgeBase
+	snapshotOperator
+	snapshotValue
+)
+
+//snapshotWriter writes the primitives of a snapshot. The first error is kept and the later writes are skipped
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+	err error
+	//refs has the index of the nodes in the node table
+	refs map[interpreter.Node]int
+	//nodes is the node table
+	nodes []interpreter.Node
+}
+
+func (s *snapshotWriter) bytes(b []byte) {
+	if s.err != nil {
+		return
+	}
+	s.crc.Write(b)
+	_, s.err = s.w.Write(b)
+}
+
+func (s *snapshotWriter) uint(v uint64) {
+	s.bytes(s.buf[:binary.PutUvarint(s.buf[:], v)])
+}
+
+func (s *snapshotWriter) int(v int64) {
+	s.bytes(s.buf[:binary.PutVarint(s.buf[:], v)])
+}
+
+func (s *snapshotWriter) bool(v bool) {
+	if v {
+		s.uint(1)
+		return
+	}
+	s.uint(0)
+}
+
+func (s *snapshotWriter) string(v string) {
+	s.uint(uint64(len(v)))
+	s.bytes([]byte(v))
+}
+
+func (s *snapshotWriter) runes(v []rune) {
+	s.string(string(v))
+}
+
+//ref writes the reference of the node. Zero refers to nil
+func (s *snapshotWriter) ref(n interpreter.Node) {
+	if n == nil {
+		s.uint(0)
+		return
+	}
+	s.uint(uint64(s.refs[n] + 1))
+}
+
+//register adds the node and the nodes it points to, to the node table
+func (s *snapshotWriter) register(n interpreter.Node) {
+	if n == nil {
+		return
+	}
+	if _, ok := s.refs[n]; ok {
+		return
+	}
+	s.refs[n] = len(s.nodes)
+	s.nodes = append(s.nodes, n)
+	switch v := n.(type) {
+	case *interpreter.ColumnNode:
+		s.registerColumn(*v)
+	case *interpreter.TableNode:
+		if v.DefaultDateField != nil {
+			s.register(v.DefaultDateField)
+		}
+		for _, c := range v.Children {
+			s.registerColumn(c)
+		}
+	case *interpreter.KnowledgeBaseNode:
+		for _, c := range v.Children {
+			s.register(c)
+		}
+	case *interpreter.OperatorNode:
+		s.register(v.PN)
+	case *interpreter.ValueNode:
+		if v.PN != nil {
+			s.register(v.PN)
+		}
+	}
+}
+
+//registerColumn registers the nodes the column points to
+func (s *snapshotWriter) registerColumn(c interpreter.ColumnNode) {
+	if c.PN != nil {
+		s.register(c.PN)
+	}
+	for _, v := range c.Children {
+		if v.PN != nil {
+			s.register(v.PN)
+		}
+	}
+}
+
+//node writes the body of the node
+func (s *snapshotWriter) node(n interpreter.Node) {
+	switch v := n.(type) {
+	case *interpreter.ColumnNode:
+		s.column(*v)
+	case *interpreter.TableNode:
+		s.string(v.UID)
+		s.runes(v.Word)
+		s.string(v.PUID)
+		s.string(v.Name)
+		s.string(v.DefaultDateFieldUID)
+		s.string(v.Description)
+		s.uint(uint64(v.DatastoreID))
+		if v.DefaultDateField != nil {
+			s.ref(v.DefaultDateField)
+		} else {
+			s.ref(nil)
+		}
+		s.uint(uint64(len(v.Children)))
+		for _, c := range v.Children {
+			s.column(c)
+		}
+	case *interpreter.KnowledgeBaseNode:
+		s.string(v.UID)
+		s.runes(v.Word)
+		s.string(v.Name)
+		s.string(v.Description)
+		s.uint(uint64(v.KBType))
+		s.uint(uint64(len(v.Children)))
+		for _, c := range v.Children {
+			s.ref(c)
+		}
+	case *interpreter.OperatorNode:
+		s.string(v.UID)
+		s.runes(v.Word)
+		s.string(v.PUID)
+		s.string(v.Operation)
+		s.ref(v.PN)
+	case *interpreter.ValueNode:
+		s.value(*v)
+	}
+}
+
+func (s *snapshotWriter) column(c interpreter.ColumnNode) {
+	s.string(c.UID)
+	s.runes(c.Word)
+	s.string(c.PUID)
+	s.string(c.Name)
+	s.bool(c.Dimension)
+	s.bool(c.Measure)
+	s.string(c.AggregationFn)
+	s.string(c.DataType)
+	s.string(c.Description)
+	s.string(c.DateFormat)
+	if c.PN != nil {
+		s.ref(c.PN)
+	} else {
+		s.ref(nil)
+	}
+	s.uint(uint64(len(c.Children)))
+	for _, v := range c.Children {
+		s.value(v)
+	}
+}
+
+func (s *snapshotWriter) value(v interpreter.ValueNode) {
+	s.string(v.UID)
+	s.runes(v.Word)
+	s.string(v.PUID)
+	s.string(v.Name)
+	if v.PN != nil {
+		s.ref(v.PN)
+	} else {
+		s.ref(nil)
+	}
+}
+
+//kind returns the kind of the node in the snapshot. Returns false if the node can't be written to a snapshot
+func kind(n interpreter.Node) (byte, bool) {
+	switch n.(type) {
+	case *interpreter.ColumnNode:
+		return snapshotColumn, true
+	case *interpreter.TableNode:
+		return snapshotTable, true
+	case *interpreter.KnowledgeBaseNode:
+		return snapshotKnowledgeBase, true
+	case *interpreter.OperatorNode:
+		return snapshotOperator, true
+	case *interpreter.ValueNode:
+		return snapshotValue, true
+	}
+	return 0, false
+}
+
+//WriteSnapshot writes the snapshot of the dataset to the writer. Nodes of types unknown to the snapshot format are skipped
+func WriteSnapshot(w io.Writer, snap Snapshot) error {
+	/*
+	 * We will write the header
+	 * Then we will build and write the node table
+	 * Then we will write the tokens
+	 * Finally we will write the checksum
+	 */
+	s := &snapshotWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE(), refs: map[interpreter.Node]int{}}
+	//writing the header
+	s.bytes([]byte(snapshotMagic))
+	s.uint(SnapshotVersion)
+	s.string(snap.ID)
+	s.bool(!snap.Dataset.UpdatedAt.IsZero())
+	if !snap.Dataset.UpdatedAt.IsZero() {
+		s.int(snap.Dataset.UpdatedAt.UnixNano())
+	}
+
+	//building and writing the node table
+	for _, t := range snap.Dataset.D {
+		for _, n := range t.Nodes {
+			if _, ok := kind(n); ok {
+				s.register(n)
+			}
+		}
+	}
+	s.uint(uint64(len(s.nodes)))
+	for _, n := range s.nodes {
+		k, _ := kind(n)
+		s.bytes([]byte{k})
+	}
+	for _, n := range s.nodes {
+		s.node(n)
+	}
+
+	//writing the tokens
+	s.uint(uint64(len(snap.Dataset.D)))
+	for k, t := range snap.Dataset.D {
+		s.string(k)
+		s.runes(t.Word)
+		nodes := make([]interpreter.Node, 0, len(t.Nodes))
+		for _, n := range t.Nodes {
+			if _, ok := kind(n); ok {
+				nodes = append(nodes, n)
+			}
+		}
+		s.uint(uint64(len(nodes)))
+		for _, n := range nodes {
+			s.ref(n)
+		}
+	}
+
+	//writing the checksum
+	if s.err != nil {
+		return s.err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], s.crc.Sum32())
+	if _, err := s.w.Write(sum[:]); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+//snapshotReader reads the primitives of a snapshot. The first error is kept and the later reads return zero values
+type snapshotReader struct {
+	r     *bufio.Reader
+	crc   hash.Hash32
+	err   error
+	nodes []interpreter.Node
+}
+
+//ReadByte reads a byte updating the checksum
+func (s *snapshotReader) ReadByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (s *snapshotReader) fail(err error) {
+	if s.err != nil {
+		return
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	s.err = err
+}
+
+func (s *snapshotReader) bytes(n uint64) []byte {
+	if s.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		s.fail(err)
+		return nil
+	}
+	s.crc.Write(b)
+	return b
+}
+
+func (s *snapshotReader) uint() uint64 {
+	if s.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(s)
+	s.fail(err)
+	return v
+}
+
+func (s *snapshotReader) int() int64 {
+	if s.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(s)
+	s.fail(err)
+	return v
+}
+
+func (s *snapshotReader) bool() bool {
+	return s.uint() == 1
+}
+
+//length reads the length of a string or a list
+func (s *snapshotReader) length() uint64 {
+	n := s.uint()
+	if n > maxSnapshotLength {
+		s.fail(ErrSnapshotCorrupt)
+		return 0
+	}
+	return n
+}
+
+func (s *snapshotReader) string() string {
+	return string(s.bytes(s.length()))
+}
+
+func (s *snapshotReader) runes() []rune {
+	return []rune(s.string())
+}
+
+//ref reads the reference of a node
+func (s *snapshotReader) ref() interpreter.Node {
+	i := s.uint()
+	if i == 0 || s.err != nil {
+		return nil
+	}
+	if i > uint64(len(s.nodes)) {
+		s.fail(ErrSnapshotCorrupt)
+		return nil
+	}
+	return s.nodes[i-1]
+}
+
+//tableRef reads the reference of a table node
+func (s *snapshotReader) tableRef() *interpreter.TableNode {
+	n := s.ref()
+	if n == nil {
+		return nil
+	}
+	t, ok := n.(*interpreter.TableNode)
+	if !ok {
+		s.fail(ErrSnapshotCorrupt)
+	}
+	return t
+}
+
+//columnRef reads the reference of a column node
+func (s *snapshotReader) columnRef() *interpreter.ColumnNode {
+	n := s.ref()
+	if n == nil {
+		return nil
+	}
+	c, ok := n.(*interpreter.ColumnNode)
+	if !ok {
+		s.fail(ErrSnapshotCorrupt)
+	}
+	return c
+}
+
+//node reads the body of the node
+func (s *snapshotReader) node(n interpreter.Node) {
+	switch v := n.(type) {
+	case *interpreter.ColumnNode:
+		*v = s.column()
+	case *interpreter.TableNode:
+		v.UID = s.string()
+		v.Word = s.runes()
+		v.PUID = s.string()
+		v.Name = s.string()
+		v.DefaultDateFieldUID = s.string()
+		v.Description = s.string()
+		v.DatastoreID = uint(s.uint())
+		v.DefaultDateField = s.columnRef()
+		v.Children = make([]interpreter.ColumnNode, s.length())
+		for i := range v.Children {
+			v.Children[i] = s.column()
+		}
+	case *interpreter.KnowledgeBaseNode:
+		v.UID = s.string()
+		v.Word = s.runes()
+		v.Name = s.string()
+		v.Description = s.string()
+		v.KBType = interpreter.KBType(s.uint())
+		v.Children = make([]interpreter.Node, s.length())
+		for i := range v.Children {
+			v.Children[i] = s.ref()
+		}
+	case *interpreter.OperatorNode:
+		v.UID = s.string()
+		v.Word = s.runes()
+		v.PUID = s.string()
+		v.Operation = s.string()
+		v.PN = s.ref()
+	case *interpreter.ValueNode:
+		*v = s.value()
+	}
+}
+
+func (s *snapshotReader) column() interpreter.ColumnNode {
+	c := interpreter.ColumnNode{}
+	c.UID = s.string()
+	c.Word = s.runes()
+	c.PUID = s.string()
+	c.Name = s.string()
+	c.Dimension = s.bool()
+	c.Measure = s.bool()
+	c.AggregationFn = s.string()
+	c.DataType = s.string()
+	c.Description = s.string()
+	c.DateFormat = s.string()
+	c.PN = s.tableRef()
+	c.Children = make([]interpreter.ValueNode, s.length())
+	for i := range c.Children {
+		c.Children[i] = s.value()
+	}
+	return c
+}
+
+func (s *snapshotReader) value() interpreter.ValueNode {
+	v := interpreter.ValueNode{}
+	v.UID = s.string()
+	v.Word = s.runes()
+	v.PUID = s.string()
+	v.Name = s.string()
+	v.PN = s.columnRef()
+	return v
+}
+
+//ReadSnapshot reads a snapshot of a dataset from the reader
+func ReadSnapshot(r io.Reader) (Snapshot, error) {
+	/*
+	 * We will read and validate the header
+	 * Then we will read the node table
+	 * Then we will read the tokens
+	 * Finally we will verify the checksum
+	 */
+	result := Snapshot{Dataset: Dataset{D: map[string]interpreter.Token{}}}
+	s := &snapshotReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	//reading the header
+	if string(s.bytes(uint64(len(snapshotMagic)))) != snapshotMagic {
+		if s.err != nil {
+			return result, s.err
+		}
+		return result, ErrSnapshotCorrupt
+	}
+	if v := s.uint(); s.err == nil && v != SnapshotVersion {
+		return result, ErrSnapshotVersion
+	}
+	result.ID = s.string()
+	if s.bool() {
+		result.Dataset.UpdatedAt = time.Unix(0, s.int())
+	}
+
+	//reading the node table. the nodes are allocated first so that the references can be resolved while reading the bodies
+	s.nodes = make([]interpreter.Node, s.length())
+	for i := range s.nodes {
+		b := s.bytes(1)
+		if s.err != nil {
+			return result, s.err
+		}
+		switch b[0] {
+		case snapshotColumn:
+			s.nodes[i] = &interpreter.ColumnNode{}
+		case snapshotTable:
+			s.nodes[i] = &interpreter.TableNode{}
+		case snapshotKnowledgeBase:
+			s.nodes[i] = &interpreter.KnowledgeBaseNode{}
+		case snapshotOperator:
+			s.nodes[i] = &interpreter.OperatorNode{}
+		case snapshotValue:
+			s.nodes[i] = &interpreter.ValueNode{}
+		default:
+			return result, ErrSnapshotCorrupt
+		}
+	}
+	for _, n := range s.nodes {
+		s.node(n)
+	}
+
+	//reading the tokens
+	count := s.length()
+	for i := uint64(0); i < count && s.err == nil; i++ {
+		k := s.string()
+		t := interpreter.Token{Word: s.runes(), Nodes: make([]interpreter.Node, s.length())}
+		for j := range t.Nodes {
+			t.Nodes[j] = s.ref()
+		}
+		result.Dataset.D[k] = t
+	}
+	if s.err != nil {
+		return result, s.err
+	}
+
+	//verifying the checksum
+	sum := s.crc.Sum32()
+	var b [4]byte
+	if _, err := io.ReadFull(s.r, b[:]); err != nil || binary.BigEndian.Uint32(b[:]) != sum {
+		return result, ErrSnapshotCorrupt
+	}
+	return result, nil
+}
+
+//snapshotPath returns the path of the snapshot file of the dataset in the directory
+func snapshotPath(dir, ID string) string {
+	return filepath.Join(dir, url.PathEscape(ID)+snapshotExt)
+}
+
+//writeSnapshotFile writes the snapshot of the dataset to its file in the directory.
+//The snapshot is written to a temporary file first and renamed so that a partial snapshot is never read
+func writeSnapshotFile(dir string, snap Snapshot) error {
+	f, err := ioutil.TempFile(dir, "."+url.PathEscape(snap.ID)+"-*"+snapshotExt)
+	if err != nil {
+		return err
+	}
+	err = WriteSnapshot(f, snap)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), snapshotPath(dir, snap.ID))
+}
+
+//readSnapshotFiles reads the snapshots in the directory. The files which couldn't be read are returned separately
+func readSnapshotFiles(dir string) ([]Snapshot, []string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	snaps := []Snapshot{}
+	invalid := []string{}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || filepath.Ext(f.Name()) != snapshotExt {
+			continue
+		}
+		p := filepath.Join(dir, f.Name())
+		file, err := os.Open(p)
+		if err != nil {
+			invalid = append(invalid, p)
+			continue
+		}
+		snap, err := ReadSnapshot(file)
+		file.Close()
+		if err != nil || snapshotPath(dir, snap.ID) != p {
+			invalid = append(invalid, p)
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, invalid, nil
+}
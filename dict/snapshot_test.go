@@ -0,0 +1,234 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/brain/log"
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+//snapshotDataset returns a dataset having a table, a column of the table and a value of the column
+func snapshotDataset(updatedAt time.Time) Dataset {
+	table := &interpreter.TableNode{UID: "table", Word: []rune("sales"), Name: "sales", DatastoreID: 3}
+	column := &interpreter.ColumnNode{UID: "column", Word: []rune("region"), PUID: "table", Name: "region", Dimension: true, DataType: "string", PN: table}
+	value := &interpreter.ValueNode{UID: "value", Word: []rune("north"), PUID: "column", Name: "north", PN: column}
+	return Dataset{
+		UpdatedAt: updatedAt,
+		D: map[string]interpreter.Token{
+			"sales":  {Word: table.Word, Nodes: []interpreter.Node{table}},
+			"region": {Word: column.Word, Nodes: []interpreter.Node{column}},
+			"north":  {Word: value.Word, Nodes: []interpreter.Node{value}},
+		},
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	updatedAt := time.Unix(0, 1571270400123456789)
+	buf := &bytes.Buffer{}
+	if err := WriteSnapshot(buf, Snapshot{ID: "7", Dataset: snapshotDataset(updatedAt)}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := ReadSnapshot(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.ID != "7" {
+		t.Errorf("expected the id 7, got %s", snap.ID)
+	}
+	if !snap.Dataset.UpdatedAt.Equal(updatedAt) {
+		t.Errorf("expected the update time %v, got %v", updatedAt, snap.Dataset.UpdatedAt)
+	}
+	if len(snap.Dataset.D) != 3 {
+		t.Fatalf("expected 3 tokens, got %d", len(snap.Dataset.D))
+	}
+	value, ok := snap.Dataset.D["north"].Nodes[0].(*interpreter.ValueNode)
+	if !ok || value.UID != "value" || string(value.Word) != "north" {
+		t.Fatalf("expected the value node, got %#v", snap.Dataset.D["north"].Nodes[0])
+	}
+	column, ok := snap.Dataset.D["region"].Nodes[0].(*interpreter.ColumnNode)
+	if !ok || column.UID != "column" || !column.Dimension || column.DataType != "string" {
+		t.Fatalf("expected the column node, got %#v", snap.Dataset.D["region"].Nodes[0])
+	}
+	table, ok := snap.Dataset.D["sales"].Nodes[0].(*interpreter.TableNode)
+	if !ok || table.UID != "table" || table.DatastoreID != 3 {
+		t.Fatalf("expected the table node, got %#v", snap.Dataset.D["sales"].Nodes[0])
+	}
+	//the pointers shared between the nodes are restored as such
+	if value.PN != column {
+		t.Error("expected the value to point to the restored column")
+	}
+	if column.PN != table {
+		t.Error("expected the column to point to the restored table")
+	}
+}
+
+func TestSnapshotCorruption(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := WriteSnapshot(buf, Snapshot{ID: "7", Dataset: snapshotDataset(time.Now())}); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+
+	flipped := append([]byte{}, valid...)
+	flipped[len(flipped)/2] ^= 0xff
+	badMagic := append([]byte{}, valid...)
+	badMagic[0] = 'X'
+	badVersion := append([]byte{}, valid...)
+	badVersion[len(snapshotMagic)] = SnapshotVersion + 1
+
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"flipped byte", flipped, nil},
+		{"truncated", valid[:len(valid)-10], nil},
+		{"missing checksum", valid[:len(valid)-4], ErrSnapshotCorrupt},
+		{"bad magic", badMagic, ErrSnapshotCorrupt},
+		{"bad version", badVersion, ErrSnapshotVersion},
+		{"empty", []byte{}, nil},
+	}
+	for _, c := range cases {
+		_, err := ReadSnapshot(bytes.NewReader(c.data))
+		if err == nil {
+			t.Errorf("%s: expected the snapshot to be rejected", c.name)
+			continue
+		}
+		if c.err != nil && err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+//versionedAggregator is the fake aggregator giving the update time of the datasets
+type versionedAggregator struct {
+	*fakeAggregator
+	versions map[string]time.Time
+}
+
+func (v versionedAggregator) DatasetsUpdatedAt(IDs []string) (map[string]time.Time, error) {
+	result := map[string]time.Time{}
+	for _, ID := range IDs {
+		if t, ok := v.versions[ID]; ok {
+			result[ID] = t
+		}
+	}
+	return result, nil
+}
+
+func TestRestoreDiscardsStaleAndCorruptSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	snapshotAt := time.Now().Add(-time.Hour)
+	for _, ID := range []string{"fresh", "stale", "deleted"} {
+		if err := writeSnapshotFile(dir, Snapshot{ID: ID, Dataset: snapshotDataset(snapshotAt)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(snapshotPath(dir, "corrupt"), []byte("BDSS garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	//the stale dataset was touched after its snapshot was taken
+	agg := versionedAggregator{fakeAggregator: newFakeAggregator(), versions: map[string]time.Time{
+		"fresh":   snapshotAt,
+		"stale":   snapshotAt.Add(time.Second),
+		"corrupt": snapshotAt,
+	}}
+	conf := DefaultDatasetCacheConfig()
+	conf.SnapshotDir = dir
+	c := startCache(agg, conf)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for _, ID := range []string{"fresh", "stale"} {
+		if _, err := c.Get(ctx, ID, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := agg.count("fresh"); n != 0 {
+		t.Errorf("expected the fresh dataset to be restored from its snapshot, got %d loads", n)
+	}
+	if n := agg.count("stale"); n != 1 {
+		t.Errorf("expected the stale dataset to be loaded again, got %d loads", n)
+	}
+	for _, ID := range []string{"stale", "deleted", "corrupt"} {
+		if _, err := os.Stat(snapshotPath(dir, ID)); !os.IsNotExist(err) {
+			t.Errorf("expected the snapshot of %s to be removed", ID)
+		}
+	}
+	if _, err := os.Stat(snapshotPath(dir, "fresh")); err != nil {
+		t.Errorf("expected the snapshot of the fresh dataset to be kept, got %v", err)
+	}
+}
+
+func TestUpdateNodeMetadataCommitsWithTheUpdateTime(t *testing.T) {
+	db, driver := openFakeDB(t)
+	defer db.Close()
+	driver.affected = 1
+	m := models.NodeMetadata{Prop: models.NodeMetadataPropName, Value: "region", DatasetID: 4}
+	m.ID = 7
+
+	if err := models.UpdateNodeMetadata(log.NewLogger(), db, []models.NodeMetadata{m, m}); err != nil {
+		t.Fatal(err)
+	}
+	//the metadata and the update time of their dataset are saved together in a committed transaction
+	statements := driver.executed()
+	if len(statements) != 5 || statements[0] != "BEGIN" || statements[4] != "COMMIT" {
+		t.Fatalf("expected the updates to be committed in a transaction, got %v", statements)
+	}
+	for _, s := range statements[1:3] {
+		if !strings.HasPrefix(s, `UPDATE "node_metadata"`) {
+			t.Errorf("expected the metadata to be updated, got %s", s)
+		}
+	}
+	if !strings.HasPrefix(statements[3], `UPDATE "datasets" SET "updated_at"`) {
+		t.Errorf("expected the update time of the dataset to be bumped once, got %s", statements[3])
+	}
+}
+
+//snapshotNodeFields has the fields of the interpreter nodes written by the snapshot codec. A field added to the nodes
+//has to be written and read by the codec, with a bump of SnapshotVersion, before it is added here
+var snapshotNodeFields = map[reflect.Type][]string{
+	reflect.TypeOf(interpreter.ColumnNode{}):        {"UID", "Word", "PUID", "Name", "Dimension", "Measure", "AggregationFn", "DataType", "Description", "DateFormat", "PN", "Children"},
+	reflect.TypeOf(interpreter.TableNode{}):         {"UID", "Word", "PUID", "Name", "DefaultDateFieldUID", "Description", "DatastoreID", "DefaultDateField", "Children"},
+	reflect.TypeOf(interpreter.KnowledgeBaseNode{}): {"UID", "Word", "Name", "Description", "KBType", "Children"},
+	reflect.TypeOf(interpreter.OperatorNode{}):      {"UID", "Word", "PUID", "Operation", "PN"},
+	reflect.TypeOf(interpreter.ValueNode{}):         {"UID", "Word", "PUID", "Name", "PN"},
+}
+
+func TestSnapshotCodecCoversTheNodeFields(t *testing.T) {
+	for typ, fields := range snapshotNodeFields {
+		written := map[string]struct{}{}
+		for _, f := range fields {
+			written[f] = struct{}{}
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if _, ok := written[f.Name]; !ok {
+				t.Errorf("the field %s of %s is not written by the snapshot codec", f.Name, typ.Name())
+			}
+			delete(written, f.Name)
+		}
+		for f := range written {
+			t.Errorf("the field %s written by the snapshot codec is no longer in %s", f, typ.Name())
+		}
+	}
+}
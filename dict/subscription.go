@@ -0,0 +1,88 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import "sort"
+
+/*
+ * This file contains the registry of the ids subscribed to the datasets in the cache
+ */
+
+//subscriptions is the registry of the ids subscribed to the datasets. A subscriber is subscribed to a dataset only once.
+//It is not safe for concurrent use and is to be owned by the cache go routine.
+type subscriptions struct {
+	//byDataset has the subscribers of each dataset
+	byDataset map[string]map[string]struct{}
+	//bySubscriber has the datasets subscribed by each subscriber
+	bySubscriber map[string]map[string]struct{}
+}
+
+//newSubscriptions returns a new subscription registry
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		byDataset:    map[string]map[string]struct{}{},
+		bySubscriber: map[string]map[string]struct{}{},
+	}
+}
+
+//add subscribes the subscriber to the dataset
+func (s *subscriptions) add(datasetID, subscriberID string) {
+	addToSet(s.byDataset, datasetID, subscriberID)
+	addToSet(s.bySubscriber, subscriberID, datasetID)
+}
+
+//remove unsubscribes the subscriber from the dataset. Returns false if it wasn't subscribed
+func (s *subscriptions) remove(datasetID, subscriberID string) bool {
+	if _, ok := s.byDataset[datasetID][subscriberID]; !ok {
+		return false
+	}
+	removeFromSet(s.byDataset, datasetID, subscriberID)
+	removeFromSet(s.bySubscriber, subscriberID, datasetID)
+	return true
+}
+
+//subscribers returns the sorted list of subscribers of the dataset
+func (s *subscriptions) subscribers(datasetID string) []string {
+	return sortedSet(s.byDataset[datasetID])
+}
+
+//datasets returns the sorted list of datasets subscribed by the subscriber
+func (s *subscriptions) datasets(subscriberID string) []string {
+	return sortedSet(s.bySubscriber[subscriberID])
+}
+
+//count returns the no. of subscribers of the dataset
+func (s *subscriptions) count(datasetID string) int {
+	return len(s.byDataset[datasetID])
+}
+
+func addToSet(m map[string]map[string]struct{}, k, v string) {
+	set, ok := m[k]
+	if !ok {
+		set = map[string]struct{}{}
+		m[k] = set
+	}
+	set[v] = struct{}{}
+}
+
+func removeFromSet(m map[string]map[string]struct{}, k, v string) {
+	set, ok := m[k]
+	if !ok {
+		return
+	}
+	delete(set, v)
+	if len(set) == 0 {
+		delete(m, k)
+	}
+}
+
+func sortedSet(set map[string]struct{}) []string {
+	result := make([]string, 0, len(set))
+	for k := range set {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
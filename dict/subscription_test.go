@@ -0,0 +1,114 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/brain/log"
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+func TestSubscriptionsAreSets(t *testing.T) {
+	c := startCache(newFakeAggregator(), DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	for _, s := range []string{"user-2", "user-1", "user-1"} {
+		if _, err := c.Get(ctx, "1", s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.GetMany(ctx, []string{"1", "2"}, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	subs, err := c.Subscribers(ctx, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(subs, []string{"user-1", "user-2"}) {
+		t.Errorf("expected each subscriber once, got %v", subs)
+	}
+
+	if err := c.Unsubscribe("1", "user-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SyncSubscriptions("user-1", []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+	if subs, _ := c.Subscribers(ctx, "1"); len(subs) != 0 {
+		t.Errorf("expected no subscribers of the dataset 1, got %v", subs)
+	}
+	if subs, _ := c.Subscribers(ctx, "2"); !reflect.DeepEqual(subs, []string{"user-1"}) {
+		t.Errorf("expected the subscription to the dataset 2 to be kept, got %v", subs)
+	}
+
+	//syncing subscribes to the datasets not requested yet
+	if err := c.SyncSubscriptions("user-3", []string{"2", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if subs, _ := c.Subscribers(ctx, "3"); !reflect.DeepEqual(subs, []string{"user-3"}) {
+		t.Errorf("expected the subscription to the dataset 3, got %v", subs)
+	}
+}
+
+func TestRevokeAccessThenRebuild(t *testing.T) {
+	c := startCache(newFakeAggregator(), DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	db, driver := openFakeDB(t)
+	defer db.Close()
+	d := NewDAggWithCache(db, log.NewLogger(), c)
+	d.EnableFuzzyIndex(0)
+
+	scoped := ScopedDICTID("7", []uint{1, 2})
+	for _, s := range []string{"7", scoped, "8"} {
+		if _, err := c.GetMany(ctx, []string{"1", "2"}, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.fuzzy.set("7", NewFuzzyIndex(interpreter.DICT{Map: map[string]interpreter.Token{}}, 0))
+
+	if err := d.RevokeAccess(1, 7); err != nil {
+		t.Fatal(err)
+	}
+	deleted := false
+	for _, s := range driver.executed() {
+		deleted = deleted || strings.Contains(s, `"datset_user_mappings"`) && strings.Contains(s, "dataset_id = $2 and user_id = $3")
+	}
+	if !deleted {
+		t.Errorf("expected the mapping of the user to the dataset to be deleted, got %v", driver.executed())
+	}
+	if subs, _ := c.Subscribers(ctx, "1"); !reflect.DeepEqual(subs, []string{"8"}) {
+		t.Errorf("expected the user and its scoped dictionary to be unsubscribed from the dataset, got %v", subs)
+	}
+	if subs, _ := c.Subscribers(ctx, "2"); !reflect.DeepEqual(subs, []string{"7", scoped, "8"}) {
+		t.Errorf("expected the subscriptions to the other datasets to be kept, got %v", subs)
+	}
+	if _, ok := d.Suggest("7", "column", 1); ok {
+		t.Error("expected the fuzzy index of the user to be dropped")
+	}
+
+	//the dictionary is rebuilt from the datasets the user still has access to
+	dict, err := d.build(ctx, "7", "7", []string{"2"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dict.Map["column 1"]; ok {
+		t.Error("expected the revoked dataset not to be in the rebuilt dictionary")
+	}
+	if _, ok := dict.Map["column 2"]; !ok {
+		t.Error("expected the dataset the user has access to in the rebuilt dictionary")
+	}
+	if subs, _ := c.Subscribers(ctx, "1"); !reflect.DeepEqual(subs, []string{"8"}) {
+		t.Errorf("expected the rebuild not to subscribe the user to the revoked dataset, got %v", subs)
+	}
+}
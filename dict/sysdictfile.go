@@ -0,0 +1,318 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cuttle-ai/brain/log"
+	"github.com/cuttle-ai/octopus/interpreter"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * This file contains the loading of the system dictionaries from a json or yaml file
+ */
+
+//DefaultSystemDICTReloadInterval is the default interval at which the system dictionary file is checked for changes
+const DefaultSystemDICTReloadInterval = time.Second * 30
+
+//ErrUnknownSystemDICTFormat is returned when the format of the system dictionary file is not known from its extension
+var ErrUnknownSystemDICTFormat = errors.New("unknown format of the system dictionary file. expected .json, .yaml or .yml")
+
+//SystemDICTFile is the content of a system dictionary file. An example of the file in yaml is
+//
+//	dictionaries:
+//	  - locale: en
+//	    remove: ["not"]
+//	    entries:
+//	      - uid: not-equal
+//	        operator: "<>"
+//	        words: ["is not", "isn't"]
+type SystemDICTFile struct {
+	//Dictionaries has the vocabulary of the locales
+	Dictionaries []SystemDICTVocabulary `json:"dictionaries" yaml:"dictionaries"`
+}
+
+//SystemDICTVocabulary is the vocabulary of a locale in the system dictionary file.
+//It is merged on top of the built-in dictionary of the locale
+type SystemDICTVocabulary struct {
+	//Locale is the locale of the vocabulary. Defaults to DefaultLocale if empty
+	Locale string `json:"locale" yaml:"locale"`
+	//Remove has the words to be removed from the built-in dictionary of the locale
+	Remove []string `json:"remove,omitempty" yaml:"remove,omitempty"`
+	//Entries has the entries overriding the words of the built-in dictionary of the locale
+	Entries []SystemDICTEntry `json:"entries" yaml:"entries"`
+}
+
+//SystemDICTLoader loads the system dictionaries from a json or yaml file and registers them.
+//The dictionaries of the file are merged on top of the built-in dictionaries
+type SystemDICTLoader struct {
+	path string
+	l    log.Log
+	//m guards the fields below
+	m sync.Mutex
+	//modTime and size are of the file when it was last loaded
+	modTime time.Time
+	size    int64
+	//locales has the locales registered by the last load
+	locales map[string]struct{}
+	//hooks are called with the changed locales after each successful load
+	hooks []func(locales []string)
+}
+
+//NewSystemDICTLoader returns a new loader of the system dictionary file at the given path
+func NewSystemDICTLoader(path string, l log.Log) *SystemDICTLoader {
+	return &SystemDICTLoader{path: path, l: l, locales: map[string]struct{}{}}
+}
+
+//OnReload registers the hook to be called with the locales whose system dictionaries were registered or restored
+//after each successful load. The dictionaries of the users built before the load aren't affected by the load by
+//themselves. DAgg.EnableSystemDICTReload registers a hook dropping them
+func (s *SystemDICTLoader) OnReload(hook func(locales []string)) {
+	s.m.Lock()
+	s.hooks = append(s.hooks, hook)
+	s.m.Unlock()
+}
+
+//Load loads the system dictionary file and registers the dictionaries of its locales. If the file is invalid,
+//the registered dictionaries are left unchanged. The locales removed from the file since the last load are
+//restored to their built-in dictionaries. The hooks registered with OnReload are called once the load succeeds
+func (s *SystemDICTLoader) Load() error {
+	locales, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	hooks := append([]func(locales []string){}, s.hooks...)
+	s.m.Unlock()
+	for _, h := range hooks {
+		h(locales)
+	}
+	return nil
+}
+
+//load loads the system dictionary file and registers the dictionaries of its locales.
+//It returns the locales whose dictionaries were registered or restored
+func (s *SystemDICTLoader) load() ([]string, error) {
+	/*
+	 * We will read the file
+	 * Then we will parse it according to its format
+	 * Then we will build the dictionaries of each locale
+	 * Finally we will register them
+	 */
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	//reading the file
+	info, err := os.Stat(s.path)
+	if err != nil {
+		s.l.Error("error while getting the info of the system dictionary file", s.path)
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		s.l.Error("error while reading the system dictionary file", s.path)
+		return nil, err
+	}
+	//an invalid file is not retried by the watch till it changes again
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+
+	//parsing the file
+	f := SystemDICTFile{}
+	switch strings.ToLower(filepath.Ext(s.path)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &f)
+	default:
+		err = ErrUnknownSystemDICTFormat
+	}
+	if err != nil {
+		s.l.Error("error while parsing the system dictionary file", s.path)
+		return nil, err
+	}
+
+	//building the dictionaries
+	dicts := map[string]interpreter.DICT{}
+	for _, v := range f.Dictionaries {
+		locale := NormaliseLocale(v.Locale)
+		if len(locale) == 0 {
+			locale = DefaultLocale
+		}
+		d, ok := dicts[locale]
+		if !ok {
+			d, _ = builtinSystemDICT(locale)
+		}
+		for _, w := range v.Remove {
+			delete(d.Map, strings.ToLower(strings.TrimSpace(w)))
+		}
+		err = addSystemDICTEntries(d.Map, v.Entries)
+		if err != nil {
+			s.l.Error("error while validating the dictionary of the locale", locale, "in the system dictionary file", s.path)
+			return nil, err
+		}
+		dicts[locale] = d
+	}
+
+	//registering the dictionaries and restoring the locales not in the file anymore
+	changed := []string{}
+	for k := range s.locales {
+		if _, ok := dicts[k]; ok {
+			continue
+		}
+		if d, ok := builtinSystemDICT(k); ok {
+			RegisterSystemDICT(k, d)
+		} else {
+			unregisterSystemDICT(k)
+		}
+		changed = append(changed, k)
+	}
+	s.locales = map[string]struct{}{}
+	for k, d := range dicts {
+		RegisterSystemDICT(k, d)
+		s.locales[k] = struct{}{}
+		changed = append(changed, k)
+	}
+	return changed, nil
+}
+
+//changed returns true if the file has changed since it was last loaded
+func (s *SystemDICTLoader) changed() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size, nil
+}
+
+//Watch checks the file for changes at the given interval and reloads it when changed. Non positive interval
+//falls back to DefaultSystemDICTReloadInterval. The returned function stops the watch
+func (s *SystemDICTLoader) Watch(interval time.Duration) func() {
+	if interval <= 0 {
+		interval = DefaultSystemDICTReloadInterval
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			changed, err := s.changed()
+			if err != nil {
+				s.l.Error("error while checking the system dictionary file for changes", s.path, err)
+				continue
+			}
+			if !changed {
+				continue
+			}
+			if err := s.Load(); err != nil {
+				s.l.Error("error while reloading the system dictionary file. keeping the previous dictionaries", s.path, err)
+				continue
+			}
+			s.l.Info("reloaded the system dictionary file", s.path)
+		}
+	}()
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+//localeIndex has the locales of the system dictionaries in the built dictionaries mapped to the dictionary id
+type localeIndex struct {
+	m       sync.Mutex
+	locales map[string]string
+	//built has the time at which each dictionary was built
+	built map[string]time.Time
+}
+
+//set records the locale of the system dictionary added to the dictionary
+func (l *localeIndex) set(ID, locale string) {
+	l.m.Lock()
+	l.locales[ID] = NormaliseLocale(locale)
+	l.built[ID] = time.Now()
+	l.m.Unlock()
+}
+
+//remove removes the dictionaries built before the given time
+func (l *localeIndex) remove(before time.Time, IDs ...string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, ID := range IDs {
+		if t, ok := l.built[ID]; ok && t.Before(before) {
+			delete(l.locales, ID)
+			delete(l.built, ID)
+		}
+	}
+}
+
+//dicts returns the ids of the dictionaries whose system dictionary is affected by a change to the given locales.
+//A dictionary is affected if the dictionary of its locale, of its language or of the default locale changes,
+//since the system dictionary of a locale falls back to them
+func (l *localeIndex) dicts(locales []string) []string {
+	changed := map[string]struct{}{}
+	for _, v := range locales {
+		changed[NormaliseLocale(v)] = struct{}{}
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	result := []string{}
+	for ID, locale := range l.locales {
+		for _, v := range []string{locale, strings.SplitN(locale, "-", 2)[0], DefaultLocale} {
+			if _, ok := changed[v]; ok {
+				result = append(result, ID)
+				break
+			}
+		}
+	}
+	return result
+}
+
+//EnableSystemDICTReload drops the dictionaries built with the system dictionaries of the locales reloaded by the loader,
+//so that they are built again with the reloaded system dictionaries
+func (d *DAgg) EnableSystemDICTReload(s *SystemDICTLoader) {
+	if d.locales == nil {
+		d.locales = &localeIndex{locales: map[string]string{}, built: map[string]time.Time{}}
+		d.observeIndexes()
+	}
+	s.OnReload(func(locales []string) {
+		d.DropLocaleDICTs(locales...)
+	})
+}
+
+//DropLocaleDICTs drops the dictionaries built with the system dictionaries of the given locales from the interpreter.
+//It is to be called after the system dictionaries of the locales are registered again. Only the dictionaries built
+//after EnableSystemDICTReload are known to the aggregator
+func (d DAgg) DropLocaleDICTs(locales ...string) {
+	if d.locales == nil {
+		return
+	}
+	keys := d.locales.dicts(locales)
+	if len(keys) == 0 {
+		return
+	}
+	removeSubscribedDICTs(keys)
+	d.dropIndexes(time.Now(), keys...)
+}
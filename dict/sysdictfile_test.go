@@ -0,0 +1,132 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cuttle-ai/brain/log"
+)
+
+func TestSystemDICTReloadDropsTheAffectedDICTs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysdict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		d, _ := builtinSystemDICT(LocaleGerman)
+		RegisterSystemDICT(LocaleGerman, d)
+	}()
+	path := filepath.Join(dir, "sysdict.yaml")
+	content := "dictionaries:\n  - locale: de\n    entries:\n      - uid: not-equal\n        operator: \"<>\"\n        words: [\"ungleich\"]\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loader := NewSystemDICTLoader(path, log.NewLogger())
+	d := NewDAggWithCache(nil, nil, nil)
+	d.EnableSystemDICTReload(loader)
+	d.locales.set("1", "en")
+	d.locales.set("2", "de")
+	d.locales.set(LocaleDICTID("3", "de-at"), "de-AT")
+	d.locales.set(TeamDICTID(4), "es")
+
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := SystemDICTForLocale(LocaleGerman).Map["ungleich"]; !ok {
+		t.Fatal("expected the system dictionary of the file to be registered")
+	}
+	remaining := []string{}
+	d.locales.m.Lock()
+	for k := range d.locales.locales {
+		remaining = append(remaining, k)
+	}
+	d.locales.m.Unlock()
+	sort.Strings(remaining)
+	if expected := []string{"1", TeamDICTID(4)}; !reflect.DeepEqual(remaining, expected) {
+		t.Errorf("expected the dictionaries of the german locales to be dropped leaving %v, got %v", expected, remaining)
+	}
+
+	//the hooks aren't called when the file is invalid
+	d.locales.set("2", "de")
+	if err := ioutil.WriteFile(path, []byte("dictionaries: [}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Load(); err == nil {
+		t.Fatal("expected the invalid file to fail loading")
+	}
+	if keys := d.locales.dicts([]string{LocaleGerman}); len(keys) != 1 {
+		t.Errorf("expected the dictionaries to be kept when the reload fails, got %v", keys)
+	}
+}
+
+func TestSystemDICTFileIsMergedOverTheBuiltins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysdict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		d, _ := builtinSystemDICT(LocaleEnglish)
+		RegisterSystemDICT(LocaleEnglish, d)
+	}()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	//the entries of the file override the built-in words and the removed words are dropped
+	path := write("sysdict.json", `{"dictionaries": [{"remove": ["not"], "entries": [{"uid": "not-equal", "operator": "<>", "words": ["is not", "isn't"]}]}]}`)
+	loader := NewSystemDICTLoader(path, log.NewLogger())
+	reloaded := []string{}
+	loader.OnReload(func(locales []string) {
+		reloaded = append(reloaded, locales...)
+	})
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	en := SystemDICTForLocale(LocaleEnglish)
+	for w, ok := range map[string]bool{"is not": true, "isn't": true, "contains": true, "not": false} {
+		if _, found := en.Map[w]; found != ok {
+			t.Errorf("expected the word %q in the system dictionary to be %v, got %v", w, ok, found)
+		}
+	}
+	if !reflect.DeepEqual(reloaded, []string{LocaleEnglish}) {
+		t.Errorf("expected the reload of the default locale, got %v", reloaded)
+	}
+
+	//the locales removed from the file are restored to their built-in dictionaries
+	if err := ioutil.WriteFile(path, []byte(`{"dictionaries": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := SystemDICTForLocale(LocaleEnglish).Map["not"]; !ok {
+		t.Error("expected the built-in dictionary to be restored once the locale is removed from the file")
+	}
+
+	//invalid files are rejected
+	invalid := map[string]string{
+		"operator.json": `{"dictionaries": [{"entries": [{"uid": "x", "operator": "~", "words": ["like"]}]}]}`,
+		"unknown.json":  `{"dictionaries": [], "version": 2}`,
+		"sysdict.txt":   `dictionaries: []`,
+	}
+	for name, content := range invalid {
+		if err := NewSystemDICTLoader(write(name, content), log.NewLogger()).Load(); err == nil {
+			t.Errorf("%s: expected the file to be rejected", name)
+		}
+	}
+}
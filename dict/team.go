@@ -0,0 +1,391 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+/*
+ * This file contains the dictionaries shared by the members of a team
+ */
+
+//teamDICTPrefix prefixes the team id in the id of the shared dictionary of a team
+const teamDICTPrefix = "team:"
+
+//TeamDICTID returns the id of the shared dictionary of the team. The shared dictionary is stored in the interpreter with this id
+func TeamDICTID(teamID uint) string {
+	return teamDICTPrefix + strconv.Itoa(int(teamID))
+}
+
+//ParseTeamDICTID returns the team id from the id of the shared dictionary of a team.
+//Returns false if the id is not of a team dictionary
+func ParseTeamDICTID(key string) (uint, bool) {
+	if !strings.HasPrefix(key, teamDICTPrefix) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(key, teamDICTPrefix))
+	if err != nil || id < 0 {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+//teamLocale returns the locale of the system vocabulary in the shared dictionary of the team
+func teamLocale(t models.Team) string {
+	if len(t.Locale) == 0 {
+		return DefaultLocale
+	}
+	return NormaliseLocale(t.Locale)
+}
+
+//GetTeam builds the shared dictionary of the team from the datasets shared with the team and the system dict of the team's locale.
+//The dictionary is stored in the interpreter with the id given by TeamDICTID so that the members of the team share it
+//instead of building their own copies. It is subscribed to the updates of its datasets with the same id
+func (d DAgg) GetTeam(ctx context.Context, teamID uint, update bool) (interpreter.DICT, error) {
+	team := models.Team{}
+	err := d.db.Where("id = ?", teamID).First(&team).Error
+	if err != nil {
+		d.l.Error("error while getting the team", teamID)
+		return interpreter.DICT{Map: map[string]interpreter.Token{}}, err
+	}
+	dIDs, err := d.teamDatasetIDs(team)
+	if err != nil {
+		return interpreter.DICT{Map: map[string]interpreter.Token{}}, err
+	}
+	return d.buildTeam(ctx, team, dIDs, update)
+}
+
+//teamDatasetIDs returns the ids of the datasets shared with the team
+func (d DAgg) teamDatasetIDs(team models.Team) ([]string, error) {
+	ids, err := team.GetDatasetIDs(d.db)
+	if err != nil {
+		d.l.Error("error while getting the list of datasets shared with the team", team.ID)
+		return nil, err
+	}
+	result := make([]string, 0, len(ids))
+	for _, v := range ids {
+		result = append(result, strconv.Itoa(int(v)))
+	}
+	return result, nil
+}
+
+//buildTeam builds the shared dictionary of the team and stores it in the interpreter
+func (d DAgg) buildTeam(ctx context.Context, team models.Team, dIDs []string, update bool) (interpreter.DICT, error) {
+	key := TeamDICTID(team.ID)
+	result, err := d.build(WithLocale(ctx, teamLocale(team)), key, key, dIDs, update)
+	if err != nil {
+		return result, err
+	}
+	interpreter.SendDICTToChannel(dictInputChannel(), interpreter.DICTRequest{ID: key, Type: interpreter.DICTAdd, DICT: result})
+	return result, nil
+}
+
+//sharedDICT returns true if the key is of a dictionary shared by several users, ie. the shared dictionary of a team
+//or a layered dictionary. The shared dictionaries are not ranked with the usage of any one user
+func sharedDICT(key string) bool {
+	return strings.HasPrefix(key, teamDICTPrefix) || strings.HasPrefix(key, layeredDICTPrefix)
+}
+
+//sharedTeamDICT returns the shared dictionary of the team stored in the interpreter along with the ids of the datasets of the team.
+//The dictionary is built if it is not found in the interpreter or if it has to be updated
+func (d DAgg) sharedTeamDICT(ctx context.Context, team models.Team, update bool) (interpreter.DICT, []string, error) {
+	dIDs, err := d.teamDatasetIDs(team)
+	if err != nil {
+		return interpreter.DICT{Map: map[string]interpreter.Token{}}, nil, err
+	}
+	if !update {
+		stored, ok, err := storedDICT(ctx, TeamDICTID(team.ID))
+		if err != nil {
+			d.l.Error("error while getting the shared dictionary of the team", team.ID, "from the interpreter")
+			return interpreter.DICT{Map: map[string]interpreter.Token{}}, nil, err
+		}
+		if ok {
+			return stored, dIDs, nil
+		}
+	}
+	result, err := d.buildTeam(ctx, team, dIDs, update)
+	return result, dIDs, err
+}
+
+//dictInputChannel returns the channel of the interpreter to which the dictionaries are sent and from which the
+//stored dictionaries are requested. It is a variable so that the tests can stand in for the interpreter
+var dictInputChannel = func() chan interpreter.DICTRequest {
+	return interpreter.DICTInputChannel
+}
+
+//storedDICT returns the dictionary stored in the interpreter with the given id. Returns false if the interpreter
+//doesn't have the dictionary. The error of the context is returned if it is done before the interpreter responds
+func storedDICT(ctx context.Context, ID string) (interpreter.DICT, bool, error) {
+	req := interpreter.DICTRequest{ID: ID, Type: interpreter.DICTGet, Out: make(chan interpreter.DICTRequest, 1)}
+	go interpreter.SendDICTToChannel(dictInputChannel(), req)
+	select {
+	case res := <-req.Out:
+		return res.DICT, res.Valid, nil
+	case <-ctx.Done():
+		return interpreter.DICT{}, false, ctx.Err()
+	}
+}
+
+//layeredDICTPrefix prefixes the id of a dictionary layering the datasets of its members over the shared dictionaries of teams
+const layeredDICTPrefix = "layer:"
+
+//layeredDICTID returns the id of the dictionary layering the datasets over the shared dictionaries of the teams in the locale.
+//The id is the same irrespective of the order of the teams and the datasets
+func layeredDICTID(teams []models.Team, dIDs []string, locale string) string {
+	tIDs := make([]uint, 0, len(teams))
+	for _, t := range teams {
+		tIDs = append(tIDs, t.ID)
+	}
+	ids := make([]string, 0, len(tIDs))
+	for _, v := range normaliseDatasetIDs(tIDs) {
+		ids = append(ids, strconv.Itoa(int(v)))
+	}
+	own := append([]string{}, dIDs...)
+	sort.Strings(own)
+	return layeredDICTPrefix + strings.Join(ids, ",") + scopeSeparator + strings.Join(own, ",") + localeSeparator + locale
+}
+
+//buildLayered builds the user dictionary by layering the user's own datasets over the shared dictionaries of the user's teams.
+//If the user has no datasets apart from those of a single team having the user's locale, the shared dictionary of the team is returned as is.
+//Else the layered dictionary is stored in the interpreter with an id made of the teams, the own datasets and the locale, so that the
+//members having the same teams and datasets share it instead of building their own copies. Hence the layered dictionaries are not
+//ranked with the usage of a member. The key of the user dictionary is subscribed to the datasets of the teams as well so that it is
+//dropped along with the shared ones
+func (d DAgg) buildLayered(ctx context.Context, key, ID string, teams []models.Team, dIDs []string, update bool) (interpreter.DICT, error) {
+	/*
+	 * We will get the shared dictionaries of the teams
+	 * Then we will find the user's datasets not shared with the teams
+	 * Then we will subscribe the user to all the datasets
+	 * If the shared dictionary can be used as is, we will return it
+	 * If the layered dictionary is already stored in the interpreter, we will return it
+	 * Else we will layer the user's datasets and the system dict over the shared dictionaries and store it
+	 */
+	result := interpreter.DICT{Map: map[string]interpreter.Token{}}
+	//getting the shared dictionaries
+	locale := NormaliseLocale(d.Locale(ctx, ID))
+	shared := make([]interpreter.DICT, 0, len(teams))
+	sameLocale := true
+	all := []string{}
+	teamDatasets := map[string]struct{}{}
+	for _, t := range teams {
+		tDict, tIDs, err := d.sharedTeamDICT(ctx, t, update)
+		if err != nil {
+			d.l.Error("error while getting the shared dictionary of the team", t.ID, "for the user", ID)
+			return result, err
+		}
+		shared = append(shared, tDict)
+		if teamLocale(t) != locale {
+			sameLocale = false
+		}
+		for _, v := range tIDs {
+			if _, ok := teamDatasets[v]; ok {
+				continue
+			}
+			teamDatasets[v] = struct{}{}
+			all = append(all, v)
+		}
+	}
+
+	//finding the user's own datasets
+	own := map[string]struct{}{}
+	ownIDs := []string{}
+	for _, v := range dIDs {
+		if _, ok := teamDatasets[v]; ok {
+			continue
+		}
+		if _, ok := own[v]; ok {
+			continue
+		}
+		own[v] = struct{}{}
+		ownIDs = append(ownIDs, v)
+		all = append(all, v)
+	}
+
+	//subscribing the user to all the datasets
+	err := d.cache.SyncSubscriptions(key, all)
+	if err != nil {
+		d.l.Error("error while syncing the dataset subscriptions of", key)
+		return result, err
+	}
+	//the datasets of the teams are already updated along with the shared dictionaries
+	if update && len(ownIDs) > 0 {
+		if _, err = d.cache.UpdateMany(ctx, ownIDs, key); err != nil {
+			d.l.Error("error while updating the datasets", ownIDs, "for", key)
+			return result, err
+		}
+	}
+	datasets, err := d.cache.GetMany(ctx, all, key)
+	if err != nil {
+		d.l.Error("error while getting the datasets", all, "for", key)
+		return result, err
+	}
+
+	//returning the shared dictionary as is
+	if len(own) == 0 && len(shared) == 1 && sameLocale {
+		d.shareIndexes(TeamDICTID(teams[0].ID), key, locale)
+		return shared[0], nil
+	}
+
+	//returning the layered dictionary stored in the interpreter
+	lKey := layeredDICTID(teams, ownIDs, locale)
+	if !update {
+		stored, ok, err := storedDICT(ctx, lKey)
+		if err != nil {
+			d.l.Error("error while getting the layered dictionary", lKey, "from the interpreter for", key)
+			return result, err
+		}
+		if ok {
+			d.shareIndexes(lKey, key, locale)
+			return stored, nil
+		}
+	}
+
+	//layering the user's datasets over the shared dictionaries. the layered dictionary is subscribed to all the datasets
+	if err = d.cache.SyncSubscriptions(lKey, all); err != nil {
+		d.l.Error("error while syncing the dataset subscriptions of", lKey)
+		return result, err
+	}
+	for _, s := range shared {
+		for k, t := range s.Map {
+			mergeUniqueToken(result.Map, k, t)
+		}
+	}
+	nodeDatasets := map[interpreter.Node]string{}
+	for dID, dataset := range datasets {
+		_, ok := own[dID]
+		for k, t := range dataset.D {
+			if ok {
+				mergeUniqueToken(result.Map, k, t)
+			}
+			for _, n := range t.Nodes {
+				nodeDatasets[n] = dID
+			}
+		}
+	}
+	d.rank(lKey, result.Map, nodeDatasets, datasets)
+	for k, v := range SystemDICTForLocale(locale).Map {
+		mergeUniqueToken(result.Map, d.Normalise(k), v)
+	}
+
+	//building the fuzzy index and syncing the phrase index
+	if d.fuzzy != nil {
+		d.fuzzy.set(lKey, NewFuzzyIndex(result, d.fuzzyMaxDistance))
+	}
+	if d.phrases != nil {
+		d.phrases.sync(lKey, result, d.normaliser)
+	}
+	if d.locales != nil {
+		d.locales.set(lKey, locale)
+	}
+	d.shareIndexes(lKey, key, locale)
+
+	interpreter.SendDICTToChannel(dictInputChannel(), interpreter.DICTRequest{ID: lKey, Type: interpreter.DICTAdd, DICT: result})
+	return result, nil
+}
+
+//shareIndexes makes the user dictionary with the given key use the indexes of the shared dictionary
+func (d DAgg) shareIndexes(sharedKey, key, locale string) {
+	if d.fuzzy != nil {
+		if i, ok := d.fuzzy.get(sharedKey); ok {
+			d.fuzzy.set(key, i)
+		}
+	}
+	if d.phrases != nil {
+		if i, ok := d.phrases.get(sharedKey); ok {
+			d.phrases.share(key, i)
+		}
+	}
+	if d.locales != nil {
+		d.locales.set(key, locale)
+	}
+}
+
+//mergeUniqueToken merges the token with the existing token of the key skipping the nodes already present in it.
+//It is used while layering dictionaries that may share the same datasets or the system dict
+func mergeUniqueToken(tokens map[string]interpreter.Token, k string, t interpreter.Token) {
+	existing, ok := tokens[k]
+	if !ok {
+		mergeToken(tokens, k, t)
+		return
+	}
+	present := make(map[string]struct{}, len(existing.Nodes))
+	for _, n := range existing.Nodes {
+		if uid := NodeUID(n); len(uid) > 0 {
+			present[uid] = struct{}{}
+		}
+	}
+	nodes := make([]interpreter.Node, 0, len(t.Nodes)+len(existing.Nodes))
+	nodes = append(nodes, existing.Nodes...)
+	for _, n := range t.Nodes {
+		if uid := NodeUID(n); len(uid) > 0 {
+			if _, ok := present[uid]; ok {
+				continue
+			}
+			present[uid] = struct{}{}
+		}
+		nodes = append(nodes, n)
+	}
+	existing.Nodes = nodes
+	tokens[k] = existing
+}
+
+//RevokeTeamAccess removes the access of the team to the dataset. The shared dictionary of the team and the
+//dictionaries of its members are dropped from the interpreter so that they are built again without the dataset
+func (d DAgg) RevokeTeamAccess(datasetID, teamID uint) error {
+	err := d.db.Where("dataset_id = ? and team_id = ?", datasetID, teamID).Delete(&models.DatasetTeamMapping{}).Error
+	if err != nil {
+		d.l.Error("error while removing the access of the team", teamID, "to the dataset", datasetID)
+		return err
+	}
+	team := models.Team{}
+	team.ID = teamID
+	users, err := team.GetUserIDs(d.db)
+	if err != nil {
+		d.l.Error("error while getting the members of the team", teamID)
+		return err
+	}
+	dID := strconv.Itoa(int(datasetID))
+	keys := []string{TeamDICTID(teamID)}
+	members := map[string]struct{}{}
+	for _, v := range users {
+		keys = append(keys, strconv.Itoa(int(v)))
+		members[strconv.Itoa(int(v))] = struct{}{}
+	}
+
+	//the locale dictionaries of the members and the layered dictionaries are dropped along with the user dictionaries
+	ctx, cancel := context.WithTimeout(context.Background(), DatasetRequestTimeout)
+	defer cancel()
+	subs, err := d.cache.Subscribers(ctx, dID)
+	if err != nil {
+		d.l.Error("error while getting the subscribers of the dataset", datasetID)
+		return err
+	}
+	for _, k := range subs {
+		if _, ok := members[k]; ok {
+			continue
+		}
+		if _, ok := members[dictUser(k)]; ok || strings.HasPrefix(k, layeredDICTPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		err = d.cache.Unsubscribe(dID, k)
+		if err != nil {
+			d.l.Error("error while unsubscribing", k, "of the team", teamID, "from the dataset", datasetID)
+			return err
+		}
+	}
+	removeSubscribedDICTs(keys)
+	d.dropIndexes(time.Now(), keys...)
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/brain/log"
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+)
+
+//stubInterpreter stands in for the interpreter storing the dictionaries sent to it
+type stubInterpreter struct {
+	in      chan interpreter.DICTRequest
+	done    chan struct{}
+	dicts   map[string]interpreter.DICT
+	restore func() chan interpreter.DICTRequest
+}
+
+//startStubInterpreter makes the package send the dictionaries to a new stub interpreter. The requests are not served
+//if serve is false. stop has to be called to restore the interpreter
+func startStubInterpreter(serve bool) *stubInterpreter {
+	s := &stubInterpreter{
+		in:      make(chan interpreter.DICTRequest),
+		done:    make(chan struct{}),
+		dicts:   map[string]interpreter.DICT{},
+		restore: dictInputChannel,
+	}
+	dictInputChannel = func() chan interpreter.DICTRequest {
+		return s.in
+	}
+	if serve {
+		go s.serve()
+	}
+	return s
+}
+
+func (s *stubInterpreter) serve() {
+	for {
+		select {
+		case req := <-s.in:
+			switch req.Type {
+			case interpreter.DICTAdd:
+				s.dicts[req.ID] = req.DICT
+			case interpreter.DICTRemove:
+				delete(s.dicts, req.ID)
+			case interpreter.DICTGet:
+				d, ok := s.dicts[req.ID]
+				req.DICT, req.Valid = d, ok
+				req.Out <- req
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+//stored returns true if the dictionary is stored in the stub. The request is served after the ones sent before it
+func (s *stubInterpreter) stored(ID string) bool {
+	req := interpreter.DICTRequest{ID: ID, Type: interpreter.DICTGet, Out: make(chan interpreter.DICTRequest, 1)}
+	s.in <- req
+	return (<-req.Out).Valid
+}
+
+func (s *stubInterpreter) stop() {
+	close(s.done)
+	dictInputChannel = s.restore
+}
+
+//recordingUsage is the usage source recording the ids the usage is asked for
+type recordingUsage struct {
+	m   sync.Mutex
+	IDs []string
+}
+
+func (r *recordingUsage) NodeUsage(userID string) (map[string]int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.IDs = append(r.IDs, userID)
+	return map[string]int{}, nil
+}
+
+func TestLayeredDICTID(t *testing.T) {
+	teams := func(IDs ...uint) []models.Team {
+		result := []models.Team{}
+		for _, v := range IDs {
+			t := models.Team{}
+			t.ID = v
+			result = append(result, t)
+		}
+		return result
+	}
+	a := layeredDICTID(teams(2, 1), []string{"6", "5"}, "en")
+	b := layeredDICTID(teams(1, 2), []string{"5", "6"}, "en")
+	if a != b {
+		t.Errorf("expected the same id irrespective of the order, got %s and %s", a, b)
+	}
+	if a != "layer:1,2/5,6@en" {
+		t.Errorf("unexpected layered dictionary id %s", a)
+	}
+	if dictUser(a) == "1" || dictUser(a) == "5" {
+		t.Errorf("expected the layered dictionary id not to be taken for a user, got %s", dictUser(a))
+	}
+	if c := layeredDICTID(teams(1, 2), []string{"5", "6"}, "de"); c == a {
+		t.Errorf("expected the locales to have different layered dictionaries, got %s", c)
+	}
+}
+
+func TestStoredDICTHonoursTheContext(t *testing.T) {
+	//the interpreter never responds
+	s := startStubInterpreter(false)
+	defer s.stop()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, ok, err := storedDICT(ctx, "team:1")
+		if ok {
+			t.Error("expected no dictionary once the context is done")
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected the deadline of the context, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected the lookup to return once the context is done")
+	}
+}
+
+func TestLayeredDICTIsSharedAndNotRankedWithUsage(t *testing.T) {
+	s := startStubInterpreter(true)
+	defer s.stop()
+	agg := newFakeAggregator()
+	c := startCache(agg, DefaultDatasetCacheConfig())
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	//the dataset 1 is shared with the team
+	db, driver := openFakeDB(t, int64(1))
+	defer db.Close()
+	driver.column = "dataset_id"
+	d := NewDAggWithCache(db, log.NewLogger(), c)
+	usage := &recordingUsage{}
+	d.SetUsageSource(usage)
+	team := models.Team{}
+	team.ID = 1
+
+	dict, err := d.buildLayered(ctx, "7", "7", []models.Team{team}, []string{"1", "2"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"column 1", "column 2"} {
+		if _, ok := dict.Map[k]; !ok {
+			t.Errorf("expected %s in the layered dictionary", k)
+		}
+	}
+	lKey := layeredDICTID([]models.Team{team}, []string{"2"}, DefaultLocale)
+	for _, k := range []string{TeamDICTID(1), lKey} {
+		if !s.stored(k) {
+			t.Errorf("expected %s to be stored in the interpreter", k)
+		}
+	}
+	for _, ID := range usage.IDs {
+		if sharedDICT(ID) {
+			t.Errorf("expected the shared dictionaries not to be ranked with the usage, got the usage asked for %s", ID)
+		}
+	}
+
+	//the datasets are loaded once and the layered dictionary is subscribed to them along with the user
+	subscribers := map[string][]string{"1": {"7", lKey, TeamDICTID(1)}, "2": {"7", lKey}}
+	for dID, want := range subscribers {
+		if n := agg.count(dID); n != 1 {
+			t.Errorf("expected the dataset %s to be loaded once, got %d", dID, n)
+		}
+		if subs, _ := c.Subscribers(ctx, dID); !reflect.DeepEqual(subs, want) {
+			t.Errorf("expected the user and the layered dictionary to be subscribed to the dataset %s, got %v", dID, subs)
+		}
+	}
+
+	//the members with the same teams and datasets get the stored layered dictionary
+	if _, err := d.buildLayered(ctx, "8", "8", []models.Team{team}, []string{"2", "1"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := agg.count("2"); n != 1 {
+		t.Errorf("expected the stored layered dictionary to be used, got the dataset 2 loaded %d times", n)
+	}
+}
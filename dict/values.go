@@ -0,0 +1,273 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cuttle-ai/brain/models"
+	"github.com/cuttle-ai/octopus/interpreter"
+	"github.com/jinzhu/gorm"
+)
+
+/*
+ * This file contains the indexing of the distinct values of the dimension columns as value tokens
+ */
+
+//DefaultValueCardinalityLimit is the default maximum no. of distinct values of a column to be indexed.
+//Columns having more distinct values than the limit are not indexed
+const DefaultValueCardinalityLimit = 1000
+
+//ValueSource reads the distinct values of the columns from the datastores of the datasets
+type ValueSource interface {
+	//DistinctValues returns at most limit distinct non empty values of the column of the table
+	//in the datastore with the given id
+	DistinctValues(ctx context.Context, datastoreID uint, table, column string, limit int) ([]string, error)
+}
+
+//ErrInvalidIdentifier is returned by the sql value source for the table and column names that can't be quoted safely
+var ErrInvalidIdentifier = errors.New("invalid table or column name for reading the distinct values")
+
+//SQLValueSource is the value source reading the distinct values of the columns from sql datastores
+type SQLValueSource struct {
+	//datastore returns the connection to the datastore with the given id
+	datastore func(ctx context.Context, datastoreID uint) (*gorm.DB, error)
+}
+
+//NewSQLValueSource returns the value source reading the distinct values from the sql datastores.
+//The datastore function returns the connection to the datastore with the given id
+func NewSQLValueSource(datastore func(ctx context.Context, datastoreID uint) (*gorm.DB, error)) SQLValueSource {
+	return SQLValueSource{datastore: datastore}
+}
+
+//DistinctValues returns at most limit distinct non empty values of the column of the table in the datastore with the given id.
+//The values are read as strings in the order returned by the datastore
+func (s SQLValueSource) DistinctValues(ctx context.Context, datastoreID uint, table, column string, limit int) ([]string, error) {
+	/*
+	 * We will get the connection to the datastore
+	 * Then we will query the distinct values of the column
+	 * Finally we will collect the non empty values
+	 */
+	result := []string{}
+	//getting the connection
+	conn, err := s.datastore(ctx, datastoreID)
+	if err != nil {
+		return result, err
+	}
+
+	//querying the distinct values
+	query, err := distinctValuesQuery(conn.Dialect(), table, column, limit)
+	if err != nil {
+		return result, err
+	}
+	rows, err := conn.DB().QueryContext(ctx, query)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	//collecting the values
+	for rows.Next() && len(result) < limit {
+		v := sql.NullString{}
+		if err = rows.Scan(&v); err != nil {
+			return result, err
+		}
+		if !v.Valid {
+			continue
+		}
+		result = append(result, v.String)
+	}
+	return result, rows.Err()
+}
+
+//distinctValuesQuery returns the query for at most limit distinct non empty values of the column of the table quoted
+//for the dialect. The table may be qualified with its schema. The values are compared as text to filter the blank ones
+func distinctValuesQuery(dialect gorm.Dialect, table, column string, limit int) (string, error) {
+	quote := func(name string) (string, error) {
+		if len(name) == 0 || strings.ContainsAny(name, "\"`;\x00") {
+			return "", ErrInvalidIdentifier
+		}
+		return dialect.Quote(name), nil
+	}
+	parts := strings.Split(table, ".")
+	for i := range parts {
+		q, err := quote(parts[i])
+		if err != nil {
+			return "", err
+		}
+		parts[i] = q
+	}
+	col, err := quote(column)
+	if err != nil {
+		return "", err
+	}
+	from := " FROM " + strings.Join(parts, ".") + " WHERE " + col + " IS NOT NULL"
+	n := strconv.Itoa(limit)
+	switch dialect.GetName() {
+	case "mssql":
+		//mssql has no limit clause and trim only from sql server 2017
+		return "SELECT DISTINCT TOP " + n + " " + col + from + " AND LTRIM(RTRIM(CAST(" + col + " AS NVARCHAR(MAX)))) <> ''", nil
+	case "mysql":
+		return "SELECT DISTINCT " + col + from + " AND TRIM(CAST(" + col + " AS CHAR)) <> '' LIMIT " + n, nil
+	default:
+		return "SELECT DISTINCT " + col + from + " AND TRIM(CAST(" + col + " AS TEXT)) <> '' LIMIT " + n, nil
+	}
+}
+
+//EnableValueIndex enables indexing the distinct values of the dimension columns read from the value source.
+//The indexed values are added as value tokens to the datasets. Columns having more distinct values than
+//the limit are not indexed. Non positive limit falls back to DefaultValueCardinalityLimit
+func (d *DAgg) EnableValueIndex(src ValueSource, limit int) {
+	if limit <= 0 {
+		limit = DefaultValueCardinalityLimit
+	}
+	d.values = src
+	d.valueLimit = limit
+}
+
+//ValueIndexTimeout is the maximum time taken by indexing the values of a dataset in the background
+const ValueIndexTimeout = time.Minute * 10
+
+//IndexValuesInBackground indexes the values of the dataset like IndexValues in a separate go routine within ValueIndexTimeout.
+//The returned channel receives the error of the indexing once it is done, which is also logged
+func (d DAgg) IndexValuesInBackground(dataset models.Dataset) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ValueIndexTimeout)
+		defer cancel()
+		err := d.IndexValues(ctx, &dataset)
+		if err != nil {
+			d.l.Error("error while indexing the values of the dataset in the background", dataset.ID, err)
+		}
+		result <- err
+	}()
+	return result
+}
+
+//IndexValues indexes the distinct values of the dimension columns of the dataset and invalidates the cached dataset
+//so that it gets loaded with the values. It is to be called whenever the data of the dataset changes. UpdateColumns
+//calls it in the background when the dimension columns of the dataset change
+func (d DAgg) IndexValues(ctx context.Context, dataset *models.Dataset) error {
+	/*
+	 * We will get the tables and the columns of the dataset
+	 * Then we will read the distinct values of each dimension column from its table
+	 * Columns exceeding the cardinality limit and the other columns will have their values removed
+	 * Finally we will invalidate the cached dataset
+	 */
+	if d.values == nil {
+		return nil
+	}
+
+	//getting the tables and the columns
+	tables, err := dataset.GetTables(d.db)
+	if err != nil {
+		d.l.Error("error while getting the tables of the dataset", dataset.ID)
+		return err
+	}
+	cols, err := dataset.GetColumns(d.db)
+	if err != nil {
+		d.l.Error("error while getting the columns of the dataset", dataset.ID)
+		return err
+	}
+	tNodes := make(map[string]interpreter.TableNode, len(tables))
+	for _, t := range tables {
+		tNodes[t.UID.String()] = t.TableNode()
+	}
+
+	//reading and storing the values of each column
+	for _, c := range cols {
+		cN := c.ColumnNode()
+		values := []string{}
+		//columns not attached to any table belong to the only table of the dataset
+		tN, ok := tNodes[cN.PUID]
+		if !ok && len(tables) == 1 {
+			tN, ok = tables[0].TableNode(), true
+		}
+		if cN.Dimension && ok {
+			datastoreID := dataset.DatastoreID
+			if tN.DatastoreID != 0 {
+				datastoreID = tN.DatastoreID
+			}
+			//one more than the limit is read to know if the column exceeds the limit
+			values, err = d.values.DistinctValues(ctx, datastoreID, tN.Name, cN.Name, d.valueLimit+1)
+			if err != nil {
+				d.l.Error("error while reading the distinct values of the column", cN.Name, "of the dataset", dataset.ID)
+				return err
+			}
+			if len(values) > d.valueLimit {
+				d.l.Info("skipping the value index of the column", cN.Name, "of the dataset", dataset.ID, "as it has more than", d.valueLimit, "distinct values")
+				values = []string{}
+			}
+		}
+		err = models.ReplaceColumnValues(d.l, d.db, dataset.ID, c.ID, values)
+		if err != nil {
+			d.l.Error("error while storing the values of the column", cN.Name, "of the dataset", dataset.ID)
+			return err
+		}
+	}
+
+	//invalidating the cached dataset
+	if err = dataset.Touch(d.db); err != nil {
+		d.l.Error("error while updating the update time of the dataset after indexing its values", dataset.ID)
+		return err
+	}
+	err = d.cache.Invalidate(strconv.Itoa(int(dataset.ID)))
+	if err != nil {
+		d.l.Error("error while invalidating the cached dataset after indexing its values", dataset.ID)
+	}
+	return err
+}
+
+//getColumnValues returns the indexed values of the columns of the dataset mapped to the id of the column nodes
+func (d DAgg) getColumnValues(datasetID uint) (map[uint][]models.ColumnValue, error) {
+	result := map[uint][]models.ColumnValue{}
+	if d.values == nil {
+		return result, nil
+	}
+	values, err := models.GetColumnValues(d.db, datasetID)
+	if err != nil {
+		return result, err
+	}
+	for _, v := range values {
+		result[v.NodeID] = append(result[v.NodeID], v)
+	}
+	return result, nil
+}
+
+//getDatasetsColumnValues returns the indexed values of the columns of the datasets mapped to the id of the dataset
+//and then to the id of the column nodes
+func (d DAgg) getDatasetsColumnValues(datasetIDs []uint) (map[uint]map[uint][]models.ColumnValue, error) {
+	result := map[uint]map[uint][]models.ColumnValue{}
+	if d.values == nil {
+		return result, nil
+	}
+	values, err := models.GetDatasetsColumnValues(d.db, datasetIDs)
+	if err != nil {
+		return result, err
+	}
+	for _, v := range values {
+		if _, ok := result[v.DatasetID]; !ok {
+			result[v.DatasetID] = map[uint][]models.ColumnValue{}
+		}
+		result[v.DatasetID][v.NodeID] = append(result[v.DatasetID][v.NodeID], v)
+	}
+	return result, nil
+}
+
+//addValueTokens adds the values as the children of the column and as value tokens to the token map
+func (d DAgg) addValueTokens(tokens map[string]interpreter.Token, column *interpreter.ColumnNode, values []models.ColumnValue) {
+	column.Children = make([]interpreter.ValueNode, 0, len(values))
+	for _, v := range values {
+		column.Children = append(column.Children, v.ValueNode(column))
+	}
+	for i := range column.Children {
+		addToken(tokens, d.Normalise(column.Children[i].Name), column.Children[i].Word, &column.Children[i])
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dict
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cuttle-ai/brain/models"
+	"github.com/jinzhu/gorm"
+)
+
+//fakeValuesDriver is the sql driver returning the same values for every query and recording the queries
+//and the statements executed along with the transactions. Every statement affects the given no. of rows.
+//The values are returned in the column named value unless a column is given
+type fakeValuesDriver struct {
+	m          sync.Mutex
+	values     []interface{}
+	column     string
+	affected   int64
+	queries    []string
+	statements []string
+}
+
+func (f *fakeValuesDriver) Open(name string) (driver.Conn, error) {
+	return fakeValuesConn{f}, nil
+}
+
+func (f *fakeValuesDriver) Connect(ctx context.Context) (driver.Conn, error) {
+	return fakeValuesConn{f}, nil
+}
+
+func (f *fakeValuesDriver) Driver() driver.Driver {
+	return f
+}
+
+func (f *fakeValuesDriver) record(statement string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.statements = append(f.statements, statement)
+}
+
+//executed returns the statements executed so far
+func (f *fakeValuesDriver) executed() []string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]string{}, f.statements...)
+}
+
+//openFakeDB returns a postgres gorm connection over a new fake driver returning the given values
+func openFakeDB(t *testing.T, values ...interface{}) (*gorm.DB, *fakeValuesDriver) {
+	f := &fakeValuesDriver{values: values}
+	conn, err := gorm.Open("postgres", sql.OpenDB(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, f
+}
+
+type fakeValuesConn struct {
+	f *fakeValuesDriver
+}
+
+func (c fakeValuesConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeValuesStmt{c.f, query}, nil
+}
+
+func (c fakeValuesConn) Close() error {
+	return nil
+}
+
+func (c fakeValuesConn) Begin() (driver.Tx, error) {
+	c.f.record("BEGIN")
+	return fakeValuesTx{c.f}, nil
+}
+
+type fakeValuesTx struct {
+	f *fakeValuesDriver
+}
+
+func (t fakeValuesTx) Commit() error {
+	t.f.record("COMMIT")
+	return nil
+}
+
+func (t fakeValuesTx) Rollback() error {
+	t.f.record("ROLLBACK")
+	return nil
+}
+
+type fakeValuesStmt struct {
+	f     *fakeValuesDriver
+	query string
+}
+
+func (s fakeValuesStmt) Close() error {
+	return nil
+}
+
+func (s fakeValuesStmt) NumInput() int {
+	return -1
+}
+
+func (s fakeValuesStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.f.record(s.query)
+	return driver.RowsAffected(s.f.affected), nil
+}
+
+func (s fakeValuesStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.f.m.Lock()
+	defer s.f.m.Unlock()
+	s.f.queries = append(s.f.queries, s.query)
+	return &fakeValuesRows{values: s.f.values, column: s.f.column}, nil
+}
+
+type fakeValuesRows struct {
+	values []interface{}
+	column string
+	i      int
+}
+
+func (r *fakeValuesRows) Columns() []string {
+	if len(r.column) == 0 {
+		return []string{"value"}
+	}
+	return []string{r.column}
+}
+
+func (r *fakeValuesRows) Close() error {
+	return nil
+}
+
+func (r *fakeValuesRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.values) {
+		return io.EOF
+	}
+	dest[0] = r.values[r.i]
+	r.i++
+	return nil
+}
+
+func TestSQLValueSource(t *testing.T) {
+	conn, driver := openFakeDB(t, "California", nil, int64(42), "Texas")
+	defer conn.Close()
+	src := NewSQLValueSource(func(ctx context.Context, datastoreID uint) (*gorm.DB, error) {
+		if datastoreID != 3 {
+			t.Errorf("expected the datastore 3, got %d", datastoreID)
+		}
+		return conn, nil
+	})
+
+	values, err := src.DistinctValues(context.Background(), 3, "public.sales", "state", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []string{"California", "42"}) {
+		t.Errorf("expected the first 2 non null values, got %v", values)
+	}
+	expected := `SELECT DISTINCT "state" FROM "public"."sales" WHERE "state" IS NOT NULL AND TRIM(CAST("state" AS TEXT)) <> '' LIMIT 2`
+	if len(driver.queries) != 1 || driver.queries[0] != expected {
+		t.Errorf("expected the query %s, got %v", expected, driver.queries)
+	}
+
+	if _, err = src.DistinctValues(context.Background(), 3, "sales", `state"; drop table sales`, 2); err != ErrInvalidIdentifier {
+		t.Errorf("expected the unsafe column name to be rejected, got %v", err)
+	}
+}
+
+//mssqlDialect is the dialect named mssql quoting the names with square brackets
+type mssqlDialect struct {
+	gorm.Dialect
+}
+
+func (mssqlDialect) GetName() string {
+	return "mssql"
+}
+
+func (mssqlDialect) Quote(key string) string {
+	return "[" + key + "]"
+}
+
+func TestDistinctValuesQueryOfTheDialects(t *testing.T) {
+	db, _ := openFakeDB(t)
+	defer db.Close()
+	mysql, _ := gorm.Open("mysql", sql.OpenDB(&fakeValuesDriver{}))
+	defer mysql.Close()
+	cases := []struct {
+		dialect  gorm.Dialect
+		expected string
+	}{
+		{db.Dialect(), `SELECT DISTINCT "state" FROM "sales" WHERE "state" IS NOT NULL AND TRIM(CAST("state" AS TEXT)) <> '' LIMIT 10`},
+		{mysql.Dialect(), "SELECT DISTINCT `state` FROM `sales` WHERE `state` IS NOT NULL AND TRIM(CAST(`state` AS CHAR)) <> '' LIMIT 10"},
+		{mssqlDialect{db.Dialect()}, "SELECT DISTINCT TOP 10 [state] FROM [sales] WHERE [state] IS NOT NULL AND LTRIM(RTRIM(CAST([state] AS NVARCHAR(MAX)))) <> ''"},
+	}
+	for _, c := range cases {
+		query, err := distinctValuesQuery(c.dialect, "sales", "state", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != c.expected {
+			t.Errorf("expected the %s query %s, got %s", c.dialect.GetName(), c.expected, query)
+		}
+	}
+}
+
+func TestIndexValuesInBackgroundWithoutValueSource(t *testing.T) {
+	d := NewDAggWithCache(nil, nil, nil)
+	select {
+	case err := <-d.IndexValuesInBackground(models.Dataset{}):
+		if err != nil {
+			t.Errorf("expected nothing to be indexed without a value source, got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected the background indexing to complete")
+	}
+}
+
+func TestDimensionsChanged(t *testing.T) {
+	column := func(ID uint, name, dimension string) models.Node {
+		n := models.Node{NodeMetadatas: []models.NodeMetadata{
+			{Prop: models.NodeMetadataPropName, Value: name},
+			{Prop: models.NodeMetadataPropDimension, Value: dimension},
+		}}
+		n.ID = ID
+		return n
+	}
+	old := []models.Node{column(1, "state", models.NodeMetadataPropValueTrue), column(2, "sales", models.NodeMetadataPropValueFalse)}
+	cases := []struct {
+		name    string
+		updated []models.Node
+		changed bool
+	}{
+		{"unchanged", []models.Node{column(1, "state", models.NodeMetadataPropValueTrue), column(2, "sales", models.NodeMetadataPropValueFalse)}, false},
+		{"renamed measure", []models.Node{column(1, "state", models.NodeMetadataPropValueTrue), column(2, "revenue", models.NodeMetadataPropValueFalse)}, false},
+		{"renamed dimension", []models.Node{column(1, "region", models.NodeMetadataPropValueTrue), column(2, "sales", models.NodeMetadataPropValueFalse)}, true},
+		{"new dimension", []models.Node{column(1, "state", models.NodeMetadataPropValueTrue), column(2, "sales", models.NodeMetadataPropValueTrue)}, true},
+		{"removed dimension", []models.Node{column(1, "state", models.NodeMetadataPropValueFalse), column(2, "sales", models.NodeMetadataPropValueFalse)}, true},
+	}
+	for _, c := range cases {
+		if changed := dimensionsChanged(old, c.updated); changed != c.changed {
+			t.Errorf("%s: expected %v, got %v", c.name, c.changed, changed)
+		}
+	}
+}
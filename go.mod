@@ -8,4 +8,5 @@ require (
 	github.com/cuttle-ai/octopus v0.0.0-00010101000000-000000000000
 	github.com/google/uuid v1.1.1
 	github.com/jinzhu/gorm v1.9.12
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -6,6 +6,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/cuttle-ai/brain/log"
 	"github.com/cuttle-ai/octopus/interpreter"
 	"github.com/google/uuid"
@@ -75,12 +77,42 @@ func (d Dataset) GetTable(conn *gorm.DB) (Node, error) {
 	return Node{}, err
 }
 
+//GetTables get all the tables corresponding to a dataset
+func (d Dataset) GetTables(conn *gorm.DB) ([]Node, error) {
+	result := []Node{}
+	err := conn.Set("gorm:auto_preload", true).Where("dataset_id = ? and type = ?", d.ID, interpreter.Table).Find(&result).Error
+	return result, err
+}
+
 //Get will find the dataset values and set in the instance. Returns an error if couldn't find
 func (d *Dataset) Get(conn *gorm.DB) error {
 	return conn.Where("user_id = ? and id = ?", d.UserID, d.ID).Find(d).Error
 }
 
-//UpdateColumns updates the columns in the database. It will create the columns if not existing
+//Touch sets the update time of the dataset to now. It is to be called when the nodes of the dataset change
+//so that the snapshots of the dataset taken before the change are discarded
+func (d *Dataset) Touch(conn *gorm.DB) error {
+	return conn.Model(d).Update("updated_at", time.Now()).Error
+}
+
+//TouchDatasets sets the update time of the datasets to now. It is to be called along with any change to the nodes
+//or the node metadata of the datasets so that the snapshots of the datasets taken before the change are discarded.
+//Zero ids are skipped
+func TouchDatasets(conn *gorm.DB, IDs []uint) error {
+	ids := make([]uint, 0, len(IDs))
+	for _, v := range IDs {
+		if v != 0 {
+			ids = append(ids, v)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return conn.Model(&Dataset{}).Where("id in (?)", ids).Update("updated_at", time.Now()).Error
+}
+
+//UpdateColumns updates the columns in the database. It will create the columns if not existing.
+//The update time of the dataset is bumped along with it
 func (d *Dataset) UpdateColumns(l log.Log, conn *gorm.DB, cols []Node) ([]Node, error) {
 	/*
 	 * We will use the db transactions to start update
@@ -122,19 +154,44 @@ func (d *Dataset) UpdateColumns(l log.Log, conn *gorm.DB, cols []Node) ([]Node,
 			}
 		}
 	}
+
+	//bumping the update time of the dataset
+	err := TouchDatasets(tx, []uint{d.ID})
+	if err != nil {
+		l.Error("error while updating the update time of the dataset", d.ID)
+		tx.Rollback()
+		return nil, err
+	}
 	return cols, tx.Commit().Error
 }
 
-//UpdateTable will update the given table
+//UpdateTable will update the given table. The update time of the dataset is bumped along with it
 func (d *Dataset) UpdateTable(conn *gorm.DB, table Node) (Node, error) {
-	err := conn.Save(&table).Error
-	return table, err
+	tx := conn.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+	if err := tx.Error; err != nil {
+		return table, err
+	}
+	if err := tx.Save(&table).Error; err != nil {
+		tx.Rollback()
+		return table, err
+	}
+	if err := TouchDatasets(tx, []uint{table.DatasetID}); err != nil {
+		tx.Rollback()
+		return table, err
+	}
+	return table, tx.Commit().Error
 }
 
-//HasUserAccess will return true if the user has access to all the given datasets
+//HasUserAccess will return true if the user has access to all the given datasets.
+//The datasets shared with the teams of the user are accessible to the user
 func HasUserAccess(l log.Log, conn *gorm.DB, datasetIds []uint, userID uint) (bool, error) {
 	/*
-	 * We will get the list of datasets the user has access to
+	 * We will get the list of datasets the user and the user's teams have access to
 	 * Then will iterate through the list and convert it to a map
 	 * Then will iterate through the passed list and check whether they exist
 	 */
@@ -148,15 +205,27 @@ func HasUserAccess(l log.Log, conn *gorm.DB, datasetIds []uint, userID uint) (bo
 		return false, err
 	}
 
+	//getting the list of datasets shared with the teams of the user
+	teamDatasets := []DatasetTeamMapping{}
+	err = conn.Joins("JOIN team_user_mappings ON team_user_mappings.team_id = dataset_team_mappings.team_id AND team_user_mappings.deleted_at IS NULL").
+		Where("team_user_mappings.user_id = ?", userID).Find(&teamDatasets).Error
+	if err != nil {
+		l.Error("error while getting the list of datasets shared with the teams of the user", userID)
+		return false, err
+	}
+
 	//iterating through the list and mapping to a map
 	dMap := map[uint]struct{}{}
 	for _, v := range datasets {
 		dMap[v.DatasetID] = struct{}{}
 	}
+	for _, v := range teamDatasets {
+		dMap[v.DatasetID] = struct{}{}
+	}
 
 	//iterating through the list of given datatsets and checking whether they exist in the map
-	for _, v := range datasets {
-		if _, ok := dMap[v.DatasetID]; !ok {
+	for _, v := range datasetIds {
+		if _, ok := dMap[v]; !ok {
 			l.Error("user doesn't has access to the dataset", v)
 			return false, nil
 		}
@@ -6,6 +6,7 @@ package models
 
 import (
 	"strconv"
+	"strings"
 
 	"github.com/cuttle-ai/brain/log"
 	"github.com/cuttle-ai/octopus/interpreter"
@@ -42,6 +43,9 @@ const (
 	NodeMetadataPropOperation = "Operation"
 	//NodeMetadataPropDateFormat is the metadata property of a column's csv data if the given column is of data type date
 	NodeMetadataPropDateFormat = "DateFormat"
+	//NodeMetadataPropSynonym is the metadata property of a node for a synonym of its word.
+	//A node can have multiple metadata with this property, one for each synonym
+	NodeMetadataPropSynonym = "Synonym"
 )
 
 const (
@@ -65,9 +69,25 @@ const (
 	NodeMetadataPropValueContainsOperator = "HAS"
 	//NodeMetadataPropValueLikeOperator is the value to be put for Like operator as operation of operator node
 	NodeMetadataPropValueLikeOperator = "LIKE"
+	//NodeMetadataPropValuePrefixOperator is the value to be put for Starts with operator as operation of operator node
+	NodeMetadataPropValuePrefixOperator = "PREFIX"
 )
 
+//PrefixOperator is the operation of the operator node for a value starting with the other.
+//It is a like operation with the value followed by a wildcard, kept apart so that the value isn't matched anywhere in the other
+const PrefixOperator = "PREFIX"
+
 var (
+	//NodeMetadataOperators is the map containing the supported operator values mapped to the operation of the interpreter's operator node
+	NodeMetadataOperators = map[string]string{
+		NodeMetadataPropValueEqOperator:       interpreter.EqOperator,
+		NodeMetadataPropValueNotEqOperator:    interpreter.NotEqOperator,
+		NodeMetadataPropValueGreaterOperator:  interpreter.GreaterOperator,
+		NodeMetadataPropValueLessOperator:     interpreter.LessOperator,
+		NodeMetadataPropValueContainsOperator: interpreter.ContainsOperator,
+		NodeMetadataPropValueLikeOperator:     interpreter.LikeOperator,
+		NodeMetadataPropValuePrefixOperator:   PrefixOperator,
+	}
 	//NodeMetadataAggregationFns is the map containing the supported aggregation functions
 	NodeMetadataAggregationFns = map[string]struct{}{
 		interpreter.AggregationFnAvg:   {},
@@ -412,18 +432,8 @@ func (n Node) OperatorNode() interpreter.OperatorNode {
 	for _, v := range n.NodeMetadatas {
 		if v.Prop == NodeMetadataPropWord {
 			word = v.Value
-		} else if v.Prop == NodeMetadataPropDimension && v.Value == NodeMetadataPropValueEqOperator {
-			operation = interpreter.EqOperator
-		} else if v.Prop == NodeMetadataPropDimension && v.Value == NodeMetadataPropValueNotEqOperator {
-			operation = interpreter.NotEqOperator
-		} else if v.Prop == NodeMetadataPropDimension && v.Value == NodeMetadataPropValueGreaterOperator {
-			operation = interpreter.GreaterOperator
-		} else if v.Prop == NodeMetadataPropDimension && v.Value == NodeMetadataPropValueLessOperator {
-			operation = interpreter.LessOperator
-		} else if v.Prop == NodeMetadataPropDimension && v.Value == NodeMetadataPropValueContainsOperator {
-			operation = interpreter.ContainsOperator
-		} else if v.Prop == NodeMetadataPropDimension && v.Value == NodeMetadataPropValueLikeOperator {
-			operation = interpreter.LikeOperator
+		} else if o, ok := NodeMetadataOperators[v.Value]; ok && v.Prop == NodeMetadataPropDimension {
+			operation = o
 		}
 	}
 	result := interpreter.OperatorNode{
@@ -473,12 +483,168 @@ func (n Node) FromOperatorNode(o interpreter.OperatorNode) Node {
 	}
 }
 
-//UpdateNodeMetadata updates the given node metadata. If the node metadata is not created, will create the same
+//Synonyms returns the synonyms of the node's word
+func (n Node) Synonyms() []string {
+	result := []string{}
+	for _, v := range n.NodeMetadatas {
+		if v.Prop == NodeMetadataPropSynonym && len(v.Value) > 0 {
+			result = append(result, v.Value)
+		}
+	}
+	return result
+}
+
+//HasSynonym returns true if the node has the given synonym. The comparison is case insensitive
+func (n Node) HasSynonym(synonym string) bool {
+	for _, v := range n.NodeMetadatas {
+		if v.Prop == NodeMetadataPropSynonym && strings.EqualFold(v.Value, synonym) {
+			return true
+		}
+	}
+	return false
+}
+
+//AddSynonym adds the synonym to the node's metadata. Returns false if the synonym is empty or already exists
+func (n *Node) AddSynonym(synonym string) bool {
+	synonym = strings.TrimSpace(synonym)
+	if len(synonym) == 0 || n.HasSynonym(synonym) {
+		return false
+	}
+	n.NodeMetadatas = append(n.NodeMetadatas, NodeMetadata{
+		NodeID:    n.ID,
+		DatasetID: n.DatasetID,
+		Prop:      NodeMetadataPropSynonym,
+		Value:     synonym,
+	})
+	return true
+}
+
+//RemoveSynonym removes the synonym from the node's metadata and returns the removed metadata.
+//The comparison is case insensitive
+func (n *Node) RemoveSynonym(synonym string) []NodeMetadata {
+	removed := []NodeMetadata{}
+	metadata := []NodeMetadata{}
+	for _, v := range n.NodeMetadatas {
+		if v.Prop == NodeMetadataPropSynonym && strings.EqualFold(v.Value, synonym) {
+			removed = append(removed, v)
+			continue
+		}
+		metadata = append(metadata, v)
+	}
+	n.NodeMetadatas = metadata
+	return removed
+}
+
+//AddNodeSynonyms adds the synonyms to the node in the database. Synonyms already existing for the node are skipped
+func AddNodeSynonyms(l log.Log, conn *gorm.DB, node *Node, synonyms []string) error {
+	/*
+	 * We will add the synonyms to the node
+	 * Then we will create the metadata for the newly added synonyms
+	 */
+	//adding the synonyms to the node
+	added := []NodeMetadata{}
+	for _, v := range synonyms {
+		if node.AddSynonym(v) {
+			added = append(added, node.NodeMetadatas[len(node.NodeMetadatas)-1])
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	//starting the transaction
+	tx := conn.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	//creating the metadata
+	for i := 0; i < len(added); i++ {
+		err := tx.Create(&added[i]).Error
+		if err != nil {
+			l.Error("error while creating the synonym", added[i].Value, "for the node", node.ID)
+			tx.Rollback()
+			return err
+		}
+	}
+	err := TouchDatasets(tx, []uint{node.DatasetID})
+	if err != nil {
+		l.Error("error while updating the update time of the dataset", node.DatasetID)
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	//updating the node with the created metadata
+	for i := len(node.NodeMetadatas) - len(added); i < len(node.NodeMetadatas); i++ {
+		node.NodeMetadatas[i] = added[i-len(node.NodeMetadatas)+len(added)]
+	}
+	return nil
+}
+
+//RemoveNodeSynonyms removes the synonyms of the node from the database
+func RemoveNodeSynonyms(l log.Log, conn *gorm.DB, node *Node, synonyms []string) error {
+	/*
+	 * We will remove the synonyms from the node
+	 * Then we will delete the metadata of the removed synonyms
+	 */
+	removed := []NodeMetadata{}
+	for _, v := range synonyms {
+		removed = append(removed, node.RemoveSynonym(v)...)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	//starting the transaction
+	tx := conn.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	//deleting the metadata
+	for _, v := range removed {
+		if v.ID == 0 {
+			continue
+		}
+		err := tx.Where("id = ? and node_id = ?", v.ID, node.ID).Delete(&NodeMetadata{}).Error
+		if err != nil {
+			l.Error("error while deleting the synonym", v.Value, "of the node", node.ID)
+			tx.Rollback()
+			return err
+		}
+	}
+	err := TouchDatasets(tx, []uint{node.DatasetID})
+	if err != nil {
+		l.Error("error while updating the update time of the dataset", node.DatasetID)
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+//UpdateNodeMetadata updates the given node metadata. If the node metadata is not created, will create the same.
+//The metadata are saved along with the update time of their datasets in a single transaction which is committed
+//only if all of them are saved
 func UpdateNodeMetadata(l log.Log, conn *gorm.DB, metadata []NodeMetadata) error {
 	/*
 	 * We will begin the transaction
 	 * Will iterate through the node metadata
 	 * And update the node metadata
+	 * Then we will bump the update time of the datasets and commit the transaction
 	 */
 	//starting the transaction
 	tx := conn.Begin()
@@ -492,6 +658,8 @@ func UpdateNodeMetadata(l log.Log, conn *gorm.DB, metadata []NodeMetadata) error
 	}
 
 	//iterating through the metadata
+	datasets := []uint{}
+	seen := map[uint]struct{}{}
 	for _, v := range metadata {
 		//and updating the metadata
 		err := tx.Where(" id = ? and dataset_id = ?", v.ID, v.DatasetID).Save(&v).Error
@@ -501,7 +669,19 @@ func UpdateNodeMetadata(l log.Log, conn *gorm.DB, metadata []NodeMetadata) error
 			tx.Rollback()
 			return err
 		}
+		if _, ok := seen[v.DatasetID]; !ok {
+			seen[v.DatasetID] = struct{}{}
+			datasets = append(datasets, v.DatasetID)
+		}
 	}
 
-	return nil
+	//bumping the update time of the datasets
+	err := TouchDatasets(tx, datasets)
+	if err != nil {
+		l.Error("error while updating the update time of the datasets", datasets)
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
 }
@@ -0,0 +1,100 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+/*
+ * This file contains the models of the organisations and the teams of the users
+ */
+
+//Organisation represents an organisation to which the teams of users belong
+type Organisation struct {
+	gorm.Model
+	//Name of the organisation
+	Name string
+	//Description is the description for the organisation
+	Description string
+}
+
+//Team represents a team of users in an organisation. The datasets shared with the team are accessible to all its members
+type Team struct {
+	gorm.Model
+	//Name of the team
+	Name string
+	//Description is the description for the team
+	Description string
+	//OrganisationID is the id of the organisation to which the team belongs
+	OrganisationID uint
+	//Locale is the locale of the system vocabulary in the shared dictionary of the team.
+	//Empty value means the default locale
+	Locale string
+}
+
+//TeamUserMapping has the mapping of a user to a team
+type TeamUserMapping struct {
+	gorm.Model
+	//TeamID is the ID of the team
+	TeamID uint
+	//UserID is the ID of the user
+	UserID uint
+}
+
+//DatasetTeamMapping has the mapping of a dataset shared with a team.
+//The access type is given to all the members of the team
+type DatasetTeamMapping struct {
+	gorm.Model
+	//DatasetID is the ID of the dataset
+	DatasetID uint
+	//TeamID is the ID of the team
+	TeamID uint
+	//AccessType is the type of access for the members of the team to the dataset
+	AccessType int
+}
+
+//GetTeams returns the teams of the organisation
+func (o Organisation) GetTeams(conn *gorm.DB) ([]Team, error) {
+	result := []Team{}
+	err := conn.Where("organisation_id = ?", o.ID).Find(&result).Error
+	return result, err
+}
+
+//GetDatasetIDs returns the ids of the datasets shared with the team
+func (t Team) GetDatasetIDs(conn *gorm.DB) ([]uint, error) {
+	datasets := []DatasetTeamMapping{}
+	err := conn.Where("team_id = ?", t.ID).Find(&datasets).Error
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint, 0, len(datasets))
+	for _, v := range datasets {
+		result = append(result, v.DatasetID)
+	}
+	return result, nil
+}
+
+//GetUserIDs returns the ids of the members of the team
+func (t Team) GetUserIDs(conn *gorm.DB) ([]uint, error) {
+	users := []TeamUserMapping{}
+	err := conn.Where("team_id = ?", t.ID).Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint, 0, len(users))
+	for _, v := range users {
+		result = append(result, v.UserID)
+	}
+	return result, nil
+}
+
+//GetUserTeams returns the teams the user is a member of
+func GetUserTeams(conn *gorm.DB, userID uint) ([]Team, error) {
+	result := []Team{}
+	err := conn.Joins("JOIN team_user_mappings ON team_user_mappings.team_id = teams.id AND team_user_mappings.deleted_at IS NULL").
+		Where("team_user_mappings.user_id = ?", userID).Find(&result).Error
+	return result, err
+}
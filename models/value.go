@@ -0,0 +1,92 @@
+// Copyright 2019 Cuttle.ai. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package models
+
+import (
+	"github.com/cuttle-ai/brain/log"
+	"github.com/cuttle-ai/octopus/interpreter"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+)
+
+/*
+ * This file contains the model implementation of the indexed values of the columns
+ */
+
+//ColumnValue is a distinct value of a dimension column indexed from the datastore of the dataset
+type ColumnValue struct {
+	gorm.Model
+	//UID is the unique id of the value
+	UID uuid.UUID
+	//NodeID is the id of the column node to which the value belongs to
+	NodeID uint
+	//DatasetID is the id of the dataset to which the column belongs to
+	DatasetID uint
+	//Value is the value of the column
+	Value string
+}
+
+//ValueNode returns the interpreter value node of the value for the given column
+func (c ColumnValue) ValueNode(column *interpreter.ColumnNode) interpreter.ValueNode {
+	return interpreter.ValueNode{
+		UID:  c.UID.String(),
+		Word: []rune(c.Value),
+		PUID: column.UID,
+		Name: c.Value,
+		PN:   column,
+	}
+}
+
+//GetColumnValues returns the indexed values of the columns of the dataset
+func GetColumnValues(conn *gorm.DB, datasetID uint) ([]ColumnValue, error) {
+	result := []ColumnValue{}
+	err := conn.Where("dataset_id = ?", datasetID).Find(&result).Error
+	return result, err
+}
+
+//GetDatasetsColumnValues returns the indexed values of the columns of all the given datasets
+func GetDatasetsColumnValues(conn *gorm.DB, datasetIDs []uint) ([]ColumnValue, error) {
+	result := []ColumnValue{}
+	err := conn.Where("dataset_id IN (?)", datasetIDs).Find(&result).Error
+	return result, err
+}
+
+//ReplaceColumnValues replaces the indexed values of the column with the given values
+func ReplaceColumnValues(l log.Log, conn *gorm.DB, datasetID, nodeID uint, values []string) error {
+	/*
+	 * We will use the db transactions to replace the values
+	 * We will delete the existing values of the column
+	 * Then will create the given values
+	 */
+	//starting the transaction
+	tx := conn.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+		}
+	}()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	//deleting the existing values. they are deleted permanently since they are re-created on every index
+	err := tx.Unscoped().Where("dataset_id = ? and node_id = ?", datasetID, nodeID).Delete(&ColumnValue{}).Error
+	if err != nil {
+		l.Error("error while deleting the existing values of the column", nodeID, "of the dataset", datasetID)
+		tx.Rollback()
+		return err
+	}
+
+	//creating the values
+	for _, v := range values {
+		err = tx.Create(&ColumnValue{UID: uuid.New(), NodeID: nodeID, DatasetID: datasetID, Value: v}).Error
+		if err != nil {
+			l.Error("error while creating the value of the column", nodeID, "of the dataset", datasetID)
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}